@@ -0,0 +1,91 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// The export templates and built frontend are compiled into the server so it runs from any
+// directory. `make web` copies the frontend into public before the server is built. all: keeps
+// built assets whose names start with _ or .
+var (
+	//go:embed templates/*.xml
+	templateFiles embed.FS
+
+	//go:embed all:public
+	publicFiles embed.FS
+)
+
+// publicPlaceholder keeps the public directory in git so the embed builds without a frontend.
+// It is not served.
+const publicPlaceholder = "README.md"
+
+// loadQDCTemplate parses the WSLS QDC template from dir, if given, or from the built in templates.
+// A dir is only needed to try out template changes without rebuilding.
+func loadQDCTemplate(dir string) (*template.Template, error) {
+	if dir != "" {
+		return template.ParseFiles(filepath.Join(dir, "wsls_qdc.xml"))
+	}
+	return template.ParseFS(templateFiles, "templates/wsls_qdc.xml")
+}
+
+// publicFS returns the frontend files from dir, if given, or the built in frontend
+func publicFS(dir string) (fs.FS, error) {
+	if dir != "" {
+		return os.DirFS(dir), nil
+	}
+	public, err := fs.Sub(publicFiles, "public")
+	if err != nil {
+		return nil, err
+	}
+	return withoutPlaceholder{public}, nil
+}
+
+// withoutPlaceholder hides the placeholder in the built in public directory
+type withoutPlaceholder struct {
+	fs.FS
+}
+
+func (w withoutPlaceholder) Open(name string) (fs.File, error) {
+	if name == publicPlaceholder {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return w.FS.Open(name)
+}
+
+// staticFileSystem serves frontend files with the gin static middleware
+type staticFileSystem struct {
+	http.FileSystem
+	files fs.FS
+}
+
+func newStaticFileSystem(files fs.FS) *staticFileSystem {
+	return &staticFileSystem{FileSystem: http.FS(files), files: files}
+}
+
+// Exists is true if the request path below prefix is a file or a directory with an index page
+func (s *staticFileSystem) Exists(prefix string, urlPath string) bool {
+	p := strings.TrimPrefix(urlPath, prefix)
+	if len(p) == len(urlPath) {
+		return false
+	}
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		name = "."
+	}
+	info, err := fs.Stat(s.files, name)
+	if err != nil {
+		return false
+	}
+	if info.IsDir() {
+		_, err = fs.Stat(s.files, path.Join(name, "index.html"))
+		return err == nil
+	}
+	return true
+}
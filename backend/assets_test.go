@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFrontendOverride(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "assets"), 0755)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<html>apollo</html>"), 0644)
+	os.WriteFile(filepath.Join(dir, "assets", "app.js"), []byte("console.log('apollo')"), 0644)
+	public, err := publicFS(dir)
+	if err != nil {
+		t.Fatalf("unable to open %s: %s", dir, err.Error())
+	}
+	router := newHandler(&Apollo{Version: "test", Repo: newMemoryRepository(), Public: public})
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/assets/app.js", http.StatusOK, "console.log"},
+		{"/", http.StatusOK, "<html>apollo</html>"},
+		{"/collections/uva-an1", http.StatusOK, "<html>apollo</html>"},
+		{"/api/types", http.StatusOK, "["},
+	}
+	for _, tc := range tests {
+		resp := doRequest(router, "GET", tc.path, "", "")
+		if resp.Code != tc.status || strings.Contains(resp.Body.String(), tc.body) == false {
+			t.Errorf("%s returned %d: %s", tc.path, resp.Code, resp.Body.String())
+		}
+	}
+}
+
+func TestBuiltInTemplates(t *testing.T) {
+	tmpl, err := loadQDCTemplate("")
+	if err != nil {
+		t.Fatalf("unable to load built in QDC template: %s", err.Error())
+	}
+	override, err := loadQDCTemplate("./templates")
+	if err != nil {
+		t.Fatalf("unable to load QDC template from directory: %s", err.Error())
+	}
+	if tmpl.Name() != override.Name() {
+		t.Errorf("built in template is %s; directory template is %s", tmpl.Name(), override.Name())
+	}
+}
+
+func TestPlaceholderNotServed(t *testing.T) {
+	router := newTestRouter(t)
+	resp := doRequest(router, "GET", "/"+publicPlaceholder, "", "")
+	if resp.Code == http.StatusOK {
+		t.Errorf("placeholder is served: %s", resp.Body.String())
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// AuditEntry records a change to a single field of a node; who made it, when, and the old and new values
+type AuditEntry struct {
+	ID           int64     `db:"id" json:"id"`
+	ComputingID  string    `db:"computing_id" json:"user"`
+	Action       string    `db:"action" json:"action"`
+	CollectionID int64     `db:"collection_id" json:"-"`
+	NodeID       int64     `db:"node_id" json:"-"`
+	NodePID      string    `db:"node_pid" json:"nodePID,omitempty"`
+	NodeType     string    `db:"node_type" json:"nodeType,omitempty"`
+	Field        string    `db:"field" json:"field,omitempty"`
+	OldValue     string    `db:"old_value" json:"oldValue"`
+	NewValue     string    `db:"new_value" json:"newValue"`
+	CreatedAt    time.Time `db:"created_at" json:"createdAt"`
+}
+
+// auditSelect is the base query for audit entries. Empty columns are returned as blanks
+const auditSelect = `SELECT a.id, a.computing_id, a.action, COALESCE(a.collection_id, 0) as collection_id,
+ COALESCE(a.node_id, 0) as node_id, COALESCE(a.node_pid, '') as node_pid, COALESCE(a.node_type, '') as node_type,
+ a.field, COALESCE(a.old_value, '') as old_value, COALESCE(a.new_value, '') as new_value, a.created_at
+ FROM audit_log a`
+
+// auditRecord builds the audit entry for a change to a field of a node
+func auditRecord(computingID string, action string, node *moveNode, nodeType string, field string, oldVal string, newVal string) AuditEntry {
+	return AuditEntry{ComputingID: computingID, Action: action,
+		CollectionID: ancestryRootID(node.ID, node.Ancestry.String),
+		NodeID:       node.ID, NodePID: node.PID, NodeType: nodeType,
+		Field: field, OldValue: oldVal, NewValue: newVal,
+	}
+}
+
+// logAudit writes an audit entry and queues the webhook event for it. It must be called in the
+// same transaction as the change it records
+func logAudit(tx *sqlx.Tx, entry AuditEntry) error {
+	_, err := tx.Exec(`INSERT INTO audit_log
+		(computing_id, action, collection_id, node_id, node_pid, node_type, field, old_value, new_value, created_at)
+		VALUES (?, ?, NULLIF(?, 0), NULLIF(?, 0), NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, NOW(6))`,
+		entry.ComputingID, entry.Action, entry.CollectionID, entry.NodeID, entry.NodePID, entry.NodeType,
+		entry.Field, entry.OldValue, entry.NewValue)
+	if err != nil {
+		return err
+	}
+	if evt, ok := auditWebhookEvent(entry); ok {
+		return queueWebhookEvent(tx, entry.CollectionID, evt)
+	}
+	return nil
+}
+
+// nodeTypeName returns the name of the type of a node. A failed lookup is logged to the request log
+// and leaves the type out of the audit entry rather than failing the change.
+func nodeTypeName(tx *sqlx.Tx, logger *log.Logger, nodeID int64) string {
+	var name string
+	err := tx.Get(&name, "SELECT nt.name FROM nodes n INNER JOIN node_types nt ON nt.id=n.node_type_id WHERE n.id=?", nodeID)
+	if err != nil {
+		logger.Printf("WARNING: unable to get type of node %d: %s", nodeID, err.Error())
+	}
+	return name
+}
+
+// auditFilter selects audit entries. Blank and zero fields are not filtered on. Entries are from
+// Start up to but not including End.
+type auditFilter struct {
+	User         string
+	NodeType     string
+	CollectionID int64
+	Start        time.Time
+	End          time.Time
+}
+
+// matches reports if an entry passes the filter
+func (f *auditFilter) matches(entry *AuditEntry) bool {
+	switch {
+	case f.User != "" && entry.ComputingID != f.User:
+		return false
+	case f.NodeType != "" && entry.NodeType != f.NodeType:
+		return false
+	case f.CollectionID != 0 && entry.CollectionID != f.CollectionID:
+		return false
+	case f.Start.IsZero() == false && entry.CreatedAt.Before(f.Start):
+		return false
+	case f.End.IsZero() == false && entry.CreatedAt.Before(f.End) == false:
+		return false
+	}
+	return true
+}
+
+// where returns the SQL where clause and args for the filter
+func (f *auditFilter) where() (string, []interface{}) {
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+	if f.User != "" {
+		where = append(where, "a.computing_id=?")
+		args = append(args, f.User)
+	}
+	if f.NodeType != "" {
+		where = append(where, "a.node_type=?")
+		args = append(args, f.NodeType)
+	}
+	if f.CollectionID != 0 {
+		where = append(where, "a.collection_id=?")
+		args = append(args, f.CollectionID)
+	}
+	if f.Start.IsZero() == false {
+		where = append(where, "a.created_at >= ?")
+		args = append(args, f.Start)
+	}
+	if f.End.IsZero() == false {
+		where = append(where, "a.created_at < ?")
+		args = append(args, f.End)
+	}
+	if len(where) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(where, " and "), args
+}
+
+// GetAuditLog returns audit entries, newest first. They can be filtered with the user, collection (PID),
+// type (node type name), start and end (dates or RFC3339 timestamps) query params. The json response
+// is paged with offset and limit. Use format=csv to export all matching entries as CSV.
+func (app *Apollo) GetAuditLog(c *gin.Context) {
+	filter := auditFilter{User: c.Query("user"), NodeType: c.Query("type")}
+	if pid := c.Query("collection"); pid != "" {
+		collIDs, err := app.repo(c).LookupIdentifier(pid)
+		if err != nil {
+			requestLog(c).Printf("ERROR: %s", err.Error())
+			c.String(http.StatusNotFound, err.Error())
+			return
+		}
+		filter.CollectionID = collIDs.ID
+	}
+	for _, param := range []string{"start", "end"} {
+		if c.Query(param) == "" {
+			continue
+		}
+		ts, err := parseTimeParam(c.Query(param))
+		if err != nil {
+			requestLog(c).Printf("ERROR: invalid audit %s %s", param, c.Query(param))
+			c.String(http.StatusBadRequest, fmt.Sprintf("invalid %s: %s", param, c.Query(param)))
+			return
+		}
+		if param == "start" {
+			filter.Start = ts
+		} else {
+			// a date-only end includes the whole day
+			if len(c.Query(param)) == len("2006-01-02") {
+				ts = ts.AddDate(0, 0, 1)
+			}
+			filter.End = ts
+		}
+	}
+
+	if c.Query("format") == "csv" {
+		app.exportAuditCSV(c, &filter)
+		return
+	}
+
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	out := struct {
+		Total   int          `json:"total"`
+		Offset  int          `json:"offset"`
+		Limit   int          `json:"limit"`
+		Entries []AuditEntry `json:"entries"`
+	}{Offset: offset, Limit: limit}
+	var err error
+	out.Total, out.Entries, err = app.repo(c).GetAuditLog(&filter, offset, limit)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to get audit entries: %s", err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// exportAuditCSV streams all audit entries matching the filter as a CSV attachment
+func (app *Apollo) exportAuditCSV(c *gin.Context, filter *auditFilter) {
+	var out *csv.Writer
+	start := func() {
+		c.Header("Content-Disposition", "attachment; filename=apollo_audit.csv")
+		c.Header("Content-Type", "text/csv")
+		c.Status(http.StatusOK)
+		out = csv.NewWriter(c.Writer)
+		out.Write([]string{"timestamp", "user", "action", "node_pid", "node_type", "field", "old_value", "new_value"})
+	}
+	cnt := 0
+	err := app.repo(c).ExportAuditLog(filter, func(entry *AuditEntry) error {
+		if out == nil {
+			start()
+		}
+		cnt++
+		return out.Write([]string{entry.CreatedAt.Format(time.RFC3339), entry.ComputingID, entry.Action,
+			entry.NodePID, entry.NodeType, entry.Field, entry.OldValue, entry.NewValue})
+	})
+	if err != nil && out == nil {
+		requestLog(c).Printf("ERROR: unable to export audit entries: %s", err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to read audit entry: %s", err.Error())
+	}
+	if out == nil {
+		start()
+	}
+	out.Flush()
+	requestLog(c).Printf("INFO: exported %d audit entries", cnt)
+}
+
+// getAuditLog returns the total number of entries matching the filter and one page of them, newest first
+func getAuditLog(db *DB, filter *auditFilter, offset int, limit int) (int, []AuditEntry, error) {
+	where, args := filter.where()
+	var total int
+	err := db.Get(&total, fmt.Sprintf("SELECT count(*) FROM audit_log a %s", where), args...)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to count audit entries: %s", err.Error())
+	}
+	out := make([]AuditEntry, 0)
+	qs := fmt.Sprintf(`%s %s ORDER BY a.created_at DESC, a.id DESC LIMIT ? OFFSET ?`, auditSelect, where)
+	err = db.Select(&out, qs, append(args, limit, offset)...)
+	return total, out, err
+}
+
+// exportAuditLog calls each for every entry matching the filter, newest first. It stops at the first error.
+func exportAuditLog(db *DB, filter *auditFilter, each func(entry *AuditEntry) error) error {
+	where, args := filter.where()
+	rows, err := db.Queryx(fmt.Sprintf(`%s %s ORDER BY a.created_at DESC, a.id DESC`, auditSelect, where), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry AuditEntry
+		err = rows.StructScan(&entry)
+		if err == nil {
+			err = each(&entry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// parseTimeParam accepts a date (2006-01-02) or a full RFC3339 timestamp
+func parseTimeParam(val string) (time.Time, error) {
+	if ts, err := time.ParseInLocation("2006-01-02", val, time.UTC); err == nil {
+		return ts, nil
+	}
+	return time.Parse(time.RFC3339, val)
+}
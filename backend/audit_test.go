@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// auditPage is a page of the audit log as returned by the API
+type auditPage struct {
+	Total   int          `json:"total"`
+	Entries []AuditEntry `json:"entries"`
+}
+
+func TestAuditLog(t *testing.T) {
+	router := newTestRouter(t)
+	var page auditPage
+	checkJSON(t, doRequest(router, "GET", "/api/audit", "", "user1"), http.StatusOK, &page)
+	if page.Total != 0 || len(page.Entries) != 0 {
+		t.Fatalf("audit log has %d entries before any changes", page.Total)
+	}
+
+	body := fmt.Sprintf(`{"title":"Salem fire, 1951","version":"%s"}`, currentVersion(t, router, "uva-an109894"))
+	if resp := doRequest(router, "POST", "/api/nodes/109894/update", body, "user1"); resp.Code != http.StatusOK {
+		t.Fatalf("update returned %d: %s", resp.Code, resp.Body.String())
+	}
+	resp := doRequest(router, "DELETE", "/api/nodes/uva-an16?version="+currentVersion(t, router, "uva-an16"), "", "user2")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("delete returned %d: %s", resp.Code, resp.Body.String())
+	}
+
+	checkJSON(t, doRequest(router, "GET", "/api/audit", "", "user1"), http.StatusOK, &page)
+	if page.Total != 2 || len(page.Entries) != 2 {
+		t.Fatalf("audit log has entries %+v", page.Entries)
+	}
+	deleted, updated := page.Entries[0], page.Entries[1]
+	if deleted.ComputingID != "user2" || deleted.Action != "delete" || deleted.NodePID != "uva-an16" || deleted.NodeType != "issue" {
+		t.Errorf("unexpected delete entry %+v", deleted)
+	}
+	if updated.ComputingID != "user1" || updated.Action != "update" || updated.NodePID != "uva-an109895" ||
+		updated.OldValue != "Salem fire" || updated.NewValue != "Salem fire, 1951" {
+		t.Errorf("unexpected update entry %+v", updated)
+	}
+
+	tests := []struct {
+		query string
+		total int
+		first string
+	}{
+		{"user=user1", 1, "update"},
+		{"collection=uva-an1", 1, "delete"},
+		{"type=title", 1, "update"},
+		{"start=2019-05-02", 2, "delete"},
+		{"end=2019-05-02", 0, ""},
+		{"offset=1&limit=1", 2, "update"},
+	}
+	for _, tc := range tests {
+		checkJSON(t, doRequest(router, "GET", "/api/audit?"+tc.query, "", "user1"), http.StatusOK, &page)
+		first := ""
+		if len(page.Entries) > 0 {
+			first = page.Entries[0].Action
+		}
+		if page.Total != tc.total || first != tc.first {
+			t.Errorf("audit log with %s has %d entries starting with %q, expected %d starting with %q",
+				tc.query, page.Total, first, tc.total, tc.first)
+		}
+	}
+	for _, query := range []string{"start=yesterday", "end=2019-13-01"} {
+		if resp := doRequest(router, "GET", "/api/audit?"+query, "", "user1"); resp.Code != http.StatusBadRequest {
+			t.Errorf("audit log with %s returned %d, expected %d", query, resp.Code, http.StatusBadRequest)
+		}
+	}
+	if resp := doRequest(router, "GET", "/api/audit?collection=uva-an99999", "", "user1"); resp.Code != http.StatusNotFound {
+		t.Errorf("audit log of an unknown collection returned %d, expected %d", resp.Code, http.StatusNotFound)
+	}
+}
+
+func TestAuditExport(t *testing.T) {
+	router := newTestRouter(t)
+	body := fmt.Sprintf(`{"title":"Salem fire, 1951","version":"%s"}`, currentVersion(t, router, "uva-an109894"))
+	if resp := doRequest(router, "POST", "/api/nodes/109894/update", body, "user1"); resp.Code != http.StatusOK {
+		t.Fatalf("update returned %d: %s", resp.Code, resp.Body.String())
+	}
+
+	tests := []struct {
+		query string
+		rows  int
+	}{
+		{"format=csv", 2},
+		{"format=csv&user=user2", 1},
+	}
+	for _, tc := range tests {
+		resp := doRequest(router, "GET", "/api/audit?"+tc.query, "", "user1")
+		if resp.Code != http.StatusOK || strings.HasPrefix(resp.Header().Get("Content-Type"), "text/csv") == false {
+			t.Fatalf("audit export with %s returned %d %s", tc.query, resp.Code, resp.Header().Get("Content-Type"))
+		}
+		rows, err := csv.NewReader(resp.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("audit export with %s is not valid csv: %s", tc.query, err.Error())
+		}
+		if len(rows) != tc.rows || rows[0][0] != "timestamp" {
+			t.Errorf("audit export with %s has rows %v", tc.query, rows)
+		}
+	}
+
+	rows, _ := csv.NewReader(doRequest(router, "GET", "/api/audit?format=csv", "", "user1").Body).ReadAll()
+	expected := []string{"user1", "update", "uva-an109895", "title", "value", "Salem fire", "Salem fire, 1951"}
+	if strings.Join(rows[1][1:], "|") != strings.Join(expected, "|") {
+		t.Errorf("audit export row is %v, expected %v", rows[1][1:], expected)
+	}
+}
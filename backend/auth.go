@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authMiddleware identifies the user making a request that changes data. Apollo is served
+// behind Shibboleth which passes the computing ID of the authenticated user in the
+// remote_user header. In dev mode, the devuser from the config is used instead.
+func (app *Apollo) authMiddleware(c *gin.Context) {
+	computingID := app.remoteUser(c)
+	if computingID == "" {
+		requestLog(c).Printf("ERROR: unauthenticated %s request for %s", c.Request.Method, c.Request.URL.Path)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Set("computingID", computingID)
+	c.Next()
+}
+
+// remoteUser is the computing ID of the user making the request, or blank if there isn't one
+func (app *Apollo) remoteUser(c *gin.Context) string {
+	if app.DevAuthUser != "" {
+		return app.DevAuthUser
+	}
+	return c.GetHeader("remote_user")
+}
+
+// adminMiddleware only allows requests from users listed as admins in the config.
+// It must be used after authMiddleware.
+func (app *Apollo) adminMiddleware(c *gin.Context) {
+	computingID := c.GetString("computingID")
+	for _, admin := range app.Admins {
+		if admin == computingID {
+			c.Next()
+			return
+		}
+	}
+	requestLog(c).Printf("ERROR: %s is not an admin and cannot %s %s", computingID, c.Request.Method, c.Request.URL.Path)
+	c.AbortWithStatus(http.StatusForbidden)
+}
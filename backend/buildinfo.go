@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Build metadata. The Makefile stamps these at build time with
+// -ldflags "-X main.version=... -X main.build=... -X main.commit=... -X main.buildTime=..."
+var (
+	version   = "3.0.1"
+	build     = "unknown"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+// dependency is a module the server was built with
+type dependency struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+}
+
+// buildInfo describes the running binary. Build is first since the deploy pipeline reads the
+// first value in the /version response to wait for a new build.
+type buildInfo struct {
+	Build        string       `json:"build"`
+	Version      string       `json:"version"`
+	Commit       string       `json:"commit"`
+	BuildTime    string       `json:"build_time"`
+	GoVersion    string       `json:"go_version"`
+	Dependencies []dependency `json:"dependencies"`
+}
+
+// getBuildInfo combines the stamped metadata with the module info Go records in the binary.
+// The commit falls back to the VCS revision Go records when the build wasn't stamped.
+func getBuildInfo() buildInfo {
+	out := buildInfo{Build: build, Version: version, Commit: commit, BuildTime: buildTime,
+		GoVersion: runtime.Version(), Dependencies: make([]dependency, 0)}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return out
+	}
+	for _, setting := range bi.Settings {
+		if setting.Key == "vcs.revision" && out.Commit == "unknown" {
+			out.Commit = setting.Value
+		}
+		if setting.Key == "vcs.time" && out.BuildTime == "unknown" {
+			out.BuildTime = setting.Value
+		}
+	}
+	for _, dep := range bi.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		out.Dependencies = append(out.Dependencies, dependency{Path: dep.Path, Version: dep.Version})
+	}
+	return out
+}
+
+// printBuildInfo writes the build info for the -version flag
+func printBuildInfo(out io.Writer) {
+	info := getBuildInfo()
+	fmt.Fprintf(out, "apollosvr %s\n", info.Version)
+	fmt.Fprintf(out, "  build:      %s\n", info.Build)
+	fmt.Fprintf(out, "  commit:     %s\n", info.Commit)
+	fmt.Fprintf(out, "  build time: %s\n", info.BuildTime)
+	fmt.Fprintf(out, "  go version: %s\n", info.GoVersion)
+	if len(info.Dependencies) > 0 {
+		fmt.Fprintf(out, "  dependencies:\n")
+		for _, dep := range info.Dependencies {
+			fmt.Fprintf(out, "    %s %s\n", dep.Path, dep.Version)
+		}
+	}
+}
+
+// versionInfo reports the version and build of the service
+func (app *Apollo) versionInfo(c *gin.Context) {
+	c.JSON(http.StatusOK, getBuildInfo())
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	router := newTestRouter(t)
+	resp := doRequest(router, "GET", "/version", "", "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("version returned %d: %s", resp.Code, resp.Body.String())
+	}
+	// the deploy pipeline waits for the new build by reading the first value
+	if strings.HasPrefix(resp.Body.String(), `{"build":"`+build+`"`) == false {
+		t.Errorf("build is not the first value: %s", resp.Body.String())
+	}
+	var info buildInfo
+	if err := json.Unmarshal(resp.Body.Bytes(), &info); err != nil {
+		t.Fatalf("version is not valid json: %s", err.Error())
+	}
+	if info.Version != version || info.GoVersion == "" {
+		t.Errorf("unexpected build info: %+v", info)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// maxValueLength is the size of the nodes.value column
+const maxValueLength = 512
+
+// BulkReplaceRequest describes a find and replace across all nodes of one type in a collection or subtree.
+// Pattern is a literal string unless Regex is set; then it is a regex and the replacement can use $1 style
+// submatch references. Nothing is changed unless Apply is set, so a request without it is a preview.
+// Applying requires the Version returned by the preview.
+type BulkReplaceRequest struct {
+	Type        string `json:"type"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	Regex       bool   `json:"regex"`
+	IgnoreCase  bool   `json:"ignoreCase"`
+	Apply       bool   `json:"apply"`
+	Version     string `json:"version"`
+}
+
+// BulkChange is a single node value affected by a bulk replace
+type BulkChange struct {
+	ID      int64  `db:"id" json:"id"`
+	PID     string `db:"pid" json:"pid"`
+	ItemID  int64  `db:"item_id" json:"-"`
+	ItemPID string `db:"item_pid" json:"itemPID"`
+	Before  string `db:"value" json:"before"`
+	After   string `db:"-" json:"after"`
+}
+
+// BulkReplaceResults lists all of the changes made (or that would be made) by a bulk replace.
+// Version identifies the set of changes in a preview; it changes if any affected value changes.
+type BulkReplaceResults struct {
+	Applied bool         `json:"applied"`
+	Version string       `json:"version"`
+	Total   int          `json:"total"`
+	Changes []BulkChange `json:"changes"`
+}
+
+// bulkReplace is a validated bulk replace request for the repository to plan or apply
+type bulkReplace struct {
+	BulkReplaceRequest
+	RootID             int64
+	NodeType           *NodeType
+	User               string
+	RejectDuplicateIDs bool
+	re                 *regexp.Regexp
+}
+
+// BulkReplace finds and replaces text in the values of all nodes of a type within a collection or subtree.
+// By default this is a preview. When applied, all changes are made in a single transaction and
+// a revision is saved for every changed node.
+func (app *Apollo) BulkReplace(c *gin.Context) {
+	var req BulkReplaceRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		requestLog(c).Printf("ERROR: invalid bulk replace request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Type == "" || req.Pattern == "" {
+		c.String(http.StatusBadRequest, "type and pattern are required")
+		return
+	}
+	pattern := req.Pattern
+	if req.Regex == false {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if req.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		requestLog(c).Printf("ERROR: invalid bulk replace pattern %s: %s", req.Pattern, err.Error())
+		c.String(http.StatusBadRequest, fmt.Sprintf("invalid pattern: %s", err.Error()))
+		return
+	}
+
+	nodeType, err := app.repo(c).GetNodeType(req.Type)
+	if err != nil {
+		requestLog(c).Printf("ERROR: bulk replace requested for unknown type %s: %s", req.Type, err.Error())
+		c.String(http.StatusNotFound, req.Type+" not found")
+		return
+	}
+	if nodeType.Container || nodeType.ControlledVocab {
+		requestLog(c).Printf("ERROR: bulk replace requested for unsupported type %s", req.Type)
+		c.String(http.StatusBadRequest, fmt.Sprintf("%s values cannot be replaced", req.Type))
+		return
+	}
+
+	rootIDs, dbErr := app.repo(c).LookupIdentifier(c.Param("id"))
+	if dbErr != nil {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
+		return
+	}
+
+	// the changes applied must be exactly the ones the client saw in the preview
+	req.Version = requestVersion(c, req.Version)
+	if req.Apply && versionMissing(c, req.Version) {
+		return
+	}
+
+	requestLog(c).Printf("INFO: %s requests bulk replace of %s in %s values under %s; apply=%t",
+		c.GetString("computingID"), req.Pattern, req.Type, rootIDs.PID, req.Apply)
+	out, err := app.repo(c).BulkReplace(&bulkReplace{BulkReplaceRequest: req, RootID: rootIDs.ID, NodeType: nodeType,
+		User: c.GetString("computingID"), RejectDuplicateIDs: app.RejectDuplicateIDs, re: re})
+	var stale *versionError
+	if errors.As(err, &stale) {
+		requestLog(c).Printf("INFO: bulk replace preview version %s is stale; current version is %s", req.Version, out.Version)
+		c.JSON(http.StatusConflict, out)
+		return
+	}
+	if err != nil {
+		app.changeFailed(c, err, 0)
+		return
+	}
+
+	if out.Applied {
+		requestLog(c).Printf("INFO: bulk replace updated %d %s values under %s", out.Total, req.Type, rootIDs.PID)
+	} else {
+		requestLog(c).Printf("INFO: bulk replace preview found %d changes", out.Total)
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// planBulkReplace works out the changes a bulk replace makes to the candidate values. The values must be
+// in ID order. New identifier values are checked with find, and against the values given to other items
+// by the same replace. The version of the plan identifies the set of changes; when the request is to be
+// applied with a different version, the plan is returned with a versionError.
+func planBulkReplace(logger *log.Logger, req *bulkReplace, candidates []BulkChange, collectionPID string,
+	find func(value string, excludeItemID int64) ([]IdentifierMatch, error)) (*BulkReplaceResults, error) {
+	out := BulkReplaceResults{Changes: make([]BulkChange, 0)}
+	batch := make(identifierBatch)
+	for _, change := range candidates {
+		if req.re.MatchString(change.Before) == false {
+			continue
+		}
+		if req.Regex {
+			change.After = req.re.ReplaceAllString(change.Before, req.Replacement)
+		} else {
+			change.After = req.re.ReplaceAllLiteralString(change.Before, req.Replacement)
+		}
+		if change.After == change.Before {
+			continue
+		}
+		if utf8.RuneCountInString(change.After) > maxValueLength {
+			return nil, refuseChange(http.StatusBadRequest, "new value for %s is longer than %d characters", change.PID, maxValueLength)
+		}
+		if isIdentifierType(req.Type) {
+			matches, err := find(change.After, change.ItemID)
+			if err != nil {
+				return nil, fmt.Errorf("unable to check %s %s: %s", req.Type, change.After, err.Error())
+			}
+			matches = append(matches, batch.matches(req.Type, change.After, change.ItemID)...)
+			batch.add(req.Type, change.After, IdentifierMatch{Type: req.Type, ID: change.ItemID, PID: change.ItemPID,
+				CollectionPID: collectionPID})
+			if identifierCheck(logger, req.RejectDuplicateIDs, req.Type, change.After, matches).Allowed == false {
+				return nil, refuseChange(http.StatusConflict, "%s %s for %s is already used by another item", req.Type, change.After, change.ItemPID)
+			}
+		}
+		out.Changes = append(out.Changes, change)
+	}
+	out.Total = len(out.Changes)
+	versionParts := make([]interface{}, 0, len(out.Changes)*2)
+	for _, change := range out.Changes {
+		versionParts = append(versionParts, change.ID, change.Before)
+	}
+	out.Version = makeVersion(versionParts...)
+	if req.Apply && req.Version != out.Version {
+		return &out, &versionError{NodeID: req.RootID, Version: out.Version}
+	}
+	return &out, nil
+}
+
+// bulkReplaceValues plans a bulk replace and, when requested, applies it in a single transaction
+func bulkReplaceValues(db *DB, req *bulkReplace) (*BulkReplaceResults, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	root, err := getMoveNode(tx, req.RootID)
+	if err != nil {
+		return nil, refuseChange(http.StatusNotFound, "node %d not found", req.RootID)
+	}
+
+	// find all nodes of the requested type below the root
+	lock := ""
+	if req.Apply {
+		lock = "FOR UPDATE"
+	}
+	qs := fmt.Sprintf(`SELECT n.id, n.pid, np.id as item_id, np.pid as item_pid, n.value FROM nodes n
+		INNER JOIN nodes np ON np.id = n.parent_id
+		WHERE n.node_type_id=? and n.deleted=0 and n.current=1 and (n.ancestry=? or n.ancestry LIKE ?)
+		ORDER BY n.id ASC %s`, lock)
+	var candidates []BulkChange
+	err = tx.Select(&candidates, qs, req.NodeType.ID, root.childAncestry(), root.childAncestry()+"/%")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get %s values under %s: %s", req.Type, root.PID, err.Error())
+	}
+
+	collectionID := ancestryRootID(root.ID, root.Ancestry.String)
+	collectionPID := root.PID
+	if collectionID != root.ID {
+		err = tx.Get(&collectionPID, "SELECT pid FROM nodes WHERE id=?", collectionID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get collection of %s: %s", root.PID, err.Error())
+		}
+	}
+
+	// identifiers are checked in the transaction so the values written are the ones checked
+	out, err := planBulkReplace(db.Log, req, candidates, collectionPID, func(value string, excludeItemID int64) ([]IdentifierMatch, error) {
+		return findIdentifier(tx, req.Type, value, excludeItemID)
+	})
+	if err != nil || req.Apply == false {
+		return out, err
+	}
+
+	for _, change := range out.Changes {
+		err = reviseNodeValue(tx, change.ID, change.After)
+		if err == nil {
+			err = logAudit(tx, AuditEntry{ComputingID: req.User, Action: "update",
+				CollectionID: collectionID, NodeID: change.ID, NodePID: change.PID, NodeType: req.Type,
+				Field: "value", OldValue: change.Before, NewValue: change.After})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to update %s: %s", change.PID, err.Error())
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("unable to commit bulk replace: %s", err.Error())
+	}
+	out.Applied = true
+	return out, nil
+}
+
+// reviseNodeValue updates the value of a node after saving its current state as a revision. Per the schema,
+// a revision is a copy of the node that is not current and has a PID with a .# suffix; pid.1, pid.2 and so on.
+func reviseNodeValue(tx *sqlx.Tx, nodeID int64, value string) error {
+	var pid string
+	err := tx.Get(&pid, "SELECT pid FROM nodes WHERE id=?", nodeID)
+	if err != nil {
+		return err
+	}
+	var revision int
+	err = tx.Get(&revision, "SELECT count(*)+1 FROM nodes WHERE pid LIKE ?", pid+".%")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO nodes (pid, parent_id, ancestry, sequence, node_type_id, value, user_id, deleted, current, created_at, updated_at)
+		SELECT CONCAT(pid, '.', ?), parent_id, ancestry, sequence, node_type_id, value, user_id, deleted, 0, created_at, updated_at
+		FROM nodes WHERE id=?`, revision, nodeID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE nodes SET value=?, updated_at=NOW(6) WHERE id=?", value, nodeID)
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestBulkReplaceErrors(t *testing.T) {
+	router := newTestRouter(t)
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"type":"title"}`, http.StatusBadRequest},
+		{`{"type":"title","pattern":"(","regex":true}`, http.StatusBadRequest},
+		{`{"type":"nope","pattern":"Vol."}`, http.StatusNotFound},
+		{`{"type":"volume","pattern":"Vol."}`, http.StatusBadRequest},
+		{`{"type":"title","pattern":"Vol.","replacement":"Volume","apply":true}`, http.StatusPreconditionRequired},
+	}
+	for _, tc := range tests {
+		resp := doRequest(router, "POST", "/api/nodes/uva-an1/replace", tc.body, "user1")
+		if resp.Code != tc.status {
+			t.Errorf("replace %s returned %d, expected %d: %s", tc.body, resp.Code, tc.status, resp.Body.String())
+		}
+	}
+}
+
+func TestBulkReplace(t *testing.T) {
+	router := newTestRouter(t)
+	var preview BulkReplaceResults
+	checkJSON(t, doRequest(router, "POST", "/api/nodes/uva-an1/replace",
+		`{"type":"title","pattern":"Vol. 2","replacement":"Volume 2"}`, "user1"), http.StatusOK, &preview)
+	if preview.Applied || preview.Total != 2 || preview.Version == "" {
+		t.Fatalf("unexpected preview %+v", preview)
+	}
+	for _, change := range preview.Changes {
+		if change.After != "Volume 2"+change.Before[len("Vol. 2"):] {
+			t.Errorf("preview changes %q to %q", change.Before, change.After)
+		}
+	}
+	if got := getChildPage(t, router, "uva-an1").Children[1].Title; got != "Vol. 2, 1910-1911" {
+		t.Errorf("preview changed the vol 2 title to %q", got)
+	}
+
+	// a preview that does not match the current values is rejected with the current changes
+	var stale BulkReplaceResults
+	checkJSON(t, doRequest(router, "POST", "/api/nodes/uva-an1/replace",
+		`{"type":"title","pattern":"Vol. 2","replacement":"Volume 2","apply":true,"version":"stale"}`, "user1"),
+		http.StatusConflict, &stale)
+	if stale.Applied || stale.Version != preview.Version || stale.Total != 2 {
+		t.Errorf("unexpected stale response %+v", stale)
+	}
+
+	body := fmt.Sprintf(`{"type":"title","pattern":"Vol. 2","replacement":"Volume 2","apply":true,"version":"%s"}`, preview.Version)
+	var applied BulkReplaceResults
+	checkJSON(t, doRequest(router, "POST", "/api/nodes/uva-an1/replace", body, "user1"), http.StatusOK, &applied)
+	if applied.Applied == false || applied.Total != 2 {
+		t.Fatalf("unexpected apply response %+v", applied)
+	}
+	if got := getChildPage(t, router, "uva-an1").Children[1].Title; got != "Volume 2, 1910-1911" {
+		t.Errorf("vol 2 title is %q after the replace", got)
+	}
+	if got := getChildPage(t, router, "uva-an20").Children[0].Title; got != "Volume 2, no. 1, March, 1910" {
+		t.Errorf("vol 2 issue title is %q after the replace", got)
+	}
+	if got := getChildPage(t, router, "uva-an1").Children[0].Title; got != "Vol. 1, 1909-1910" {
+		t.Errorf("vol 1 title is %q after the replace", got)
+	}
+
+	// the values changed, so the preview cannot be applied again
+	resp := doRequest(router, "POST", "/api/nodes/uva-an1/replace", body, "user1")
+	if resp.Code != http.StatusConflict {
+		t.Errorf("second apply returned %d, expected %d", resp.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Change is a container node that was created, updated or deleted. A container is updated when
+// it or any of its attributes change. Deleted containers are tombstones; only the PID and time remain.
+type Change struct {
+	ID            int64          `db:"id" json:"-"`
+	PID           string         `db:"pid" json:"pid"`
+	Ancestry      sql.NullString `db:"ancestry" json:"-"`
+	CollectionPID string         `db:"-" json:"collection"`
+	Change        string         `db:"-" json:"change"`
+	CreatedAt     time.Time      `db:"created_at" json:"-"`
+	Deleted       bool           `db:"deleted" json:"-"`
+	ChangedAt     time.Time      `db:"changed_at" json:"changedAt"`
+}
+
+// ChangeFeed is a page of changes in the order they happened. When there are more, pass
+// Cursor back as the cursor param to get the next page.
+type ChangeFeed struct {
+	Since   time.Time `json:"since"`
+	Cursor  string    `json:"cursor,omitempty"`
+	More    bool      `json:"more"`
+	Changes []Change  `json:"changes"`
+}
+
+// changeCursor is the position of the last change returned in a feed along with the original
+// since time, so created and updated are reported consistently across pages
+type changeCursor struct {
+	Since     time.Time
+	ChangedAt time.Time
+	ID        int64
+}
+
+func (cc *changeCursor) encode() string {
+	raw := fmt.Sprintf("%s|%s|%d", cc.Since.Format(time.RFC3339Nano), cc.ChangedAt.Format(time.RFC3339Nano), cc.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeChangeCursor(val string) (*changeCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(val)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	bits := strings.Split(string(raw), "|")
+	if len(bits) != 3 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var out changeCursor
+	out.Since, err = time.Parse(time.RFC3339Nano, bits[0])
+	if err == nil {
+		out.ChangedAt, err = time.Parse(time.RFC3339Nano, bits[1])
+	}
+	if err == nil {
+		out.ID, err = strconv.ParseInt(bits[2], 10, 64)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &out, nil
+}
+
+// GetChanges returns the containers in all collections that changed after the since query
+// param (a date or RFC3339 timestamp). Page with the limit and cursor params.
+func (app *Apollo) GetChanges(c *gin.Context) {
+	app.getChangeFeed(c, nil)
+}
+
+// GetCollectionChanges returns the containers in a collection that changed after the since
+// query param. Page with the limit and cursor params.
+func (app *Apollo) GetCollectionChanges(c *gin.Context) {
+	collIDs, dbErr := app.repo(c).LookupIdentifier(c.Param("pid"))
+	if dbErr != nil {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
+		return
+	}
+	app.getChangeFeed(c, collIDs)
+}
+
+func (app *Apollo) getChangeFeed(c *gin.Context, collIDs *NodeIdentifier) {
+	var pos changeCursor
+	if c.Query("cursor") != "" {
+		cursor, err := decodeChangeCursor(c.Query("cursor"))
+		if err != nil {
+			requestLog(c).Printf("ERROR: invalid change cursor %s", c.Query("cursor"))
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		pos = *cursor
+	} else {
+		if c.Query("since") == "" {
+			c.String(http.StatusBadRequest, "since is required")
+			return
+		}
+		since, err := parseTimeParam(c.Query("since"))
+		if err != nil {
+			requestLog(c).Printf("ERROR: invalid changes since %s", c.Query("since"))
+			c.String(http.StatusBadRequest, fmt.Sprintf("invalid since: %s", c.Query("since")))
+			return
+		}
+		pos = changeCursor{Since: since, ChangedAt: since}
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	collectionID := int64(0)
+	if collIDs != nil {
+		collectionID = collIDs.ID
+	}
+	changes, err := app.repo(c).GetChanges(collectionID, pos, limit+1)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to get changes since %s: %s", pos.ChangedAt.Format(time.RFC3339Nano), err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	out := ChangeFeed{Since: pos.Since, Changes: changes}
+	if len(out.Changes) > limit {
+		out.More = true
+		out.Changes = out.Changes[:limit]
+	}
+	for idx := range out.Changes {
+		change := &out.Changes[idx]
+		if change.Deleted {
+			change.Change = "deleted"
+		} else if change.CreatedAt.After(pos.Since) {
+			change.Change = "created"
+		} else {
+			change.Change = "updated"
+		}
+	}
+
+	// the cursor is the position of the last change; with no changes, it stays where it was
+	last := pos
+	if len(out.Changes) > 0 {
+		final := out.Changes[len(out.Changes)-1]
+		last = changeCursor{Since: pos.Since, ChangedAt: final.ChangedAt, ID: final.ID}
+	}
+	out.Cursor = last.encode()
+	requestLog(c).Printf("INFO: %d changes since %s; more=%t", len(out.Changes), pos.Since.Format(time.RFC3339Nano), out.More)
+	c.JSON(http.StatusOK, out)
+}
+
+// getChanges returns up to limit containers changed after the cursor position, in the order they
+// changed, with the PIDs of their collections. A collectionID of 0 includes all collections.
+func getChanges(db *DB, collectionID int64, pos changeCursor, limit int) ([]Change, error) {
+	// Containers change when they are changed directly or when one of their attributes change.
+	// Any node changed after the cursor position is mapped to the container it belongs to.
+	// The timestamps are filtered separately rather than through COALESCE so each can use its index.
+	// Containers purged from the trash are reported from their tombstones.
+	scope := ""
+	tombstoneScope := ""
+	scopeArgs := []interface{}{}
+	if collectionID != 0 {
+		scope = "and (n.id=? or n.ancestry=? or n.ancestry LIKE ?)"
+		tombstoneScope = "and (t.node_id=? or t.ancestry=? or t.ancestry LIKE ?)"
+		scopeArgs = append(scopeArgs, collectionID, fmt.Sprintf("%d", collectionID), fmt.Sprintf("%d/%%", collectionID))
+	}
+	args := []interface{}{pos.ChangedAt, pos.ChangedAt}
+	args = append(args, scopeArgs...)
+	args = append(args, args...)
+	args = append(args, pos.ChangedAt, pos.ChangedAt, pos.ID, pos.ChangedAt, pos.ChangedAt, pos.ID)
+	args = append(args, scopeArgs...)
+	args = append(args, limit)
+	qs := fmt.Sprintf(`SELECT id, pid, ancestry, created_at, deleted, changed_at FROM (
+		SELECT c.id, c.pid, c.ancestry, c.created_at, c.deleted, ch.changed_at FROM
+			(SELECT cid, MAX(ts) as changed_at FROM (
+				SELECT n.id as cid, COALESCE(n.updated_at, n.created_at) as ts FROM nodes n
+					INNER JOIN node_types nt ON nt.id = n.node_type_id
+					WHERE nt.container=1 and n.current=1
+					and (n.updated_at >= ? or (n.updated_at IS NULL and n.created_at >= ?)) %[1]s
+				UNION ALL
+				SELECT n.parent_id as cid, COALESCE(n.updated_at, n.created_at) as ts FROM nodes n
+					INNER JOIN node_types nt ON nt.id = n.node_type_id
+					WHERE nt.container=0 and n.current=1 and n.parent_id IS NOT NULL
+					and (n.updated_at >= ? or (n.updated_at IS NULL and n.created_at >= ?)) %[1]s
+				) changed
+			GROUP BY cid) ch
+			INNER JOIN nodes c ON c.id = ch.cid
+			WHERE ch.changed_at > ? or (ch.changed_at = ? and c.id > ?)
+		UNION ALL
+		SELECT t.node_id as id, t.pid, t.ancestry, t.created_at, 1 as deleted, t.deleted_at as changed_at
+			FROM node_tombstones t
+			WHERE (t.deleted_at > ? or (t.deleted_at = ? and t.node_id > ?)) %[2]s
+		) feed
+		ORDER BY changed_at ASC, id ASC LIMIT ?`, scope, tombstoneScope)
+
+	out := make([]Change, 0)
+	err := db.Select(&out, qs, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	collIDList := make([]int64, 0)
+	for _, change := range out {
+		collIDList = append(collIDList, ancestryRootID(change.ID, change.Ancestry.String))
+	}
+	collPIDs, err := getCollectionPIDs(db, collIDList)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get collections for changes: %s", err.Error())
+	}
+	for idx := range out {
+		out[idx].CollectionPID = collPIDs[ancestryRootID(out[idx].ID, out[idx].Ancestry.String)]
+	}
+	return out, nil
+}
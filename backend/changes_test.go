@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// getChangeFeed returns a page of the change feed from the API
+func getChangeFeed(t *testing.T, router http.Handler, path string) ChangeFeed {
+	t.Helper()
+	var feed ChangeFeed
+	checkJSON(t, doRequest(router, "GET", path, "", ""), http.StatusOK, &feed)
+	return feed
+}
+
+func TestChangeErrors(t *testing.T) {
+	router := newTestRouter(t)
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/api/changes", http.StatusBadRequest},
+		{"/api/changes?since=yesterday", http.StatusBadRequest},
+		{"/api/changes?cursor=nope", http.StatusBadRequest},
+		{"/api/collections/uva-an99999/changes?since=2019-05-02", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		resp := doRequest(router, "GET", tc.path, "", "")
+		if resp.Code != tc.status {
+			t.Errorf("GET %s returned %d, expected %d: %s", tc.path, resp.Code, tc.status, resp.Body.String())
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	router := newTestRouter(t)
+
+	// every fixture node was created at fixtureTime
+	feed := getChangeFeed(t, router, "/api/changes?since=2019-05-01")
+	if len(feed.Changes) != 10 || feed.More {
+		t.Errorf("feed since the fixtures were loaded has %d changes; more=%t", len(feed.Changes), feed.More)
+	}
+	for _, change := range feed.Changes {
+		if change.Change != "created" {
+			t.Errorf("fixture container %s is %s, expected created", change.PID, change.Change)
+		}
+	}
+	feed = getChangeFeed(t, router, "/api/changes?since=2019-05-02")
+	if len(feed.Changes) != 0 || feed.More {
+		t.Fatalf("feed after the fixtures were loaded has %d changes", len(feed.Changes))
+	}
+
+	body := fmt.Sprintf(`{"title":"Salem fire, 1951","version":"%s"}`, currentVersion(t, router, "uva-an109894"))
+	if resp := doRequest(router, "POST", "/api/nodes/109894/update", body, "user1"); resp.Code != http.StatusOK {
+		t.Fatalf("update returned %d: %s", resp.Code, resp.Body.String())
+	}
+	resp := doRequest(router, "DELETE", "/api/nodes/uva-an16?version="+currentVersion(t, router, "uva-an16"), "", "user1")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("delete returned %d: %s", resp.Code, resp.Body.String())
+	}
+
+	expected := []Change{
+		{PID: "uva-an109894", CollectionPID: "uva-an109873", Change: "updated"},
+		{PID: "uva-an16", CollectionPID: "uva-an1", Change: "deleted"},
+	}
+	feed = getChangeFeed(t, router, "/api/changes?since=2019-05-02")
+	if len(feed.Changes) != len(expected) || feed.More {
+		t.Fatalf("feed has changes %+v; more=%t", feed.Changes, feed.More)
+	}
+	for idx, change := range feed.Changes {
+		want := expected[idx]
+		if change.PID != want.PID || change.CollectionPID != want.CollectionPID || change.Change != want.Change {
+			t.Errorf("change %d is %+v, expected %+v", idx, change, want)
+		}
+	}
+
+	// paging picks up after the last change of the previous page
+	page := getChangeFeed(t, router, "/api/changes?since=2019-05-02&limit=1")
+	if len(page.Changes) != 1 || page.More == false || page.Changes[0].PID != "uva-an109894" {
+		t.Fatalf("first page has changes %+v; more=%t", page.Changes, page.More)
+	}
+	page = getChangeFeed(t, router, "/api/changes?limit=1&cursor="+page.Cursor)
+	if len(page.Changes) != 1 || page.More || page.Changes[0].PID != "uva-an16" || page.Changes[0].Change != "deleted" {
+		t.Fatalf("second page has changes %+v; more=%t", page.Changes, page.More)
+	}
+	page = getChangeFeed(t, router, "/api/changes?limit=1&cursor="+page.Cursor)
+	if len(page.Changes) != 0 || page.More {
+		t.Errorf("last page has changes %+v; more=%t", page.Changes, page.More)
+	}
+
+	feed = getChangeFeed(t, router, "/api/collections/uva-an1/changes?since=2019-05-02")
+	if len(feed.Changes) != 1 || feed.Changes[0].PID != "uva-an16" {
+		t.Errorf("collection feed has changes %+v", feed.Changes)
+	}
+}
+
+func TestChangesAfterPurge(t *testing.T) {
+	router := newTestRouter(t)
+	resp := doRequest(router, "DELETE", "/api/nodes/uva-an16?version="+currentVersion(t, router, "uva-an16"), "", "user1")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("delete returned %d: %s", resp.Code, resp.Body.String())
+	}
+	before := getChangeFeed(t, router, "/api/changes?since=2019-05-02")
+	if len(before.Changes) != 1 || before.Changes[0].Change != "deleted" {
+		t.Fatalf("feed after the delete has changes %+v", before.Changes)
+	}
+	if resp := doRequest(router, "DELETE", "/api/admin/trash?days=0", "", "admin1"); resp.Code != http.StatusOK {
+		t.Fatalf("purge returned %d: %s", resp.Code, resp.Body.String())
+	}
+
+	// the deletion is still reported once the nodes are gone, at the same position in the feed
+	for _, path := range []string{"/api/changes?since=2019-05-02", "/api/collections/uva-an1/changes?since=2019-05-02"} {
+		feed := getChangeFeed(t, router, path)
+		if len(feed.Changes) != 1 {
+			t.Fatalf("%s after the purge has changes %+v", path, feed.Changes)
+		}
+		change, want := feed.Changes[0], before.Changes[0]
+		if change.PID != "uva-an16" || change.CollectionPID != "uva-an1" || change.Change != "deleted" ||
+			change.ChangedAt.Equal(want.ChangedAt) == false {
+			t.Errorf("%s after the purge has change %+v, expected %+v", path, change, want)
+		}
+	}
+	if feed := getChangeFeed(t, router, "/api/changes?cursor="+before.Cursor); len(feed.Changes) != 0 {
+		t.Errorf("feed after the cursor read before the purge has changes %+v", feed.Changes)
+	}
+	if feed := getChangeFeed(t, router, "/api/collections/uva-an109873/changes?since=2019-05-02"); len(feed.Changes) != 0 {
+		t.Errorf("another collection's feed has changes %+v", feed.Changes)
+	}
+}
@@ -17,8 +17,8 @@ import (
 
 // ListCollections returns a json array containg all collection in tghe system
 func (app *Apollo) ListCollections(c *gin.Context) {
-	log.Printf("INFO: get all collections")
-	collections := getCollections(&app.DB)
+	requestLog(c).Printf("INFO: get all collections")
+	collections := app.repo(c).GetCollections()
 	c.JSON(http.StatusOK, collections)
 }
 
@@ -30,39 +30,83 @@ func (app *Apollo) GetCollection(c *gin.Context) {
 		tgtFormat = "json"
 	}
 	if tgtFormat != "json" && tgtFormat != "xml" && tgtFormat != "uvamap" {
-		log.Printf("ERROR: Unsupported format for %s requested %s", tgtFormat, pid)
+		requestLog(c).Printf("ERROR: Unsupported format for %s requested %s", tgtFormat, pid)
 		c.String(http.StatusBadRequest, fmt.Sprintf("unsupported format %s", tgtFormat))
 		return
 	}
-	log.Printf("INFO: get collection for PID %s as %s", pid, tgtFormat)
+	depth, depthErr := parseDepth(c)
+	if depthErr != nil {
+		requestLog(c).Printf("ERROR: %s", depthErr.Error())
+		c.String(http.StatusBadRequest, depthErr.Error())
+		return
+	}
+	childrenOf := c.Query("children_of")
+	if (depth >= 0 || childrenOf != "") && tgtFormat != "json" {
+		requestLog(c).Printf("ERROR: partial tree requested for %s as %s", pid, tgtFormat)
+		c.String(http.StatusBadRequest, fmt.Sprintf("depth and children_of are not supported for format %s", tgtFormat))
+		return
+	}
+
+	requestLog(c).Printf("INFO: get collection for PID %s as %s", pid, tgtFormat)
 	startTime := time.Now()
-	rootID, dbErr := lookupIdentifier(&app.DB, pid)
+	rootID, dbErr := app.repo(c).LookupIdentifier(pid)
 	if dbErr != nil {
-		log.Printf("ERROR: %s", dbErr.Error())
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
 		c.String(http.StatusNotFound, dbErr.Error())
 		return
 	}
 
-	root, dbErr := getTree(&app.DB, rootID.ID)
+	// children_of picks a container within the collection to use as the root of a subtree.
+	// Since the point is to see the children, default to one level of them.
+	if childrenOf != "" {
+		rootID, dbErr = app.repo(c).LookupCollectionNode(rootID.ID, childrenOf)
+		if dbErr != nil {
+			requestLog(c).Printf("ERROR: %s", dbErr.Error())
+			c.String(http.StatusNotFound, dbErr.Error())
+			return
+		}
+		if depth < 0 {
+			depth = 1
+		}
+	}
+
+	var root *Node
+	if depth >= 0 {
+		root, dbErr = app.repo(c).GetSubtree(rootID.ID, depth)
+	} else {
+		root, dbErr = app.repo(c).GetTree(rootID.ID)
+	}
 	if dbErr != nil {
-		log.Printf("ERROR: %s", dbErr.Error())
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
 		c.String(http.StatusInternalServerError, dbErr.Error())
 		return
 	}
 	elapsedNanoSec := time.Since(startTime)
 	elapsedMS := int64(elapsedNanoSec / time.Millisecond)
 
-	log.Printf("INFO: collection tree retrieved from DB; sending to client. Elapsed Time: %d (ms)", elapsedMS)
+	requestLog(c).Printf("INFO: collection tree retrieved from DB; sending to client. Elapsed Time: %d (ms)", elapsedMS)
+	if depth < 0 && setETag(c, makeVersion(treeVersion(root), tgtFormat)) {
+		return
+	}
 	if tgtFormat == "json" {
 		//c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.json", pid))
-		c.JSON(http.StatusOK, root)
+		setNodeVersions(root)
+		data, err := json.Marshal(root)
+		if err != nil {
+			requestLog(c).Printf("ERROR: unable to generate json for %s: %s", pid, err.Error())
+			c.String(http.StatusInternalServerError, "unable to generate json content")
+			return
+		}
+		exportBytes.WithLabelValues(tgtFormat).Add(float64(len(data)))
+		c.Data(http.StatusOK, "application/json; charset=utf-8", data)
 	} else {
-		xml, err := generateXML(root, tgtFormat)
+		xml, err := generateXML(requestLog(c), root, tgtFormat)
 		if err != nil {
-			log.Printf("ERROR: unable to generate XML for %s: %s", pid, err.Error())
+			requestLog(c).Printf("ERROR: unable to generate XML for %s: %s", pid, err.Error())
 			c.String(http.StatusInternalServerError, "unable to generate XML content")
 			return
 		}
+		exportBytes.WithLabelValues(tgtFormat).Add(float64(len(xml)))
 		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.xml", pid))
 		c.Header("Content-Type", "application/xml")
 		c.String(http.StatusOK, xml)
@@ -85,11 +129,11 @@ func getCollections(db *DB) []Collection {
 	return out
 }
 
-func generateXML(node *Node, xmlType string) (string, error) {
-	log.Printf("INFO: generate %s for collection %s", xmlType, node.PID)
+func generateXML(logger *log.Logger, node *Node, xmlType string) (string, error) {
+	logger.Printf("INFO: generate %s for collection %s", xmlType, node.PID)
 	var buf bytes.Buffer
 	writer := bufio.NewWriter(&buf)
-	traverseTree(writer, node, xmlType)
+	traverseTree(logger, writer, node, xmlType)
 	writer.Flush()
 	return buf.String(), nil
 }
@@ -105,7 +149,7 @@ type nodeMapping struct {
 	Sibling  string
 }
 
-func traverseTree(out *bufio.Writer, node *Node, xmlType string) {
+func traverseTree(logger *log.Logger, out *bufio.Writer, node *Node, xmlType string) {
 	nm := mapNodeName(node.Type.Name, xmlType)
 	if node.Type.Container {
 		out.WriteString(fmt.Sprintf("%s\n", nm.OpenTag))
@@ -170,7 +214,7 @@ func traverseTree(out *bufio.Writer, node *Node, xmlType string) {
 				var doInfo digitalObjectInfo
 				doErr := json.Unmarshal([]byte(child.Value), &doInfo)
 				if doErr != nil {
-					log.Printf("ERROR: unable to read digital object info %s", doErr.Error())
+					logger.Printf("ERROR: unable to read digital object info %s", doErr.Error())
 				} else {
 					if doInfo.Type == "images" {
 						embedURL := fmt.Sprintf("https://iiif-manifest.internal.lib.virginia.edu/pid/%s", doInfo.ID)
@@ -208,7 +252,7 @@ func traverseTree(out *bufio.Writer, node *Node, xmlType string) {
 						}
 					}
 				} else {
-					traverseTree(out, child, xmlType)
+					traverseTree(logger, out, child, xmlType)
 				}
 			}
 		}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// treeNode is the part of an exported node needed to check the shape of a tree
+type treeNode struct {
+	PID  string `json:"pid"`
+	Type struct {
+		Container bool `json:"container"`
+	} `json:"type"`
+	Children []treeNode `json:"children"`
+}
+
+// containerDepth returns the number of levels of containers below the node
+func (n *treeNode) containerDepth() int {
+	depth := 0
+	for idx := range n.Children {
+		if child := &n.Children[idx]; child.Type.Container {
+			depth = max(depth, child.containerDepth()+1)
+		}
+	}
+	return depth
+}
+
+func TestTreeDepth(t *testing.T) {
+	router := newTestRouter(t)
+	tests := []struct {
+		path  string
+		root  string
+		depth int
+	}{
+		{"/api/collections/uva-an1", "uva-an1", 2},
+		{"/api/collections/uva-an1?depth=0", "uva-an1", 0},
+		{"/api/collections/uva-an1?depth=1", "uva-an1", 1},
+		{"/api/collections/uva-an1?depth=50", "uva-an1", 2},
+		{"/api/collections/uva-an1?children_of=uva-an9", "uva-an9", 1},
+	}
+	for _, tc := range tests {
+		var root treeNode
+		checkJSON(t, doRequest(router, "GET", tc.path, "", ""), http.StatusOK, &root)
+		if root.PID != tc.root || root.containerDepth() != tc.depth {
+			t.Errorf("GET %s has root %s with %d levels of containers, expected %s with %d",
+				tc.path, root.PID, root.containerDepth(), tc.root, tc.depth)
+		}
+	}
+
+	var details struct {
+		Item treeNode `json:"item"`
+	}
+	checkJSON(t, doRequest(router, "GET", "/api/items/uva-an9?depth=1", "", ""), http.StatusOK, &details)
+	if details.Item.PID != "uva-an9" || details.Item.containerDepth() != 1 {
+		t.Errorf("item uva-an9 with depth 1 has %d levels of containers", details.Item.containerDepth())
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// versionConflict is the response sent when a client tries to change data using a stale version
+type versionConflict struct {
+	Message string `json:"message"`
+	Version string `json:"version"`
+	Current *Node  `json:"current"`
+}
+
+// makeVersion hashes the parts that identify the state of some data into a short version string
+func makeVersion(parts ...interface{}) string {
+	hash := sha1.Sum([]byte(fmt.Sprint(parts...)))
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// nodeVersion returns the current version of a node. The version changes whenever the node or
+// any of its immediate children is created, updated, moved, reordered, deleted or restored;
+// every one of those changes sets updated_at on the affected nodes or changes the number of children.
+func nodeVersion(q sqlx.Queryer, nodeID int64) (string, error) {
+	var v struct {
+		Timestamp sql.NullTime `db:"ts"`
+		Children  int          `db:"children"`
+	}
+	qs := `SELECT MAX(COALESCE(updated_at, created_at)) as ts, COALESCE(SUM(id<>?), 0) as children FROM nodes
+		WHERE (id=? or (parent_id=? and deleted=0)) and current=1`
+	err := sqlx.Get(q, &v, qs, nodeID, nodeID, nodeID)
+	if err != nil {
+		return "", err
+	}
+	if v.Timestamp.Valid == false {
+		return "", fmt.Errorf("node %d not found", nodeID)
+	}
+	return makeVersion(nodeID, v.Timestamp.Time.UTC().Format(time.RFC3339Nano), v.Children), nil
+}
+
+// nodeVersions returns the current versions of a set of nodes, by ID, with the same result as
+// calling nodeVersion for each. The nodes are read in batches rather than one query per node.
+func nodeVersions(q sqlx.Queryer, nodeIDs []int64) (map[int64]string, error) {
+	out := make(map[int64]string)
+	for start := 0; start < len(nodeIDs); start += resolveBatchSize {
+		batch := nodeIDs[start:min(start+resolveBatchSize, len(nodeIDs))]
+		query, args, err := sqlx.In(`SELECT node_id, MAX(ts) as ts, SUM(child) as children FROM (
+				SELECT id as node_id, COALESCE(updated_at, created_at) as ts, 0 as child FROM nodes
+				WHERE id IN (?) and current=1
+				UNION ALL
+				SELECT parent_id as node_id, COALESCE(updated_at, created_at) as ts, 1 as child FROM nodes
+				WHERE parent_id IN (?) and deleted=0 and current=1
+			) v GROUP BY node_id`, batch, batch)
+		if err != nil {
+			return nil, err
+		}
+		var rows []struct {
+			NodeID    int64        `db:"node_id"`
+			Timestamp sql.NullTime `db:"ts"`
+			Children  int          `db:"children"`
+		}
+		err = sqlx.Select(q, &rows, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range rows {
+			out[v.NodeID] = makeVersion(v.NodeID, v.Timestamp.Time.UTC().Format(time.RFC3339Nano), v.Children)
+		}
+	}
+	for _, nodeID := range nodeIDs {
+		if _, ok := out[nodeID]; ok == false {
+			return nil, fmt.Errorf("node %d not found", nodeID)
+		}
+	}
+	return out, nil
+}
+
+// treeVersion returns a version for a full tree of nodes. It changes when any node in the tree
+// is updated, or when nodes are added or removed.
+func treeVersion(root *Node) string {
+	latest := time.Time{}
+	count := 0
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		count++
+		ts := n.CreatedAt
+		if n.UpdatedAt != nil {
+			ts = *n.UpdatedAt
+		}
+		if ts.After(latest) {
+			latest = ts
+		}
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	walk(root)
+	return makeVersion(root.ID, latest.UTC().Format(time.RFC3339Nano), count)
+}
+
+// setNodeVersions sets the version of each container in a tree that has all of its children
+// loaded, matching nodeVersion. Clients send it back to change the container without first
+// fetching it on its own, so changes made since they loaded the tree are detected.
+func setNodeVersions(node *Node) {
+	if node.Type == nil || node.Type.Container == false {
+		return
+	}
+	for _, child := range node.Children {
+		setNodeVersions(child)
+	}
+	if node.ChildCount > 0 {
+		// child containers were pruned at the depth limit
+		return
+	}
+	latest := node.CreatedAt
+	if node.UpdatedAt != nil {
+		latest = *node.UpdatedAt
+	}
+	for _, child := range node.Children {
+		ts := child.CreatedAt
+		if child.UpdatedAt != nil {
+			ts = *child.UpdatedAt
+		}
+		if ts.After(latest) {
+			latest = ts
+		}
+	}
+	node.Version = makeVersion(node.ID, latest.UTC().Format(time.RFC3339Nano), len(node.Children))
+}
+
+// setETag adds the version as an ETag to the response. If the client already has this version,
+// a 304 is sent and true is returned; the caller must not send anything else.
+func setETag(c *gin.Context, version string) bool {
+	etag := fmt.Sprintf("\"%s\"", version)
+	c.Header("ETag", etag)
+	for _, tag := range strings.Split(c.GetHeader("If-None-Match"), ",") {
+		if parseETag(tag) == version {
+			c.Status(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// parseETag strips the quotes and weak indicator from an ETag, leaving the version
+func parseETag(tag string) string {
+	tag = strings.TrimSpace(tag)
+	tag = strings.TrimPrefix(tag, "W/")
+	return strings.Trim(tag, "\"")
+}
+
+// requestVersion returns the version that the client last saw. It comes from the If-Match header,
+// the version query param, or a version field included in the request body.
+func requestVersion(c *gin.Context, bodyVersion string) string {
+	if c.GetHeader("If-Match") != "" {
+		return parseETag(c.GetHeader("If-Match"))
+	}
+	if c.Query("version") != "" {
+		return c.Query("version")
+	}
+	return bodyVersion
+}
+
+// checkVersion ensures the client version of a node is current before it is changed. It must be
+// called inside the transaction making the change after the node is locked. A stale version
+// returns a versionError.
+func checkVersion(tx *sqlx.Tx, nodeID int64, clientVersion string) error {
+	version, err := nodeVersion(tx, nodeID)
+	if err != nil {
+		return err
+	}
+	if version != clientVersion {
+		return &versionError{NodeID: nodeID, Version: version}
+	}
+	return nil
+}
+
+// versionMissing sends a 428 and returns true if the client did not send the version of the data
+// it is changing
+func versionMissing(c *gin.Context, clientVersion string) bool {
+	if clientVersion != "" {
+		return false
+	}
+	requestLog(c).Printf("ERROR: %s %s is missing a version", c.Request.Method, c.Request.URL.Path)
+	c.String(http.StatusPreconditionRequired, "the version of the data being changed is required")
+	return true
+}
+
+// changeFailed responds to a change the repository did not make. A refused change gets the status
+// from its changeError. A stale version gets a 409 with the current version and the current node
+// with depth levels of child containers. Anything else is a 500.
+func (app *Apollo) changeFailed(c *gin.Context, err error, depth int) {
+	var refused *changeError
+	var stale *versionError
+	switch {
+	case errors.As(err, &refused):
+		requestLog(c).Printf("ERROR: %s", refused.Message)
+		c.String(refused.Status, refused.Message)
+	case errors.As(err, &stale):
+		requestLog(c).Printf("INFO: %s", stale.Error())
+		current, curErr := app.repo(c).GetSubtree(stale.NodeID, depth)
+		if curErr != nil {
+			requestLog(c).Printf("WARNING: unable to get current node %d: %s", stale.NodeID, curErr.Error())
+		}
+		c.Header("ETag", fmt.Sprintf("\"%s\"", stale.Version))
+		c.JSON(http.StatusConflict, versionConflict{
+			Message: "the data has been changed by someone else",
+			Version: stale.Version, Current: current})
+	default:
+		requestLog(c).Printf("ERROR: %s", err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+	}
+}
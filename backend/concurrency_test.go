@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestUpdateVersions(t *testing.T) {
+	router := newTestRouter(t)
+	version := currentVersion(t, router, "uva-an12")
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"title":"Vol. 1, no. 1"}`, http.StatusPreconditionRequired},
+		{`{"title":"Vol. 1, no. 1","version":"stale"}`, http.StatusConflict},
+		{fmt.Sprintf(`{"title":"Vol. 1, no. 1","version":"%s"}`, version), http.StatusOK},
+		// the version changed with the update
+		{fmt.Sprintf(`{"title":"Vol. 1, no. 1, 1909","version":"%s"}`, version), http.StatusConflict},
+	}
+	for _, tc := range tests {
+		resp := doRequest(router, "POST", "/api/nodes/12/update", tc.body, "user1")
+		if resp.Code != tc.status {
+			t.Errorf("update %s returned %d, expected %d: %s", tc.body, resp.Code, tc.status, resp.Body.String())
+		}
+	}
+
+	// a conflict returns the current node and its version so the client can merge
+	resp := doRequest(router, "POST", "/api/nodes/12/update", fmt.Sprintf(`{"title":"x","version":"%s"}`, version), "user1")
+	var conflict versionConflict
+	checkJSON(t, resp, http.StatusConflict, &conflict)
+	current := currentVersion(t, router, "uva-an12")
+	if current == version || conflict.Version != current || parseETag(resp.Header().Get("ETag")) != current {
+		t.Errorf("conflict has version %s and ETag %s; current version is %s", conflict.Version, resp.Header().Get("ETag"), current)
+	}
+	if conflict.Current == nil || conflict.Current.PID != "uva-an12" {
+		t.Errorf("conflict does not include the current node: %+v", conflict.Current)
+	}
+
+	// the ETag from the update is the new version
+	resp = doRequest(router, "POST", "/api/nodes/12/update", fmt.Sprintf(`{"title":"Vol. 1, no. 1, 1909","version":"%s"}`, current), "user1")
+	if resp.Code != http.StatusOK || parseETag(resp.Header().Get("ETag")) != currentVersion(t, router, "uva-an12") {
+		t.Errorf("update returned %d with ETag %s", resp.Code, resp.Header().Get("ETag"))
+	}
+}
+
+// TestTreeVersions checks that the versions of containers in a collection match their item
+// ETags, so an edit can be made with the version from the loaded collection
+func TestTreeVersions(t *testing.T) {
+	router := newTestRouter(t)
+	resp := doRequest(router, "GET", "/api/collections/uva-an1", "", "")
+	var root struct {
+		Version  string `json:"version"`
+		Children []struct {
+			PID      string `json:"pid"`
+			Version  string `json:"version"`
+			Children []struct {
+				PID     string `json:"pid"`
+				Version string `json:"version"`
+			} `json:"children"`
+		} `json:"children"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &root); err != nil {
+		t.Fatalf("collection is not valid json: %s", err.Error())
+	}
+	checked := 0
+	for _, vol := range root.Children {
+		for _, issue := range vol.Children {
+			if issue.Version == "" {
+				continue
+			}
+			item := doRequest(router, "GET", "/api/items/"+issue.PID, "", "")
+			if parseETag(item.Header().Get("ETag")) != issue.Version {
+				t.Errorf("%s has version %s in the collection and ETag %s", issue.PID, issue.Version, item.Header().Get("ETag"))
+			}
+			checked++
+		}
+	}
+	if checked == 0 {
+		t.Errorf("no container versions found in the collection")
+	}
+}
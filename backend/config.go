@@ -2,60 +2,339 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
 )
 
+// redacted replaces secrets when the configuration is logged or shown
+const redactedValue = "REDACTED"
+
 type dbConfig struct {
-	Host     string
-	Database string
-	User     string
-	Pass     string
-	Timeout  string
+	Host            string `yaml:"host" toml:"host" json:"host"`
+	Database        string `yaml:"name" toml:"name" json:"name"`
+	User            string `yaml:"user" toml:"user" json:"user"`
+	Pass            string `yaml:"pass" toml:"pass" json:"pass"`
+	Timeout         int    `yaml:"timeout" toml:"timeout" json:"timeout"`
+	MaxOpenConns    int    `yaml:"maxOpenConns" toml:"maxOpenConns" json:"maxOpenConns"`
+	MaxIdleConns    int    `yaml:"maxIdleConns" toml:"maxIdleConns" json:"maxIdleConns"`
+	ConnMaxLifetime int    `yaml:"connMaxLifetime" toml:"connMaxLifetime" json:"connMaxLifetime"`
 }
 
+// apolloConfig is the service configuration. Each setting comes from the first of these that
+// has it: a command line flag, an APOLLO_* env variable, the config file, or the default.
+// Durations are in seconds.
 type apolloConfig struct {
-	dbConfig   dbConfig
-	port       int
-	devUser    string
-	iiifManURL string
-	apolloURL  string
-	wslsURL    string
-}
-
-func getConfig() apolloConfig {
-	log.Printf("INFO: loading configuration...")
-	cfg := apolloConfig{}
-	flag.StringVar(&cfg.dbConfig.Host, "dbhost", os.Getenv("APOLLO_DB_HOST"), "DB Host (required)")
-	flag.StringVar(&cfg.dbConfig.Database, "dbname", os.Getenv("APOLLO_DB_NAME"), "DB Name (required)")
-	flag.StringVar(&cfg.dbConfig.User, "dbuser", os.Getenv("APOLLO_DB_USER"), "DB User (required)")
-	flag.StringVar(&cfg.dbConfig.Pass, "dbpass", os.Getenv("APOLLO_DB_PASS"), "DB Password (required)")
-	flag.StringVar(&cfg.dbConfig.Timeout, "dbtimeout", os.Getenv("APOLLO_DB_TIMEOUT"), "DB Timeout (required)")
+	DB              dbConfig `yaml:"db" toml:"db" json:"db"`
+	Port            int      `yaml:"port" toml:"port" json:"port"`
+	DevUser         string   `yaml:"devUser" toml:"devUser" json:"devUser"`
+	IIIFManURL      string   `yaml:"iiif" toml:"iiif" json:"iiif"`
+	ApolloURL       string   `yaml:"apollo" toml:"apollo" json:"apollo"`
+	WSLSURL         string   `yaml:"wsls" toml:"wsls" json:"wsls"`
+	RejectDups      bool     `yaml:"rejectDups" toml:"rejectDups" json:"rejectDups"`
+	Admins          []string `yaml:"admins" toml:"admins" json:"admins"`
+	TrashDays       int      `yaml:"trashDays" toml:"trashDays" json:"trashDays"`
+	WebhookInterval int      `yaml:"webhookInterval" toml:"webhookInterval" json:"webhookInterval"`
+	ReadTimeout     int      `yaml:"readTimeout" toml:"readTimeout" json:"readTimeout"`
+	WriteTimeout    int      `yaml:"writeTimeout" toml:"writeTimeout" json:"writeTimeout"`
+	ShutdownTimeout int      `yaml:"shutdownTimeout" toml:"shutdownTimeout" json:"shutdownTimeout"`
+	TemplateDir     string   `yaml:"templates" toml:"templates" json:"templates"`
+	PublicDir       string   `yaml:"public" toml:"public" json:"public"`
+	DPLACollections []string `yaml:"dplaCollections" toml:"dplaCollections" json:"dplaCollections"`
+	CORSOrigins     []string `yaml:"corsOrigins" toml:"corsOrigins" json:"corsOrigins"`
+	LogLevel        string   `yaml:"logLevel" toml:"logLevel" json:"logLevel"`
+	AutoMigrate     bool     `yaml:"autoMigrate" toml:"autoMigrate" json:"autoMigrate"`
+	File            string   `yaml:"-" toml:"-" json:"file"`
+	Version         bool     `yaml:"-" toml:"-" json:"-"`
+}
+
+// redacted returns a copy of the configuration that is safe to log or show. Besides the DB
+// password, any password given in the userinfo of a service URL is hidden.
+func (cfg *apolloConfig) redacted() apolloConfig {
+	out := *cfg
+	if out.DB.Pass != "" {
+		out.DB.Pass = redactedValue
+	}
+	out.IIIFManURL = redactURLs(out.IIIFManURL)
+	out.ApolloURL = redactURLs(out.ApolloURL)
+	out.WSLSURL = redactURLs(out.WSLSURL)
+	out.CORSOrigins = make([]string, len(cfg.CORSOrigins))
+	for idx, origin := range cfg.CORSOrigins {
+		out.CORSOrigins[idx] = redactURLs(origin)
+	}
+	return out
+}
+
+// redactURLs hides the password of each URL with userinfo in a comma separated list.
+// Values that are not URLs are returned unchanged.
+func redactURLs(val string) string {
+	parts := strings.Split(val, ",")
+	for idx, part := range parts {
+		u, err := url.Parse(part)
+		if err != nil || u.User == nil {
+			continue
+		}
+		if _, hasPass := u.User.Password(); hasPass {
+			u.User = url.UserPassword(u.User.Username(), redactedValue)
+			parts[idx] = u.String()
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// listValue is a flag holding a comma separated list
+type listValue struct {
+	list *[]string
+}
+
+func (lv listValue) String() string {
+	if lv.list == nil {
+		return ""
+	}
+	return strings.Join(*lv.list, ",")
+}
+
+func (lv listValue) Set(val string) error {
+	*lv.list = make([]string, 0)
+	for _, item := range strings.Split(val, ",") {
+		if strings.TrimSpace(item) != "" {
+			*lv.list = append(*lv.list, strings.TrimSpace(item))
+		}
+	}
+	return nil
+}
+
+// configEnv maps the env variables to the flag for the same setting
+var configEnv = []struct {
+	env  string
+	flag string
+}{
+	{"APOLLO_DB_HOST", "dbhost"}, {"APOLLO_DB_NAME", "dbname"}, {"APOLLO_DB_USER", "dbuser"},
+	{"APOLLO_DB_PASS", "dbpass"}, {"APOLLO_DB_TIMEOUT", "dbtimeout"}, {"APOLLO_DB_MAX_OPEN", "dbmaxopen"},
+	{"APOLLO_DB_MAX_IDLE", "dbmaxidle"}, {"APOLLO_DB_MAX_LIFETIME", "dbmaxlifetime"},
+	{"APOLLO_PORT", "port"}, {"APOLLO_DEVUSER", "devuser"}, {"APOLLO_IIIF_MAN_URL", "iiif"},
+	{"APOLLO_HOST", "apollo"}, {"APOLLO_WSLS_URL", "fedora"}, {"APOLLO_REJECT_DUPS", "rejectdups"},
+	{"APOLLO_ADMINS", "admins"}, {"APOLLO_TRASH_DAYS", "trashdays"}, {"APOLLO_WEBHOOK_INTERVAL", "webhookinterval"},
+	{"APOLLO_READ_TIMEOUT", "readtimeout"}, {"APOLLO_WRITE_TIMEOUT", "writetimeout"},
+	{"APOLLO_SHUTDOWN_TIMEOUT", "shutdowntimeout"}, {"APOLLO_TEMPLATES", "templates"}, {"APOLLO_PUBLIC", "public"},
+	{"APOLLO_DPLA_COLLECTIONS", "dplacollections"}, {"APOLLO_CORS_ORIGINS", "corsorigins"},
+	{"APOLLO_LOG_LEVEL", "loglevel"}, {"APOLLO_AUTO_MIGRATE", "auto-migrate"},
+}
+
+// secretFlags are settings that are never logged or shown
+var secretFlags = map[string]bool{"dbpass": true}
+
+func configFlags(cfg *apolloConfig) *flag.FlagSet {
+	fs := flag.NewFlagSet("apollosvr", flag.ContinueOnError)
+	fs.StringVar(&cfg.File, "config", os.Getenv("APOLLO_CONFIG"), "YAML (.yml, .yaml) or TOML (.toml) config file")
+	fs.StringVar(&cfg.DB.Host, "dbhost", "", "DB Host (required)")
+	fs.StringVar(&cfg.DB.Database, "dbname", "", "DB Name (required)")
+	fs.StringVar(&cfg.DB.User, "dbuser", "", "DB User (required)")
+	fs.StringVar(&cfg.DB.Pass, "dbpass", "", "DB Password (required)")
+	fs.IntVar(&cfg.DB.Timeout, "dbtimeout", 0, "DB Timeout in seconds (required)")
+	fs.IntVar(&cfg.DB.MaxOpenConns, "dbmaxopen", 5, "Maximum open DB connections")
+	fs.IntVar(&cfg.DB.MaxIdleConns, "dbmaxidle", 5, "Maximum idle DB connections")
+	fs.IntVar(&cfg.DB.ConnMaxLifetime, "dbmaxlifetime", 300, "Seconds a DB connection is reused before it is closed")
 	//
-	flag.IntVar(&cfg.port, "port", 8080, "Port to offer service on (default 8080)")
-	flag.StringVar(&cfg.devUser, "devuser", "", "Computing ID to use for fake authentication in dev mode")
-	flag.StringVar(&cfg.iiifManURL, "iiif", "https://iiifman.lib.virginia.edu/pid", "IIIF Manifest service URL")
-	flag.StringVar(&cfg.apolloURL, "apollo", "https://apollo.lib.virginia.edu", "Apollo URL")
-	flag.StringVar(&cfg.wslsURL, "fedora", "https://wsls.lib.virginia.edu", "WSLS URL")
-
-	flag.Parse()
-
-	// if anything is still not set, die
-	if len(cfg.dbConfig.Host) == 0 || len(cfg.dbConfig.User) == 0 ||
-		len(cfg.dbConfig.Pass) == 0 || len(cfg.dbConfig.Database) == 0 || len(cfg.dbConfig.Timeout) == 0 {
-		flag.Usage()
-		log.Printf("FATAL: Missing DB configuration")
+	fs.IntVar(&cfg.Port, "port", 8080, "Port to offer service on (default 8080)")
+	fs.StringVar(&cfg.DevUser, "devuser", "", "Computing ID to use for fake authentication in dev mode")
+	fs.StringVar(&cfg.IIIFManURL, "iiif", "https://iiifman.lib.virginia.edu/pid", "IIIF Manifest service URL")
+	fs.StringVar(&cfg.ApolloURL, "apollo", "https://apollo.lib.virginia.edu", "Apollo URL")
+	fs.StringVar(&cfg.WSLSURL, "fedora", "https://wsls.lib.virginia.edu", "WSLS URL")
+	fs.Var(listValue{&cfg.Admins}, "admins", "Comma separated list of admin computing IDs")
+	fs.IntVar(&cfg.TrashDays, "trashdays", 30, "Days that deleted nodes stay in the trash before they can be purged")
+	fs.IntVar(&cfg.WebhookInterval, "webhookinterval", 15, "Seconds between webhook delivery runs. 0 disables delivery")
+	fs.IntVar(&cfg.ReadTimeout, "readtimeout", 30, "Seconds allowed to read a request")
+	fs.IntVar(&cfg.WriteTimeout, "writetimeout", 300, "Seconds allowed to write a response; large collection exports need several minutes")
+	fs.IntVar(&cfg.ShutdownTimeout, "shutdowntimeout", 25, "Seconds to let in-flight requests finish on shutdown")
+	fs.BoolVar(&cfg.RejectDups, "rejectdups", false, "Reject identifier values already used by another item (default is to flag them)")
+	fs.StringVar(&cfg.TemplateDir, "templates", "", "Directory of export templates to use instead of the built in ones, for template development")
+	fs.StringVar(&cfg.PublicDir, "public", "", "Directory of a built frontend to serve instead of the built in one")
+	cfg.DPLACollections = []string{"uva-an109873"}
+	fs.Var(listValue{&cfg.DPLACollections}, "dplacollections", "Comma separated list of PIDs of collections published to the DPLA")
+	fs.Var(listValue{&cfg.CORSOrigins}, "corsorigins", "Comma separated list of origins allowed to make cross-origin requests (default is all)")
+	fs.StringVar(&cfg.LogLevel, "loglevel", "info", "Minimum level logged: debug, info, warn or error")
+	fs.BoolVar(&cfg.Version, "version", false, "Print the version, build and dependencies, then exit")
+	fs.BoolVar(&cfg.AutoMigrate, "auto-migrate", false, "Apply new schema migrations at startup. Instances take turns using a DB lock")
+	return fs
+}
+
+// loadConfig builds the configuration from the defaults, config file, env and command line args, in
+// that order, and validates it. When -version is given nothing else is loaded or checked.
+func loadConfig(args []string) (*apolloConfig, *flag.FlagSet, error) {
+	var cfg apolloConfig
+	fs := configFlags(&cfg)
+	if err := fs.Parse(args); err != nil {
+		return nil, fs, err
+	}
+	if cfg.Version {
+		return &cfg, fs, nil
+	}
+
+	// flags are parsed first to find the config file, then applied again so they take priority
+	flagVals := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		flagVals[f.Name] = f.Value.String()
+	})
+
+	if cfg.File != "" {
+		if err := loadConfigFile(&cfg, cfg.File); err != nil {
+			return nil, fs, err
+		}
+	}
+	for _, ev := range configEnv {
+		val := os.Getenv(ev.env)
+		if val == "" {
+			continue
+		}
+		if err := fs.Set(ev.flag, val); err != nil {
+			return nil, fs, fmt.Errorf("invalid %s: %s", ev.env, err.Error())
+		}
+	}
+	for name, val := range flagVals {
+		if err := fs.Set(name, val); err != nil {
+			return nil, fs, fmt.Errorf("invalid -%s: %s", name, err.Error())
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fs, err
+	}
+	return &cfg, fs, nil
+}
+
+// loadConfigFile reads settings from a YAML or TOML file. Settings that are not in the
+// file keep their current values; unknown settings are an error.
+func loadConfigFile(cfg *apolloConfig, fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %s", err.Error())
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yml", ".yaml":
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+	case ".toml":
+		dec := toml.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	default:
+		return fmt.Errorf("config file %s must be .yml, .yaml or .toml", fileName)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %s", fileName, err.Error())
+	}
+	return nil
+}
+
+// validate checks all settings and reports every problem found
+func (cfg *apolloConfig) validate() error {
+	var problems []string
+	require := func(name string, val string) {
+		if strings.TrimSpace(val) == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", name))
+		}
+	}
+	atLeast := func(name string, val int, min int) {
+		if val < min {
+			problems = append(problems, fmt.Sprintf("%s must be at least %d; got %d", name, min, val))
+		}
+	}
+	checkURL := func(name string, val string) {
+		u, err := url.Parse(val)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s must be an http or https URL; got [%s]", name, val))
+		}
+	}
+
+	require("db host", cfg.DB.Host)
+	require("db name", cfg.DB.Database)
+	require("db user", cfg.DB.User)
+	require("db pass", cfg.DB.Pass)
+	atLeast("db timeout", cfg.DB.Timeout, 1)
+	atLeast("db max open connections", cfg.DB.MaxOpenConns, 1)
+	atLeast("db max idle connections", cfg.DB.MaxIdleConns, 0)
+	if cfg.DB.MaxIdleConns > cfg.DB.MaxOpenConns {
+		problems = append(problems, fmt.Sprintf("db max idle connections (%d) must not be more than max open connections (%d)",
+			cfg.DB.MaxIdleConns, cfg.DB.MaxOpenConns))
+	}
+	atLeast("db connection lifetime", cfg.DB.ConnMaxLifetime, 0)
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port must be between 1 and 65535; got %d", cfg.Port))
+	}
+	checkURL("iiif", cfg.IIIFManURL)
+	checkURL("apollo", cfg.ApolloURL)
+	checkURL("wsls", cfg.WSLSURL)
+	atLeast("trash days", cfg.TrashDays, 0)
+	atLeast("webhook interval", cfg.WebhookInterval, 0)
+	atLeast("read timeout", cfg.ReadTimeout, 1)
+	atLeast("write timeout", cfg.WriteTimeout, 1)
+	atLeast("shutdown timeout", cfg.ShutdownTimeout, 0)
+	if info, err := os.Stat(cfg.TemplateDir); cfg.TemplateDir != "" && (err != nil || info.IsDir() == false) {
+		problems = append(problems, fmt.Sprintf("templates directory %s does not exist", cfg.TemplateDir))
+	}
+	for _, pid := range cfg.DPLACollections {
+		if strings.HasPrefix(pid, "uva-an") == false {
+			problems = append(problems, fmt.Sprintf("dpla collection %s is not an Apollo PID", pid))
+		}
+	}
+	for _, origin := range cfg.CORSOrigins {
+		if origin != "*" {
+			checkURL("cors origin", origin)
+		}
+	}
+
+	if lvl := strings.ToLower(cfg.LogLevel); lvl != "debug" && lvl != "info" && lvl != "warn" && lvl != "error" {
+		problems = append(problems, fmt.Sprintf("log level must be debug, info, warn or error; got %s", cfg.LogLevel))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func getConfig(args []string) apolloConfig {
+	cfg, fs, err := loadConfig(args)
+	// flag errors and help have already been printed with the usage
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Printf("FATAL: %s", err.Error())
 		os.Exit(1)
 	}
+	if cfg.Version {
+		return *cfg
+	}
 
-	log.Printf("[CONFIG] port          = [%d]", cfg.port)
-	log.Printf("[CONFIG] dbhost        = [%s]", cfg.dbConfig.Host)
-	log.Printf("[CONFIG] dbname        = [%s]", cfg.dbConfig.Database)
-	log.Printf("[CONFIG] dbuser        = [%s]", cfg.dbConfig.User)
-	log.Printf("[CONFIG] dbtimeout     = [%s]", cfg.dbConfig.Timeout)
-	log.Printf("[CONFIG] iiif          = [%s]", cfg.iiifManURL)
-	log.Printf("[CONFIG] apollo        = [%s]", cfg.apolloURL)
-	log.Printf("[CONFIG] fedora        = [%s]", cfg.wslsURL)
+	log.Printf("INFO: configuration loaded")
+	if cfg.File != "" {
+		log.Printf("[CONFIG] file            = [%s]", cfg.File)
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "version" {
+			return
+		}
+		val := f.Value.String()
+		if secretFlags[f.Name] && val != "" {
+			val = redactedValue
+		}
+		val = redactURLs(val)
+		log.Printf("[CONFIG] %-15s = [%s]", f.Name, val)
+	})
+	if _, err := os.Stat(cfg.PublicDir); cfg.PublicDir != "" && err != nil {
+		log.Printf("WARNING: frontend directory %s not found; only the API will be served", cfg.PublicDir)
+	}
 
-	return cfg
+	return *cfg
 }
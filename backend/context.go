@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// ItemContext describes where an item sits in the collection hierarchy. Ancestors are
+// ordered from the collection down to the immediate parent of the item. Position is the
+// 1-based index of the item among its siblings in sequence order.
+type ItemContext struct {
+	Item         ContainerSummary   `json:"item"`
+	Ancestors    []ContainerSummary `json:"ancestors"`
+	Previous     *ContainerSummary  `json:"previous"`
+	Next         *ContainerSummary  `json:"next"`
+	Position     int                `json:"position"`
+	SiblingCount int                `json:"siblingCount"`
+}
+
+// GetItemContext returns the ancestors of an item and its previous and next siblings
+func (app *Apollo) GetItemContext(c *gin.Context) {
+	pid := c.Param("pid")
+	itemIDs, dbErr := app.repo(c).LookupIdentifier(pid)
+	if dbErr != nil {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
+		return
+	}
+
+	requestLog(c).Printf("INFO: get context for %s", itemIDs.PID)
+	out, err := app.repo(c).GetItemContext(itemIDs.ID)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to get context for %s: %s", itemIDs.PID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func getItemContext(db *DB, itemID int64) (*ItemContext, error) {
+	var item struct {
+		ParentID sql.NullInt64  `db:"parent_id"`
+		Ancestry sql.NullString `db:"ancestry"`
+	}
+	err := db.Get(&item, "select parent_id, ancestry from nodes where id=?", itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	out := ItemContext{Ancestors: make([]ContainerSummary, 0)}
+	err = db.Get(&out.Item, fmt.Sprintf("%s WHERE n.id=?", summarySelect), itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	// A collection has no ancestors or siblings
+	if item.Ancestry.String == "" || item.ParentID.Valid == false {
+		out.Position = 1
+		out.SiblingCount = 1
+		return &out, nil
+	}
+
+	// ancestry is a list of IDs from the collection down to the parent; fetch them
+	// all then put them in ancestry order
+	var ancestorIDs []int64
+	for _, idStr := range strings.Split(item.Ancestry.String, "/") {
+		id, _ := strconv.ParseInt(idStr, 10, 64)
+		ancestorIDs = append(ancestorIDs, id)
+	}
+	query, args, err := sqlx.In(fmt.Sprintf("%s WHERE n.id IN (?)", summarySelect), ancestorIDs)
+	if err != nil {
+		return nil, err
+	}
+	var ancestors []ContainerSummary
+	err = db.Select(&ancestors, db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ancestorIDs {
+		for _, a := range ancestors {
+			if a.ID == id {
+				out.Ancestors = append(out.Ancestors, a)
+				break
+			}
+		}
+	}
+
+	// siblings are other containers with the same parent, ordered by sequence. ID breaks ties
+	siblingQ := "n.parent_id=? and nt.container=1 and n.deleted=0 and n.current=1"
+	err = db.Get(&out.SiblingCount, fmt.Sprintf(`SELECT count(*) FROM nodes n
+		INNER JOIN node_types nt ON nt.id = n.node_type_id WHERE %s`, siblingQ), item.ParentID.Int64)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Get(&out.Position, fmt.Sprintf(`SELECT count(*)+1 FROM nodes n
+		INNER JOIN node_types nt ON nt.id = n.node_type_id
+		WHERE %s and (n.sequence < ? or (n.sequence = ? and n.id < ?))`, siblingQ),
+		item.ParentID.Int64, out.Item.Sequence, out.Item.Sequence, itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	var prev ContainerSummary
+	err = db.Get(&prev, fmt.Sprintf(`%s WHERE %s and (n.sequence < ? or (n.sequence = ? and n.id < ?))
+		ORDER BY n.sequence DESC, n.id DESC LIMIT 1`, summarySelect, siblingQ),
+		item.ParentID.Int64, out.Item.Sequence, out.Item.Sequence, itemID)
+	if err == nil {
+		out.Previous = &prev
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var next ContainerSummary
+	err = db.Get(&next, fmt.Sprintf(`%s WHERE %s and (n.sequence > ? or (n.sequence = ? and n.id > ?))
+		ORDER BY n.sequence ASC, n.id ASC LIMIT 1`, summarySelect, siblingQ),
+		item.ParentID.Int64, out.Item.Sequence, out.Item.Sequence, itemID)
+	if err == nil {
+		out.Next = &next
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return &out, nil
+}
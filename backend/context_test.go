@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestItemContext(t *testing.T) {
+	router := newTestRouter(t)
+	tests := []struct {
+		pid       string
+		ancestors []string
+		previous  string
+		next      string
+		position  int
+		siblings  int
+	}{
+		{"uva-an12", []string{"uva-an1", "uva-an9"}, "", "uva-an16", 1, 2},
+		{"uva-lib:2528444", []string{"uva-an1", "uva-an9"}, "uva-an12", "", 2, 2},
+		{"uva-an20", []string{"uva-an1"}, "uva-an9", "", 2, 2},
+		{"uva-an1", []string{}, "", "", 1, 1},
+	}
+	for _, tc := range tests {
+		var ctx ItemContext
+		checkJSON(t, doRequest(router, "GET", "/api/items/"+tc.pid+"/context", "", ""), http.StatusOK, &ctx)
+		ancestors := make([]string, 0, len(ctx.Ancestors))
+		for _, a := range ctx.Ancestors {
+			ancestors = append(ancestors, a.PID)
+		}
+		previous, next := "", ""
+		if ctx.Previous != nil {
+			previous = ctx.Previous.PID
+		}
+		if ctx.Next != nil {
+			next = ctx.Next.PID
+		}
+		if reflect.DeepEqual(ancestors, tc.ancestors) == false || previous != tc.previous || next != tc.next ||
+			ctx.Position != tc.position || ctx.SiblingCount != tc.siblings {
+			t.Errorf("context of %s has ancestors %v, previous %q, next %q, position %d of %d", tc.pid,
+				ancestors, previous, next, ctx.Position, ctx.SiblingCount)
+		}
+	}
+	if resp := doRequest(router, "GET", "/api/items/uva-an99999/context", "", ""); resp.Code != http.StatusNotFound {
+		t.Errorf("context of an unknown item returned %d, expected %d", resp.Code, http.StatusNotFound)
+	}
+}
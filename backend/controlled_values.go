@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -10,10 +9,9 @@ import (
 
 // GetNodeTypes will return a list of controlled vocabulary types
 func (app *Apollo) GetNodeTypes(c *gin.Context) {
-	types := []NodeType{}
-	err := app.DB.Select(&types, "select * from node_types order by name asc")
+	types, err := app.repo(c).GetNodeTypes()
 	if err != nil {
-		log.Printf("ERROR: unable to get node types: %s", err.Error())
+		requestLog(c).Printf("ERROR: unable to get node types: %s", err.Error())
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -23,18 +21,41 @@ func (app *Apollo) GetNodeTypes(c *gin.Context) {
 // GeControlledValues returns the controlled values for a type name
 func (app *Apollo) GeControlledValues(c *gin.Context) {
 	tgtName := c.Param("name")
-	log.Printf("INFO: get controlled values for '%s'", tgtName)
-	var vals []ControlledValue
-	err := app.DB.Select(&vals,
-		"SELECT cv.* FROM controlled_values cv inner join node_types nt on nt.id = cv.node_type_id WHERE nt.name=?", tgtName)
+	requestLog(c).Printf("INFO: get controlled values for '%s'", tgtName)
+	vals, err := app.repo(c).GetControlledValues(tgtName)
 	if err != nil {
-		log.Printf("ERROR: Unable to get all controlled values for %s: %s", tgtName, err.Error())
+		requestLog(c).Printf("ERROR: Unable to get all controlled values for %s: %s", tgtName, err.Error())
 		c.String(http.StatusNotFound, fmt.Sprintf("%s not found", tgtName))
 		return
 	}
 	c.JSON(http.StatusOK, vals)
 }
 
+// getNodeTypes returns all node types in name order
+func getNodeTypes(db *DB) ([]NodeType, error) {
+	types := []NodeType{}
+	err := db.Select(&types, "select * from node_types order by name asc")
+	return types, err
+}
+
+// getNodeType finds a node type by name
+func getNodeType(db *DB, name string) (*NodeType, error) {
+	var nodeType NodeType
+	err := db.Get(&nodeType, "select * from node_types where name=?", name)
+	if err != nil {
+		return nil, err
+	}
+	return &nodeType, nil
+}
+
+// getControlledValues returns all of the controlled values for a type name
+func getControlledValues(db *DB, typeName string) ([]ControlledValue, error) {
+	var vals []ControlledValue
+	err := db.Select(&vals,
+		"SELECT cv.* FROM controlled_values cv inner join node_types nt on nt.id = cv.node_type_id WHERE nt.name=?", typeName)
+	return vals, err
+}
+
 // GetControlledValueByName finds a controlled value record by name
 //func getControlledValueByName(db *DB, name string) (*ControlledValue, error) {
 //	cv := ControlledValue{}
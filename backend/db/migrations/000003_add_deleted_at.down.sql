@@ -0,0 +1,6 @@
+START TRANSACTION;
+
+DROP INDEX idx_nodes_deleted_at ON nodes;
+ALTER TABLE nodes DROP COLUMN deleted_at;
+
+COMMIT;
@@ -0,0 +1,6 @@
+START TRANSACTION;
+
+ALTER TABLE nodes ADD COLUMN deleted_at datetime DEFAULT NULL AFTER deleted;
+CREATE INDEX idx_nodes_deleted_at ON nodes (deleted, deleted_at);
+
+COMMIT;
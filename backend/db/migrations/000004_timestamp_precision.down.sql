@@ -0,0 +1,7 @@
+START TRANSACTION;
+
+ALTER TABLE nodes MODIFY created_at datetime NOT NULL,
+   MODIFY updated_at datetime DEFAULT NULL,
+   MODIFY deleted_at datetime DEFAULT NULL;
+
+COMMIT;
@@ -0,0 +1,8 @@
+START TRANSACTION;
+
+-- node versions are based on timestamps; make them precise enough to detect edits made within the same second
+ALTER TABLE nodes MODIFY created_at datetime(6) NOT NULL,
+   MODIFY updated_at datetime(6) DEFAULT NULL,
+   MODIFY deleted_at datetime(6) DEFAULT NULL;
+
+COMMIT;
@@ -0,0 +1,26 @@
+START TRANSACTION;
+
+--
+-- Durable log of all metadata changes. One row is written per changed field
+-- in the same transaction as the change
+--
+CREATE TABLE IF NOT EXISTS audit_log (
+   id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+   computing_id varchar(255) NOT NULL,
+   action varchar(20) NOT NULL,
+   collection_id int(11) DEFAULT NULL,
+   node_id int(11) DEFAULT NULL,
+   node_pid varchar(255) DEFAULT NULL,
+   node_type varchar(255) DEFAULT NULL,
+   field varchar(255) NOT NULL DEFAULT '',
+   old_value text,
+   new_value text,
+   created_at datetime(6) NOT NULL,
+   KEY (computing_id),
+   KEY (collection_id),
+   KEY (node_pid),
+   KEY (node_type),
+   KEY (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+COMMIT;
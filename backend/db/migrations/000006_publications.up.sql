@@ -0,0 +1,23 @@
+START TRANSACTION;
+
+--
+-- Replaces the publication_history table dropped in 000002. One row is written
+-- each time an item or collection is published to a target. The hash is the
+-- sha1 of the record as it was exported. There is no foreign key to nodes so the
+-- history is kept when published nodes are purged from the trash; the PID is
+-- stored on each row so it can still be found once the node is gone
+--
+CREATE TABLE IF NOT EXISTS publications (
+   id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+   node_id int(11) NOT NULL,
+   pid varchar(255) NOT NULL,
+   target varchar(30) NOT NULL,
+   computing_id varchar(255) NOT NULL,
+   record_hash char(40) NOT NULL,
+   published_at datetime(6) NOT NULL,
+   KEY (node_id, target),
+   KEY (target, published_at),
+   KEY idx_publications_pid (pid)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+COMMIT;
@@ -0,0 +1,7 @@
+START TRANSACTION;
+
+DROP TABLE IF EXISTS webhook_scans;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+
+COMMIT;
@@ -0,0 +1,57 @@
+START TRANSACTION;
+
+--
+-- Webhook subscribers. A subscriber with no collection receives events for all
+-- collections. Events is a comma separated list of event names; empty means all
+--
+CREATE TABLE IF NOT EXISTS webhooks (
+   id int(11) NOT NULL AUTO_INCREMENT PRIMARY KEY,
+   url varchar(1024) NOT NULL,
+   secret varchar(255) NOT NULL,
+   collection_id int(11) DEFAULT NULL,
+   events varchar(255) NOT NULL DEFAULT '',
+   active tinyint(1) NOT NULL DEFAULT 1,
+   computing_id varchar(255) NOT NULL,
+   created_at datetime(6) NOT NULL,
+   FOREIGN KEY (collection_id) REFERENCES nodes(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- Outbox of events to deliver. One row is written per subscriber in the same
+-- transaction as the change that caused the event. Deliveries are claimed by one
+-- delivery worker before they are sent, so instances running together don't send
+-- the same event twice
+--
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+   id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+   webhook_id int(11) NOT NULL,
+   event varchar(30) NOT NULL,
+   payload mediumtext NOT NULL,
+   status varchar(20) NOT NULL DEFAULT 'pending',
+   claimed_by varchar(255) DEFAULT NULL,
+   claimed_at datetime(6) DEFAULT NULL,
+   attempts int(11) NOT NULL DEFAULT 0,
+   next_attempt_at datetime(6) NOT NULL,
+   last_status int(11) DEFAULT NULL,
+   last_error text,
+   created_at datetime(6) NOT NULL,
+   delivered_at datetime(6) DEFAULT NULL,
+   FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE,
+   KEY (status, next_attempt_at),
+   KEY idx_webhook_deliveries_claimed_by (claimed_by)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- Nodes are created by apolloingest, which writes to the DB directly, so created
+-- events are queued by a scan for containers created since the last one. This is
+-- the creation time the scan has reached. It starts at the migration so existing
+-- nodes are not announced
+--
+CREATE TABLE IF NOT EXISTS webhook_scans (
+   id int(11) NOT NULL PRIMARY KEY,
+   scanned_to datetime(6) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+INSERT INTO webhook_scans (id, scanned_to) VALUES (1, NOW(6));
+
+COMMIT;
@@ -0,0 +1,7 @@
+START TRANSACTION;
+
+DROP TABLE IF EXISTS node_tombstones;
+DROP INDEX idx_nodes_created_at ON nodes;
+DROP INDEX idx_nodes_updated_at ON nodes;
+
+COMMIT;
@@ -0,0 +1,22 @@
+START TRANSACTION;
+
+-- the change feed filters nodes on each timestamp separately so both can use an index
+CREATE INDEX idx_nodes_updated_at ON nodes (updated_at);
+CREATE INDEX idx_nodes_created_at ON nodes (created_at);
+
+--
+-- Containers removed when the trash is purged. The change feed reports their
+-- deletion from here once their nodes are gone
+--
+CREATE TABLE IF NOT EXISTS node_tombstones (
+   id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+   node_id int(11) NOT NULL,
+   pid varchar(255) NOT NULL,
+   ancestry varchar(255),
+   created_at datetime(6) NOT NULL,
+   deleted_at datetime(6) NOT NULL,
+   KEY idx_node_tombstones_deleted_at (deleted_at),
+   KEY idx_node_tombstones_ancestry (ancestry)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+COMMIT;
@@ -0,0 +1,5 @@
+START TRANSACTION;
+
+DROP INDEX idx_nodes_type_value ON nodes;
+
+COMMIT;
@@ -0,0 +1,6 @@
+START TRANSACTION;
+
+-- typeahead counts the uses of values of one node type; controlled values are looked up by ID
+CREATE INDEX idx_nodes_type_value ON nodes (node_type_id, value(255));
+
+COMMIT;
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthTimeout limits each dependency check so a stuck DB can't hang the load balancer probe
+const healthTimeout = 2 * time.Second
+
+// poolWaitLimit is the average time requests may wait for a DB connection between readiness
+// checks before the pool counts as exhausted. Short waits while every connection is busy, such as
+// during a few concurrent exports, only make the pool degraded.
+const poolWaitLimit = time.Second
+
+// Health check status values. A check that is down makes the instance not ready; a degraded one
+// is reported but the instance still takes requests.
+const (
+	statusOK       = "ok"
+	statusDegraded = "degraded"
+	statusDown     = "down"
+)
+
+// healthCheckResult is the result of checking one dependency
+type healthCheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Message   string  `json:"message,omitempty"`
+}
+
+// schemaCheckResult adds the applied and expected migration versions to a check
+type schemaCheckResult struct {
+	healthCheckResult
+	Version  int64 `json:"version"`
+	Expected int64 `json:"expected"`
+	Dirty    bool  `json:"dirty"`
+}
+
+// poolCheckResult adds the DB connection pool stats to a check
+type poolCheckResult struct {
+	healthCheckResult
+	Open    int   `json:"open"`
+	InUse   int   `json:"in_use"`
+	Idle    int   `json:"idle"`
+	MaxOpen int   `json:"max_open"`
+	Waits   int64 `json:"waits"`
+	// waits for a connection since the previous check and their average length
+	RecentWaits int64   `json:"recent_waits"`
+	AvgWaitMS   float64 `json:"avg_wait_ms"`
+}
+
+// poolWatch keeps the pool stats from the previous readiness check, so each check can see
+// how much waiting there has been since
+type poolWatch struct {
+	mu   sync.Mutex
+	last sql.DBStats
+}
+
+// healthChecks are the results of all dependency checks
+type healthChecks struct {
+	MySQL     healthCheckResult `json:"mysql"`
+	DBPool    poolCheckResult   `json:"db_pool"`
+	Schema    schemaCheckResult `json:"schema"`
+	Templates healthCheckResult `json:"templates"`
+	Frontend  healthCheckResult `json:"frontend"`
+}
+
+// readiness is the response of the readiness check
+type readiness struct {
+	Ready   bool         `json:"ready"`
+	Version string       `json:"version"`
+	Checks  healthChecks `json:"checks"`
+}
+
+// liveness is the response of the liveness check
+type liveness struct {
+	Alive         bool    `json:"alive"`
+	Version       string  `json:"version"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+// livenessCheck reports that the process is up and serving. It checks no dependencies, so a DB
+// outage doesn't get every instance restarted.
+func (app *Apollo) livenessCheck(c *gin.Context) {
+	out := liveness{Alive: true, Version: app.Version}
+	if app.Started.IsZero() == false {
+		out.UptimeSeconds = time.Since(app.Started).Round(time.Second).Seconds()
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// readinessCheck checks each dependency and returns 503 if any is down so the load balancer stops
+// routing to this instance. This is also served at /healthcheck for the ECS target group.
+func (app *Apollo) readinessCheck(c *gin.Context) {
+	out := readiness{Version: app.Version}
+	out.Checks.DBPool = app.checkDBPool()
+	if out.Checks.DBPool.Status == statusDown {
+		// a ping would just wait for a connection; report mysql as unchecked rather than stall the probe
+		out.Checks.MySQL = healthCheckResult{Status: statusDown, Message: "not checked; connection pool exhausted"}
+		out.Checks.Schema = schemaCheckResult{healthCheckResult: out.Checks.MySQL, Expected: schemaVersion}
+	} else {
+		out.Checks.MySQL = app.checkMySQL(c.Request.Context())
+		out.Checks.Schema = app.checkSchema(c.Request.Context())
+	}
+	out.Checks.Templates = app.checkTemplates()
+	out.Checks.Frontend = app.checkFrontend()
+
+	out.Ready = true
+	for _, status := range []string{out.Checks.MySQL.Status, out.Checks.DBPool.Status, out.Checks.Schema.Status,
+		out.Checks.Templates.Status, out.Checks.Frontend.Status} {
+		if status == statusDown {
+			out.Ready = false
+		}
+	}
+	if out.Ready == false {
+		requestLog(c).Printf("WARNING: not ready: %+v", out.Checks)
+		c.JSON(http.StatusServiceUnavailable, out)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func msSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000.0
+}
+
+func (app *Apollo) checkMySQL(ctx context.Context) healthCheckResult {
+	if app.DB.DB == nil {
+		return healthCheckResult{Status: statusDown, Message: "no database connection"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := app.DB.PingContext(ctx); err != nil {
+		return healthCheckResult{Status: statusDown, LatencyMS: msSince(start), Message: err.Error()}
+	}
+	return healthCheckResult{Status: statusOK, LatencyMS: msSince(start)}
+}
+
+// checkDBPool reports the pool down when requests have been waiting a long time for a
+// connection since the previous check, since new requests would queue until they time out
+func (app *Apollo) checkDBPool() poolCheckResult {
+	if app.DB.DB == nil {
+		return poolCheckResult{healthCheckResult: healthCheckResult{Status: statusDown, Message: "no database connection"}}
+	}
+	start := time.Now()
+	stats := app.DB.Stats()
+	app.pool.mu.Lock()
+	prev := app.pool.last
+	app.pool.last = stats
+	app.pool.mu.Unlock()
+	out := poolStatus(prev, stats)
+	out.LatencyMS = msSince(start)
+	return out
+}
+
+// poolStatus rates the pool from the change in its stats between two checks
+func poolStatus(prev sql.DBStats, cur sql.DBStats) poolCheckResult {
+	out := poolCheckResult{Open: cur.OpenConnections, InUse: cur.InUse, Idle: cur.Idle,
+		MaxOpen: cur.MaxOpenConnections, Waits: cur.WaitCount}
+	out.Status = statusOK
+	out.RecentWaits = cur.WaitCount - prev.WaitCount
+	if out.RecentWaits > 0 {
+		avgWait := (cur.WaitDuration - prev.WaitDuration) / time.Duration(out.RecentWaits)
+		out.AvgWaitMS = float64(avgWait.Microseconds()) / 1000.0
+		if avgWait >= poolWaitLimit {
+			out.Status = statusDown
+			out.Message = fmt.Sprintf("%d requests waited %s on average for a connection", out.RecentWaits, avgWait.Round(time.Millisecond))
+			return out
+		}
+	}
+	if cur.MaxOpenConnections > 0 && cur.InUse >= cur.MaxOpenConnections {
+		out.Status = statusDegraded
+		out.Message = "all connections in use"
+	}
+	return out
+}
+
+// checkSchema compares the migration version recorded in schema_migrations to the one this code expects
+func (app *Apollo) checkSchema(ctx context.Context) schemaCheckResult {
+	out := schemaCheckResult{Expected: schemaVersion}
+	if app.DB.DB == nil {
+		out.Status = statusDown
+		out.Message = "no database connection"
+		return out
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	start := time.Now()
+	var err error
+	out.Version, out.Dirty, err = getSchemaVersion(ctx, app.DB)
+	out.LatencyMS = msSince(start)
+	switch {
+	case err != nil:
+		out.Status = statusDown
+		out.Message = err.Error()
+	case out.Dirty:
+		out.Status = statusDown
+		out.Message = "last migration failed; schema is dirty"
+	case out.Version < schemaVersion:
+		out.Status = statusDown
+		out.Message = "schema is older than expected"
+	case out.Version > schemaVersion:
+		out.Status = statusDegraded
+		out.Message = "schema is newer than expected"
+	default:
+		out.Status = statusOK
+	}
+	return out
+}
+
+func (app *Apollo) checkTemplates() healthCheckResult {
+	if app.QDCTemplate == nil || app.QDCTemplate.Lookup("wsls_qdc.xml") == nil {
+		return healthCheckResult{Status: statusDown, Message: "QDC template not loaded"}
+	}
+	return healthCheckResult{Status: statusOK}
+}
+
+// checkFrontend reports a missing frontend as degraded; the API still works without it
+func (app *Apollo) checkFrontend() healthCheckResult {
+	start := time.Now()
+	if app.Public == nil {
+		return healthCheckResult{Status: statusDegraded, Message: "frontend not loaded"}
+	}
+	if _, err := fs.Stat(app.Public, "index.html"); err != nil {
+		where := "the built in frontend"
+		if app.PublicDir != "" {
+			where = app.PublicDir
+		}
+		return healthCheckResult{Status: statusDegraded, LatencyMS: msSince(start), Message: "index.html not found in " + where}
+	}
+	return healthCheckResult{Status: statusOK, LatencyMS: msSince(start)}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	router := newTestRouter(t)
+	resp := doRequest(router, "GET", "/healthz", "", "")
+	if resp.Code != http.StatusOK || strings.Contains(resp.Body.String(), `"alive":true`) == false {
+		t.Errorf("healthz returned %d: %s", resp.Code, resp.Body.String())
+	}
+
+	// the test service has no database, so it is not ready
+	resp = doRequest(router, "GET", "/readyz", "", "")
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz returned %d, expected %d", resp.Code, http.StatusServiceUnavailable)
+	}
+	var ready readiness
+	if err := json.Unmarshal(resp.Body.Bytes(), &ready); err != nil {
+		t.Fatalf("readyz is not valid json: %s", err.Error())
+	}
+	if ready.Ready || ready.Checks.MySQL.Status != statusDown || ready.Checks.Schema.Expected != schemaVersion {
+		t.Errorf("expected mysql and schema to be down: %+v", ready.Checks)
+	}
+	if ready.Checks.Templates.Status != statusOK {
+		t.Errorf("expected the QDC template to be loaded: %+v", ready.Checks.Templates)
+	}
+	if ready.Checks.Frontend.Status != statusDegraded {
+		t.Errorf("expected missing frontend to be degraded: %+v", ready.Checks.Frontend)
+	}
+}
+
+func TestPoolStatus(t *testing.T) {
+	busy := sql.DBStats{MaxOpenConnections: 5, OpenConnections: 5, InUse: 5, WaitCount: 10, WaitDuration: 2 * time.Second}
+	tests := []struct {
+		name   string
+		prev   sql.DBStats
+		cur    sql.DBStats
+		status string
+	}{
+		{"idle", sql.DBStats{}, sql.DBStats{MaxOpenConnections: 5, OpenConnections: 1, Idle: 1}, statusOK},
+		{"all in use without waits", busy, busy, statusDegraded},
+		{"short waits", busy, sql.DBStats{MaxOpenConnections: 5, InUse: 5, WaitCount: 20, WaitDuration: 3 * time.Second}, statusDegraded},
+		{"long waits", busy, sql.DBStats{MaxOpenConnections: 5, InUse: 5, WaitCount: 12, WaitDuration: 6 * time.Second}, statusDown},
+	}
+	for _, tc := range tests {
+		if got := poolStatus(tc.prev, tc.cur); got.Status != tc.status {
+			t.Errorf("%s: pool is %s, expected %s: %+v", tc.name, got.Status, tc.status, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// snippetContext is the number of characters of context kept on each side of a match
+const snippetContext = 80
+
+// MatchRange is the character offset of one match within a search hit value.
+// Start is inclusive and End is exclusive.
+type MatchRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// newMatcher compiles the search query into a case-insensitive regex. Search queries
+// are handed to MySQL REGEXP, so they are treated as a regex here as well. If the query
+// is not a valid Go regex, fall back to a literal match.
+func newMatcher(query string) *regexp.Regexp {
+	re, err := regexp.Compile("(?i)" + query)
+	if err != nil {
+		re = regexp.MustCompile("(?i)" + regexp.QuoteMeta(query))
+	}
+	return re
+}
+
+// findMatches returns the character (not byte) ranges of all matches of re in val
+func findMatches(re *regexp.Regexp, val string) []MatchRange {
+	out := make([]MatchRange, 0)
+	for _, loc := range re.FindAllStringIndex(val, -1) {
+		if loc[0] == loc[1] {
+			// skip empty matches; nothing to highlight
+			continue
+		}
+		start := len([]rune(val[:loc[0]]))
+		end := start + len([]rune(val[loc[0]:loc[1]]))
+		out = append(out, MatchRange{Start: start, End: end})
+	}
+	return out
+}
+
+// buildSnippets generates a trimmed, HTML-escaped snippet around each match with the
+// matched text wrapped in <mark> tags. Matches that are close enough to share context
+// are merged into a single snippet.
+func buildSnippets(val string, matches []MatchRange) []string {
+	out := make([]string, 0)
+	if len(matches) == 0 {
+		return out
+	}
+	runes := []rune(val)
+
+	// group the matches into windows of context. A match that starts inside the
+	// context of the prior window extends it rather than starting a new one
+	type window struct {
+		start   int
+		end     int
+		matches []MatchRange
+	}
+	var windows []*window
+	for _, m := range matches {
+		wStart := max(m.Start-snippetContext, 0)
+		wEnd := min(m.End+snippetContext, len(runes))
+		if len(windows) > 0 {
+			last := windows[len(windows)-1]
+			if wStart <= last.end {
+				last.end = wEnd
+				last.matches = append(last.matches, m)
+				continue
+			}
+		}
+		windows = append(windows, &window{start: wStart, end: wEnd, matches: []MatchRange{m}})
+	}
+
+	for _, w := range windows {
+		start := trimToWord(runes, w.start, true)
+		end := trimToWord(runes, w.end, false)
+		var sb strings.Builder
+		if start > 0 {
+			sb.WriteString("...")
+		}
+		pos := start
+		for _, m := range w.matches {
+			sb.WriteString(html.EscapeString(string(runes[pos:m.Start])))
+			sb.WriteString("<mark>")
+			sb.WriteString(html.EscapeString(string(runes[m.Start:m.End])))
+			sb.WriteString("</mark>")
+			pos = m.End
+		}
+		sb.WriteString(html.EscapeString(string(runes[pos:end])))
+		if end < len(runes) {
+			sb.WriteString("...")
+		}
+		out = append(out, strings.TrimSpace(sb.String()))
+	}
+	return out
+}
+
+// trimToWord moves a snippet boundary so it does not fall in the middle of a word.
+// Start boundaries move forward to the next word, end boundaries move back to the prior one.
+// If no word break is found within the context, the original boundary is kept.
+func trimToWord(runes []rune, pos int, isStart bool) int {
+	if pos <= 0 || pos >= len(runes) {
+		return pos
+	}
+	if isStart {
+		for i := pos; i < len(runes) && i < pos+snippetContext; i++ {
+			if unicode.IsSpace(runes[i-1]) {
+				return i
+			}
+		}
+		return pos
+	}
+	for i := pos; i > 0 && i > pos-snippetContext; i-- {
+		if unicode.IsSpace(runes[i]) {
+			return i
+		}
+	}
+	return pos
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindMatches(t *testing.T) {
+	tests := []struct {
+		query string
+		val   string
+		want  []MatchRange
+	}{
+		{"roanoke", "Roanoke and roanoke", []MatchRange{{0, 7}, {12, 19}}},
+		// offsets are in characters, not bytes
+		{"fire", "Café fire", []MatchRange{{5, 9}}},
+		// an invalid regex is matched literally
+		{"vol. (1", "Vol. (1", []MatchRange{{0, 7}}},
+		{"x*", "abc", []MatchRange{}},
+	}
+	for _, tc := range tests {
+		got := findMatches(newMatcher(tc.query), tc.val)
+		if reflect.DeepEqual(got, tc.want) == false {
+			t.Errorf("matches of %q in %q are %v, expected %v", tc.query, tc.val, got, tc.want)
+		}
+	}
+}
+
+func TestBuildSnippets(t *testing.T) {
+	short := "Fire <b>at</b> the Salem station"
+	got := buildSnippets(short, findMatches(newMatcher("salem"), short))
+	if len(got) != 1 || got[0] != "Fire &lt;b&gt;at&lt;/b&gt; the <mark>Salem</mark> station" {
+		t.Errorf("short snippet is %v", got)
+	}
+
+	// matches far apart get their own snippets, trimmed to whole words
+	long := "roanoke " + strings.Repeat("word ", 60) + "roanoke"
+	got = buildSnippets(long, findMatches(newMatcher("roanoke"), long))
+	if len(got) != 2 {
+		t.Fatalf("long value has %d snippets, expected 2: %v", len(got), got)
+	}
+	if strings.HasPrefix(got[0], "<mark>roanoke</mark> word") == false || strings.HasSuffix(got[0], "word...") == false {
+		t.Errorf("first snippet is %q", got[0])
+	}
+	if strings.HasPrefix(got[1], "...word") == false || strings.HasSuffix(got[1], "<mark>roanoke</mark>") == false {
+		t.Errorf("second snippet is %q", got[1])
+	}
+
+	// matches that share context are merged
+	near := "roanoke fire in roanoke"
+	if got = buildSnippets(near, findMatches(newMatcher("roanoke"), near)); len(got) != 1 {
+		t.Errorf("near matches have %d snippets, expected 1: %v", len(got), got)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// maxResolveIdentifiers is the most identifiers that can be resolved in a single request
+const maxResolveIdentifiers = 5000
+
+// resolveBatchSize is the number of identifiers included in each lookup query
+const resolveBatchSize = 500
+
+// IdentifierMatch is one item that matches an identifier
+type IdentifierMatch struct {
+	Type          string `json:"type"`
+	ID            int64  `json:"id"`
+	PID           string `json:"pid"`
+	CollectionPID string `json:"collectionPID"`
+}
+
+// IdentifierResolution is the result of resolving a single identifier. Status is one
+// of found, ambiguous (more than one item matched) or not_found
+type IdentifierResolution struct {
+	Identifier string            `json:"identifier"`
+	Status     string            `json:"status"`
+	Matches    []IdentifierMatch `json:"matches"`
+}
+
+// ResolveResults is the response to a batch identifier resolution request
+type ResolveResults struct {
+	Found     int                    `json:"found"`
+	Ambiguous int                    `json:"ambiguous"`
+	NotFound  int                    `json:"notFound"`
+	Results   []IdentifierResolution `json:"results"`
+}
+
+// ResolveIdentifiers accepts a list of any known identifiers and returns all items that match each one
+func (app *Apollo) ResolveIdentifiers(c *gin.Context) {
+	var req struct {
+		Identifiers []string `json:"identifiers"`
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		requestLog(c).Printf("ERROR: invalid identifier resolve request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Identifiers) == 0 {
+		c.String(http.StatusBadRequest, "no identifiers specified")
+		return
+	}
+	if len(req.Identifiers) > maxResolveIdentifiers {
+		c.String(http.StatusBadRequest, fmt.Sprintf("at most %d identifiers can be resolved per request", maxResolveIdentifiers))
+		return
+	}
+
+	requestLog(c).Printf("INFO: resolve %d identifiers", len(req.Identifiers))
+	out, err := app.repo(c).ResolveIdentifiers(req.Identifiers)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to resolve identifiers: %s", err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	requestLog(c).Printf("INFO: identifiers resolved. %d found, %d ambiguous, %d not found", out.Found, out.Ambiguous, out.NotFound)
+	c.JSON(http.StatusOK, out)
+}
+
+// identifierRow is an identifier value along with the item that has it
+type identifierRow struct {
+	Identifier string         `db:"identifier"`
+	Type       string         `db:"type"`
+	ID         int64          `db:"id"`
+	PID        string         `db:"pid"`
+	Ancestry   sql.NullString `db:"ancestry"`
+}
+
+// collectionID returns the ID of the collection that contains the item
+func (r *identifierRow) collectionID() int64 {
+	return ancestryRootID(r.ID, r.Ancestry.String)
+}
+
+// match converts the row into an IdentifierMatch using a map of collection ID to PID
+func (r *identifierRow) match(collPIDs map[int64]string) IdentifierMatch {
+	return IdentifierMatch{Type: r.Type, ID: r.ID, PID: r.PID, CollectionPID: collPIDs[r.collectionID()]}
+}
+
+// cleanIdentifiers drops blank and duplicate identifiers from a resolve request but preserves order
+func cleanIdentifiers(identifiers []string) []string {
+	var idents []string
+	seen := make(map[string]bool)
+	for _, ident := range identifiers {
+		ident = strings.TrimSpace(ident)
+		if ident == "" || seen[strings.ToLower(ident)] {
+			continue
+		}
+		seen[strings.ToLower(ident)] = true
+		idents = append(idents, ident)
+	}
+	return idents
+}
+
+// resolveIdentifiers finds every item that matches each of the identifiers. Unlike lookupIdentifier,
+// all matches are returned so the caller can see when an identifier is ambiguous.
+func resolveIdentifiers(db *DB, identifiers []string) (*ResolveResults, error) {
+	idents := cleanIdentifiers(identifiers)
+	pidQ := `SELECT pid as identifier, 'apolloPID' as type, id, pid, ancestry FROM nodes
+		WHERE deleted=0 and current=1 and pid IN (?)`
+	identQ := fmt.Sprintf(`SELECT ns.value as identifier, t.name as type, np.id, np.pid, np.ancestry FROM nodes ns
+		INNER JOIN nodes np ON np.id = ns.parent_id
+		INNER JOIN node_types t on t.id = ns.node_type_id
+		WHERE ns.deleted=0 and ns.current=1 and np.deleted=0 and t.id in (%s) and ns.value IN (?)
+		ORDER BY np.id ASC`, identifierTypeIDs)
+
+	var rows []identifierRow
+	for start := 0; start < len(idents); start += resolveBatchSize {
+		end := min(start+resolveBatchSize, len(idents))
+		batch := idents[start:end]
+		for _, q := range []string{pidQ, identQ} {
+			query, args, err := sqlx.In(q, batch)
+			if err != nil {
+				return nil, err
+			}
+			var batchRows []identifierRow
+			err = db.Select(&batchRows, db.Rebind(query), args...)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, batchRows...)
+		}
+	}
+
+	// The collection is the first ID in the ancestry. Get the PIDs for all of them in one request
+	collPIDs, err := getCollectionPIDs(db, identifierCollections(rows))
+	if err != nil {
+		return nil, err
+	}
+	return resolveResults(idents, rows, collPIDs), nil
+}
+
+// identifierCollections returns the IDs of the collections containing the items in the rows
+func identifierCollections(rows []identifierRow) []int64 {
+	var collIDs []int64
+	for _, r := range rows {
+		collIDs = append(collIDs, r.collectionID())
+	}
+	return collIDs
+}
+
+// resolveResults groups the item rows matching a list of identifiers into the results for each identifier
+func resolveResults(idents []string, rows []identifierRow, collPIDs map[int64]string) *ResolveResults {
+	matches := make(map[string][]IdentifierMatch)
+	for _, r := range rows {
+		// MySQL string matches are not case sensitive; key the matches the same way
+		key := strings.ToLower(r.Identifier)
+		matches[key] = append(matches[key], r.match(collPIDs))
+	}
+
+	out := ResolveResults{Results: make([]IdentifierResolution, 0, len(idents))}
+	for _, ident := range idents {
+		res := IdentifierResolution{Identifier: ident, Status: "found", Matches: matches[strings.ToLower(ident)]}
+		switch len(res.Matches) {
+		case 0:
+			res.Status = "not_found"
+			res.Matches = make([]IdentifierMatch, 0)
+			out.NotFound++
+		case 1:
+			out.Found++
+		default:
+			res.Status = "ambiguous"
+			out.Ambiguous++
+		}
+		out.Results = append(out.Results, res)
+	}
+	return &out
+}
+
+// ancestryRootID returns the ID of the collection that contains a node. This is the first
+// ID in the ancestry. A node with no ancestry is the collection.
+func ancestryRootID(nodeID int64, ancestry string) int64 {
+	if ancestry == "" {
+		return nodeID
+	}
+	rootID, _ := strconv.ParseInt(strings.Split(ancestry, "/")[0], 10, 64)
+	return rootID
+}
+
+// getCollectionPIDs returns a map of node ID to PID for the specified collection node IDs
+func getCollectionPIDs(q sqlx.Queryer, collIDs []int64) (map[int64]string, error) {
+	out := make(map[int64]string)
+	if len(collIDs) == 0 {
+		return out, nil
+	}
+	query, args, err := sqlx.In("SELECT id, pid FROM nodes WHERE id IN (?)", collIDs)
+	if err != nil {
+		return nil, err
+	}
+	var collections []NodeIdentifier
+	err = sqlx.Select(q, &collections, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, coll := range collections {
+		out[coll.ID] = coll.PID
+	}
+	return out, nil
+}
+
+// IdentifierCollision is an identifier value that is shared by more than one item
+type IdentifierCollision struct {
+	Type       string            `json:"type"`
+	Identifier string            `json:"identifier"`
+	Items      []IdentifierMatch `json:"items"`
+}
+
+// IdentifierCheck is the result of checking a new identifier value against existing identifiers.
+// Allowed will be false if the value is a duplicate and duplicates are being rejected.
+type IdentifierCheck struct {
+	Duplicate bool              `json:"duplicate"`
+	Allowed   bool              `json:"allowed"`
+	Matches   []IdentifierMatch `json:"matches"`
+}
+
+// GetIdentifierCollisions returns a list of all identifier values that are shared by more than one item.
+// The list can be restricted to a single identifier type with the type query param.
+func (app *Apollo) GetIdentifierCollisions(c *gin.Context) {
+	typeName := c.Query("type")
+	requestLog(c).Printf("INFO: get identifier collisions [%s]", typeName)
+	out, err := app.repo(c).GetIdentifierCollisions(typeName)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to get identifier collisions: %s", err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	requestLog(c).Printf("INFO: %d identifier collisions found", len(out))
+	c.JSON(http.StatusOK, out)
+}
+
+// CheckIdentifier tests a new identifier value against all existing identifiers. Ingest and
+// edit clients use this to find duplicates before writing an identifier. The optional
+// pid is the item that will receive the identifier; it is excluded from the matches.
+func (app *Apollo) CheckIdentifier(c *gin.Context) {
+	var req struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+		PID   string `json:"pid"`
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		requestLog(c).Printf("ERROR: invalid identifier check request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Type == "" || strings.TrimSpace(req.Value) == "" {
+		c.String(http.StatusBadRequest, "type and value are required")
+		return
+	}
+
+	var itemID int64
+	if req.PID != "" {
+		ids, err := app.repo(c).LookupIdentifier(req.PID)
+		if err != nil {
+			requestLog(c).Printf("ERROR: %s", err.Error())
+			c.String(http.StatusNotFound, err.Error())
+			return
+		}
+		itemID = ids.ID
+	}
+
+	out, err := app.checkIdentifier(c, req.Type, req.Value, itemID)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to check %s %s: %s", req.Type, req.Value, err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// isIdentifierType returns true if the named node type holds an item identifier
+func isIdentifierType(typeName string) bool {
+	switch typeName {
+	case "externalPID", "barcode", "catalogKey", "callNumber", "wslsID":
+		return true
+	}
+	return false
+}
+
+// checkIdentifier finds all items other than itemID that already have the identifier value. Any write
+// of an identifier value must call this first. If duplicates are rejected by the service config,
+// the write must not proceed when the result is not allowed; otherwise the duplicate is flagged in the log.
+func (app *Apollo) checkIdentifier(c *gin.Context, typeName string, value string, itemID int64) (*IdentifierCheck, error) {
+	if isIdentifierType(typeName) == false {
+		return nil, fmt.Errorf("%s is not an identifier type", typeName)
+	}
+
+	matches, err := app.repo(c).FindIdentifier(typeName, value, itemID)
+	if err != nil {
+		return nil, err
+	}
+	return identifierCheck(requestLog(c), app.RejectDuplicateIDs, typeName, value, matches), nil
+}
+
+// identifierCheck builds the result of checking an identifier value that is used by the matching items.
+// Duplicates are flagged in the log, and not allowed when rejectDups is set.
+func identifierCheck(logger *log.Logger, rejectDups bool, typeName string, value string, matches []IdentifierMatch) *IdentifierCheck {
+	out := IdentifierCheck{Allowed: true, Matches: matches}
+	if len(out.Matches) > 0 {
+		out.Duplicate = true
+		out.Allowed = rejectDups == false
+		logger.Printf("WARNING: %s %s is already used by %d other items", typeName, value, len(out.Matches))
+	}
+	return &out
+}
+
+// identifierBatch holds the identifier values assigned by a set of changes that are written together.
+// Values are checked against the batch as well as the DB, since two items given the same value in one
+// batch would not find each other in the DB before the batch is written.
+type identifierBatch map[string][]IdentifierMatch
+
+func identifierKey(typeName string, value string) string {
+	return typeName + "|" + strings.ToLower(strings.TrimSpace(value))
+}
+
+// add records that an item is assigned an identifier value in the batch
+func (b identifierBatch) add(typeName string, value string, item IdentifierMatch) {
+	key := identifierKey(typeName, value)
+	b[key] = append(b[key], item)
+}
+
+// matches returns the items other than excludeItemID assigned the identifier value in the batch
+func (b identifierBatch) matches(typeName string, value string, excludeItemID int64) []IdentifierMatch {
+	out := make([]IdentifierMatch, 0)
+	for _, item := range b[identifierKey(typeName, value)] {
+		if item.ID != excludeItemID {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// findIdentifier finds all items other than excludeItemID that have an identifier of the given type and value.
+// It takes a Queryer so the check can be made in the transaction that writes the value.
+func findIdentifier(q sqlx.Queryer, typeName string, value string, excludeItemID int64) ([]IdentifierMatch, error) {
+	var rows []identifierRow
+	qs := `SELECT DISTINCT t.name as type, np.id, np.pid, np.ancestry FROM nodes ns
+		INNER JOIN nodes np ON np.id = ns.parent_id
+		INNER JOIN node_types t on t.id = ns.node_type_id
+		WHERE ns.deleted=0 and ns.current=1 and np.deleted=0 and t.name=? and ns.value=? and np.id<>?
+		ORDER BY np.id ASC`
+	err := sqlx.Select(q, &rows, qs, typeName, strings.TrimSpace(value), excludeItemID)
+	if err != nil {
+		return nil, err
+	}
+	collPIDs, err := getCollectionPIDs(q, identifierCollections(rows))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]IdentifierMatch, 0)
+	for _, r := range rows {
+		out = append(out, r.match(collPIDs))
+	}
+	return out, nil
+}
+
+// getIdentifierCollisions finds all identifier values that are used by more than one item. Items
+// in the trash are left out; they can't collide until they are restored.
+func getIdentifierCollisions(db *DB, typeName string) ([]IdentifierCollision, error) {
+	typeFilter := ""
+	args := make([]interface{}, 0)
+	if typeName != "" {
+		if isIdentifierType(typeName) == false {
+			return nil, fmt.Errorf("%s is not an identifier type", typeName)
+		}
+		typeFilter = "and t.name=?"
+		args = append(args, typeName)
+	}
+
+	qs := fmt.Sprintf(`SELECT t.name as type, ns.value as identifier, np.id, np.pid, np.ancestry FROM nodes ns
+		INNER JOIN nodes np ON np.id = ns.parent_id
+		INNER JOIN node_types t on t.id = ns.node_type_id
+		INNER JOIN (
+			SELECT a.node_type_id, a.value FROM nodes a
+			INNER JOIN nodes p ON p.id = a.parent_id
+			WHERE a.deleted=0 and a.current=1 and p.deleted=0 and a.node_type_id in (%s) and a.value <> ''
+			GROUP BY a.node_type_id, a.value HAVING count(distinct a.parent_id) > 1
+		) dup ON dup.node_type_id = ns.node_type_id and dup.value = ns.value
+		WHERE ns.deleted=0 and ns.current=1 and np.deleted=0 %s
+		ORDER BY t.name ASC, ns.value ASC, np.id ASC`, identifierTypeIDs, typeFilter)
+	var rows []identifierRow
+	err := db.Select(&rows, qs, args...)
+	if err != nil {
+		return nil, err
+	}
+	collPIDs, err := getCollectionPIDs(db, identifierCollections(rows))
+	if err != nil {
+		return nil, err
+	}
+	return collisionResults(rows, collPIDs), nil
+}
+
+// collisionResults groups item rows sorted by identifier type and value into collisions
+func collisionResults(rows []identifierRow, collPIDs map[int64]string) []IdentifierCollision {
+	out := make([]IdentifierCollision, 0)
+	for _, r := range rows {
+		item := r.match(collPIDs)
+		last := len(out) - 1
+		if last >= 0 && out[last].Type == r.Type && strings.EqualFold(out[last].Identifier, r.Identifier) {
+			out[last].Items = append(out[last].Items, item)
+			continue
+		}
+		out = append(out, IdentifierCollision{Type: r.Type, Identifier: r.Identifier, Items: []IdentifierMatch{item}})
+	}
+	return out
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveIdentifiers(t *testing.T) {
+	router := newTestRouter(t)
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"identifiers": []}`, http.StatusBadRequest},
+		{fmt.Sprintf(`{"identifiers": ["%s"]}`, strings.Repeat(`x", "`, maxResolveIdentifiers)+"x"), http.StatusBadRequest},
+		{`{"identifiers": "uva-an1"}`, http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		resp := doRequest(router, "POST", "/api/identifiers/resolve", tc.body, "")
+		if resp.Code != tc.status {
+			t.Errorf("resolve returned %d, expected %d: %s", resp.Code, tc.status, resp.Body.String())
+		}
+	}
+
+	// items in the trash are not resolved
+	resp := doRequest(router, "DELETE", "/api/nodes/uva-an16?version="+currentVersion(t, router, "uva-an16"), "", "user1")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("delete returned %d: %s", resp.Code, resp.Body.String())
+	}
+	var out ResolveResults
+	checkJSON(t, doRequest(router, "POST", "/api/identifiers/resolve",
+		`{"identifiers": ["uva-lib:2528443", "uva-lib:2528444", "uva-an16", "0004_1"]}`, ""), http.StatusOK, &out)
+	if out.Found != 1 || out.Ambiguous != 1 || out.NotFound != 2 || len(out.Results) != 4 {
+		t.Fatalf("unexpected resolve results %+v", out)
+	}
+	want := []string{"found", "not_found", "not_found", "ambiguous"}
+	for idx, res := range out.Results {
+		if res.Status != want[idx] {
+			t.Errorf("%s is %s, expected %s", res.Identifier, res.Status, want[idx])
+		}
+	}
+	if match := out.Results[0].Matches[0]; match.PID != "uva-an12" || match.Type != "externalPID" || match.CollectionPID != "uva-an1" {
+		t.Errorf("unexpected match %+v", match)
+	}
+}
+
+func TestIdentifierCollisions(t *testing.T) {
+	router := newTestRouter(t)
+	var dups []IdentifierCollision
+	checkJSON(t, doRequest(router, "GET", "/api/identifiers/duplicates", "", ""), http.StatusOK, &dups)
+	if len(dups) != 1 || dups[0].Identifier != "0004_1" || len(dups[0].Items) != 2 {
+		t.Fatalf("unexpected duplicates %+v", dups)
+	}
+
+	// an item in the trash no longer collides
+	resp := doRequest(router, "DELETE", "/api/nodes/uva-an109907?version="+currentVersion(t, router, "uva-an109907"), "", "user1")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("delete returned %d: %s", resp.Code, resp.Body.String())
+	}
+	checkJSON(t, doRequest(router, "GET", "/api/identifiers/duplicates", "", ""), http.StatusOK, &dups)
+	if len(dups) != 0 {
+		t.Errorf("duplicates include an item in the trash: %+v", dups)
+	}
+}
+
+func TestUpdateIdentifiers(t *testing.T) {
+	app := newTestApp(t)
+	router := newHandler(app)
+	update := func(pid string, identifiers string) *httptest.ResponseRecorder {
+		t.Helper()
+		body := fmt.Sprintf(`{"title": "Vol. 1, no. 1", "identifiers": %s, "version": "%s"}`, identifiers, currentVersion(t, router, pid))
+		return doRequest(router, "POST", "/api/nodes/"+strings.TrimPrefix(pid, "uva-an")+"/update", body, "user1")
+	}
+
+	for _, identifiers := range []string{`{"title": "x"}`, `{"barcode": " "}`} {
+		if resp := update("uva-an12", identifiers); resp.Code != http.StatusBadRequest {
+			t.Errorf("update of identifiers %s returned %d, expected %d", identifiers, resp.Code, http.StatusBadRequest)
+		}
+	}
+
+	// a value used by another item is refused when duplicates are rejected, and left unchanged
+	app.RejectDuplicateIDs = true
+	if resp := update("uva-an12", `{"externalPID": "UVA-LIB:2528444"}`); resp.Code != http.StatusConflict {
+		t.Fatalf("duplicate externalPID returned %d, expected %d: %s", resp.Code, http.StatusConflict, resp.Body.String())
+	}
+	var check IdentifierCheck
+	checkJSON(t, doRequest(router, "POST", "/api/identifiers/check", `{"type": "externalPID", "value": "uva-lib:2528443"}`, ""),
+		http.StatusOK, &check)
+	if len(check.Matches) != 1 || check.Matches[0].PID != "uva-an12" {
+		t.Errorf("refused update changed the externalPID of uva-an12: %+v", check)
+	}
+
+	// otherwise it is flagged but written
+	if resp := update("uva-an12", `{"externalPID": "uva-lib:2528450"}`); resp.Code != http.StatusOK {
+		t.Fatalf("new externalPID returned %d: %s", resp.Code, resp.Body.String())
+	}
+	app.RejectDuplicateIDs = false
+	if resp := update("uva-an12", `{"externalPID": "uva-lib:2528444"}`); resp.Code != http.StatusOK {
+		t.Fatalf("duplicate externalPID returned %d: %s", resp.Code, resp.Body.String())
+	}
+	var dups []IdentifierCollision
+	checkJSON(t, doRequest(router, "GET", "/api/identifiers/duplicates?type=externalPID", "", ""), http.StatusOK, &dups)
+	if len(dups) != 1 || len(dups[0].Items) != 2 || dups[0].Items[0].PID != "uva-an12" || dups[0].Items[1].PID != "uva-an16" {
+		t.Errorf("unexpected duplicates %+v", dups)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// logLevel is the minimum level logged. It can be changed once the config is loaded.
+var logLevel = new(slog.LevelVar)
+
+// logHandler is the JSON handler behind all logging
+var logHandler slog.Handler
+
+// logPrefixes map the level prefixes used in log messages to slog levels
+var logPrefixes = []struct {
+	prefix string
+	level  slog.Level
+}{
+	{"DEBUG:", slog.LevelDebug}, {"INFO:", slog.LevelInfo}, {"NOTICE:", slog.LevelInfo},
+	{"WARNING:", slog.LevelWarn}, {"WARN:", slog.LevelWarn}, {"ERROR:", slog.LevelError}, {"FATAL:", slog.LevelError},
+}
+
+// prefixHandler turns log.Printf("ERROR: ...") style messages into structured records. The level is
+// taken from the message prefix, which is then removed. Messages without a prefix are INFO.
+type prefixHandler struct {
+	next slog.Handler
+}
+
+// Enabled is always true since the level of a message is only known once the prefix is read
+func (h *prefixHandler) Enabled(_ context.Context, _ slog.Level) bool {
+	return true
+}
+
+func (h *prefixHandler) Handle(ctx context.Context, r slog.Record) error {
+	msg := strings.TrimSpace(r.Message)
+	level := r.Level
+	for _, lp := range logPrefixes {
+		if strings.HasPrefix(msg, lp.prefix) {
+			level = lp.level
+			msg = strings.TrimSpace(strings.TrimPrefix(msg, lp.prefix))
+			break
+		}
+	}
+	if level < logLevel.Level() {
+		return nil
+	}
+	out := slog.NewRecord(r.Time, level, msg, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(a)
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *prefixHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &prefixHandler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h *prefixHandler) WithGroup(name string) slog.Handler {
+	return &prefixHandler{next: h.next.WithGroup(name)}
+}
+
+// setupLogging sends all logging, including the standard log package, to out as JSON lines
+func setupLogging(out io.Writer) {
+	logHandler = &prefixHandler{next: slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug})}
+	slog.SetDefault(slog.New(logHandler))
+	log.SetFlags(0)
+}
+
+// setLogLevel sets the minimum level logged; one of debug, info, warn or error
+func setLogLevel(level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %s", level)
+	}
+	logLevel.Set(lvl)
+	return nil
+}
+
+// requestLog returns the logger for a request. Every line it writes includes the request ID.
+func requestLog(c *gin.Context) *log.Logger {
+	if logger, ok := c.Get("log"); ok {
+		return logger.(*log.Logger)
+	}
+	return log.Default()
+}
+
+// repo returns the repository for a request; queries log with the request ID
+func (app *Apollo) repo(c *gin.Context) Repository {
+	return app.Repo.withLog(requestLog(c))
+}
+
+// requestIDMiddleware assigns each request an ID and a logger that includes it. An X-Request-ID
+// from the load balancer or client is used when present; otherwise a new one is generated. The
+// ID is returned in the X-Request-ID response header.
+func requestIDMiddleware(c *gin.Context) {
+	reqID := c.GetHeader("X-Request-ID")
+	if reqID == "" || len(reqID) > 128 || strings.ContainsAny(reqID, " \t\r\n\"") {
+		buf := make([]byte, 12)
+		rand.Read(buf)
+		reqID = hex.EncodeToString(buf)
+	}
+	c.Set("requestID", reqID)
+	c.Header("X-Request-ID", reqID)
+	if logHandler != nil {
+		c.Set("log", slog.NewLogLogger(logHandler.WithAttrs([]slog.Attr{slog.String("request_id", reqID)}), slog.LevelInfo))
+	}
+	c.Next()
+}
+
+// accessLogMiddleware writes one line for each request once it is complete, with its status and timing
+func accessLogMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	if logHandler == nil {
+		return
+	}
+	level := slog.LevelInfo
+	if c.Writer.Status() >= 500 {
+		level = slog.LevelError
+	}
+	slog.New(logHandler).LogAttrs(c.Request.Context(), level, "request",
+		slog.String("request_id", c.GetString("requestID")),
+		slog.String("method", c.Request.Method),
+		slog.String("path", c.Request.URL.Path),
+		slog.String("route", c.FullPath()),
+		slog.Int("status", c.Writer.Status()),
+		slog.Int("bytes", c.Writer.Size()),
+		slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000.0),
+		slog.String("client_ip", c.ClientIP()),
+		slog.String("user", c.GetString("computingID")),
+	)
+}
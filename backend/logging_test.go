@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// captureLogs sends all logging to a buffer until the test is done
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	setupLogging(&buf)
+	t.Cleanup(func() {
+		logHandler = nil
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+		logLevel.Set(slog.LevelInfo)
+	})
+	return &buf
+}
+
+// logLines parses the JSON log lines in buf
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("log line is not json: %s", scanner.Text())
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestLogLevels(t *testing.T) {
+	buf := captureLogs(t)
+	setLogLevel("info")
+	log.Printf("DEBUG: hidden")
+	log.Printf("INFO: shown")
+	log.Printf("WARNING: careful")
+	log.Printf("ERROR: failed")
+	log.Printf("no prefix")
+
+	lines := logLines(t, buf)
+	want := []struct{ level, msg string }{{"INFO", "shown"}, {"WARN", "careful"}, {"ERROR", "failed"}, {"INFO", "no prefix"}}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d log lines, expected %d: %v", len(lines), len(want), lines)
+	}
+	for i, w := range want {
+		if lines[i]["level"] != w.level || lines[i]["msg"] != w.msg {
+			t.Errorf("line %d is %v %v, expected %s %s", i, lines[i]["level"], lines[i]["msg"], w.level, w.msg)
+		}
+	}
+	if err := setLogLevel("loud"); err == nil {
+		t.Errorf("unknown log level was accepted")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	buf := captureLogs(t)
+	router := newTestRouter(t)
+
+	req := httptest.NewRequest("GET", "/api/collections/uva-an99999", nil)
+	req.Header.Set("X-Request-ID", "lb-trace-1")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if got := resp.Header().Get("X-Request-ID"); got != "lb-trace-1" {
+		t.Errorf("X-Request-ID is %s, expected the incoming ID", got)
+	}
+
+	var logged, access bool
+	for _, line := range logLines(t, buf) {
+		if line["request_id"] != "lb-trace-1" {
+			t.Errorf("log line has no request ID: %v", line)
+			continue
+		}
+		if line["msg"] == "request" {
+			access = true
+			if line["status"] != float64(404) || line["route"] != "/api/collections/:pid" {
+				t.Errorf("access log has the wrong status or route: %v", line)
+			}
+			if _, ok := line["duration_ms"]; ok == false {
+				t.Errorf("access log has no duration: %v", line)
+			}
+		} else {
+			logged = true
+		}
+	}
+	if logged == false || access == false {
+		t.Errorf("expected handler and access log lines; logged=%t access=%t", logged, access)
+	}
+
+	resp = doRequest(router, "GET", "/version", "", "")
+	if len(resp.Header().Get("X-Request-ID")) != 24 {
+		t.Errorf("generated X-Request-ID is %q", resp.Header().Get("X-Request-ID"))
+	}
+}
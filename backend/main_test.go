@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// run with -update to rewrite the golden files from the current output
+var update = flag.Bool("update", false, "update golden files")
+
+// fixtureTime is the creation time of every node loaded from the fixtures
+var fixtureTime = time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestRouter builds the service handler on an in-memory repository holding the fixture collections
+func newTestRouter(t *testing.T) http.Handler {
+	t.Helper()
+	return newHandler(newTestApp(t))
+}
+
+// newTestApp builds the service on an in-memory repository holding the fixture collections.
+// Mountain Work gets IDs from 1; WSLS starts at the ID of the production WSLS collection since
+// the QDC and DPLA routes look for it by PID.
+func newTestApp(t *testing.T) *Apollo {
+	t.Helper()
+	repo := newMemoryRepository()
+	loadFixture(t, repo, "mountainwork.xml")
+	repo.nextNodeID = 109873
+	loadFixture(t, repo, "wsls_test.xml")
+
+	app := Apollo{Version: "test", ApolloURL: "https://apollo.lib.virginia.edu",
+		WSLSURL: "https://wsls.lib.virginia.edu", IIIF: "https://iiifman.lib.virginia.edu/pid",
+		Repo: repo, Admins: []string{"admin1"}, TrashDays: 30,
+		DPLACollections: []string{"uva-an109873"}}
+	app.Config = &apolloConfig{DB: dbConfig{Host: "localhost:3306", Pass: "secret"}, DPLACollections: app.DPLACollections}
+	app.QDCTemplate = template.Must(loadQDCTemplate(""))
+	app.Public, _ = publicFS("")
+	return &app
+}
+
+func loadFixture(t *testing.T, repo *memoryRepository, name string) {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("unable to open fixture %s: %s", name, err.Error())
+	}
+	defer f.Close()
+	if _, err := repo.LoadCollectionXML(f, fixtureTime); err != nil {
+		t.Fatalf("unable to load fixture %s: %s", name, err.Error())
+	}
+}
+
+// doRequest sends a request to the router as the user, if one is specified, and returns the response
+func doRequest(router http.Handler, method string, path string, body string, user string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if user != "" {
+		req.Header.Set("remote_user", user)
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+// currentVersion returns the current version of a node from the ETag of its item details
+func currentVersion(t *testing.T, router http.Handler, pid string) string {
+	t.Helper()
+	resp := doRequest(router, "GET", "/api/items/"+pid, "", "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("GET /api/items/%s returned %d: %s", pid, resp.Code, resp.Body.String())
+	}
+	return parseETag(resp.Header().Get("ETag"))
+}
+
+// checkJSON fails the test unless the response has the status, then decodes its json body into out
+func checkJSON(t *testing.T, resp *httptest.ResponseRecorder, status int, out interface{}) {
+	t.Helper()
+	if resp.Code != status {
+		t.Fatalf("returned %d, expected %d: %s", resp.Code, status, resp.Body.String())
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), out); err != nil {
+		t.Fatalf("response is not valid json: %s", err.Error())
+	}
+}
+
+// checkGolden compares output to testdata/golden/name. json output is indented first so the
+// golden files are readable and diffs are small.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	if strings.HasSuffix(name, ".json") {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, got, "", "  "); err != nil {
+			t.Fatalf("%s is not valid json: %s", name, err.Error())
+		}
+		buf.WriteString("\n")
+		got = buf.Bytes()
+	}
+	goldenFile := filepath.Join("testdata", "golden", name)
+	if *update {
+		if err := os.WriteFile(goldenFile, got, 0644); err != nil {
+			t.Fatalf("unable to write %s: %s", goldenFile, err.Error())
+		}
+		return
+	}
+	want, err := os.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatalf("unable to read %s: %s", goldenFile, err.Error())
+	}
+	if bytes.Equal(got, want) == false {
+		t.Errorf("%s does not match golden file %s\ngot:\n%s", name, goldenFile, got)
+	}
+}
+
+func TestExports(t *testing.T) {
+	router := newTestRouter(t)
+	tests := []struct {
+		golden string
+		path   string
+	}{
+		{"collections.json", "/api/collections"},
+		{"mountainwork.json", "/api/collections/uva-an1"},
+		{"mountainwork.xml", "/api/collections/uva-an1?format=xml"},
+		{"mountainwork_uvamap.xml", "/api/collections/uva-an1?format=uvamap"},
+		{"mountainwork_depth1.json", "/api/collections/uva-an1?depth=1"},
+		{"mountainwork_children.json", "/api/collections/uva-an1?children_of=uva-lib:2528442"},
+		{"wsls.json", "/api/collections/uva-lib:2214294"},
+		{"wsls.xml", "/api/collections/uva-lib:2214294?format=xml"},
+		{"wsls_uvamap.xml", "/api/collections/uva-lib:2214294?format=uvamap"},
+		{"wsls_qdc_2214295.xml", "/api/dpla/uva-lib:2214295"},
+		{"wsls_qdc_2214296.xml", "/api/dpla/uva-lib:2214296"},
+		{"dpla_pids.txt", "/api/published/dpla"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.golden, func(t *testing.T) {
+			resp := doRequest(router, "GET", tc.path, "", "")
+			if resp.Code != http.StatusOK {
+				t.Fatalf("GET %s returned %d: %s", tc.path, resp.Code, resp.Body.String())
+			}
+			checkGolden(t, tc.golden, resp.Body.Bytes())
+		})
+	}
+}
+
+func TestReads(t *testing.T) {
+	router := newTestRouter(t)
+	tests := []struct {
+		golden string
+		method string
+		path   string
+		body   string
+	}{
+		{"item.json", "GET", "/api/items/uva-lib:2528443", ""},
+		{"item_context.json", "GET", "/api/items/uva-lib:2528444/context", ""},
+		{"children.json", "GET", "/api/nodes/uva-an1/children", ""},
+		{"types.json", "GET", "/api/types", ""},
+		{"values_wslsplace.json", "GET", "/api/values/wslsPlace", ""},
+		{"suggest_wslsplace.json", "GET", "/api/suggest?type=wslsPlace&q=r", ""},
+		{"suggest_title.json", "GET", "/api/suggest?type=title&q=vol.%201", ""},
+		{"resolve.json", "POST", "/api/identifiers/resolve",
+			`{"identifiers": ["uva-lib:2528443", "0004_1", "uva-an109873", "missing"]}`},
+		{"check.json", "POST", "/api/identifiers/check", `{"type": "wslsID", "value": "0003_1"}`},
+		{"duplicates.json", "GET", "/api/identifiers/duplicates", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.golden, func(t *testing.T) {
+			resp := doRequest(router, tc.method, tc.path, tc.body, "")
+			if resp.Code != http.StatusOK {
+				t.Fatalf("%s %s returned %d: %s", tc.method, tc.path, resp.Code, resp.Body.String())
+			}
+			checkGolden(t, tc.golden, resp.Body.Bytes())
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	router := newTestRouter(t)
+	resp := doRequest(router, "GET", "/api/search?q=roanoke", "", "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("search returned %d: %s", resp.Code, resp.Body.String())
+	}
+
+	// response time changes with every run so it is left out of the golden file
+	var results SearchResults
+	if err := json.Unmarshal(resp.Body.Bytes(), &results); err != nil {
+		t.Fatalf("invalid search response: %s", err.Error())
+	}
+	results.ResponseTimeMS = 0
+	out, _ := json.Marshal(results)
+	checkGolden(t, "search_roanoke.json", out)
+}
+
+func TestErrors(t *testing.T) {
+	router := newTestRouter(t)
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		user   string
+		status int
+	}{
+		{"GET", "/api/collections/uva-an99999", "", "", http.StatusNotFound},
+		{"GET", "/api/collections/uva-an1?format=pdf", "", "", http.StatusBadRequest},
+		{"GET", "/api/collections/uva-an1?format=xml&depth=1", "", "", http.StatusBadRequest},
+		{"GET", "/api/collections/uva-an1?depth=1000000", "", "", http.StatusBadRequest},
+		{"GET", "/api/items/uva-an12?depth=51", "", "", http.StatusBadRequest},
+		{"GET", "/api/collections/uva-an1?children_of=uva-lib:2214295", "", "", http.StatusNotFound},
+		{"GET", "/api/dpla/uva-lib:2528443", "", "", http.StatusBadRequest},
+		{"GET", "/api/dpla/uva-an109907", "", "", http.StatusNotFound},
+		{"GET", "/api/suggest?type=nope&q=a", "", "", http.StatusNotFound},
+		{"POST", "/api/nodes/2/update", `{"title":"x","version":"v"}`, "", http.StatusUnauthorized},
+		{"POST", "/api/nodes/uva-an2/update", "{}", "user1", http.StatusBadRequest},
+		{"DELETE", "/api/nodes/uva-an9", "", "", http.StatusUnauthorized},
+		{"GET", "/api/audit", "", "", http.StatusUnauthorized},
+		{"DELETE", "/api/admin/trash", "", "user1", http.StatusForbidden},
+		{"GET", "/api/admin/webhooks", "", "user1", http.StatusForbidden},
+		{"GET", "/api/admin/config", "", "user1", http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		resp := doRequest(router, tc.method, tc.path, tc.body, tc.user)
+		if resp.Code != tc.status {
+			t.Errorf("%s %s returned %d, expected %d: %s", tc.method, tc.path, resp.Code, tc.status, resp.Body.String())
+		}
+	}
+}
@@ -0,0 +1,749 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The changes made by the in-memory repository follow the SQL of the MySQL repository. A change
+// checks everything that can refuse it before touching any node, so a refused change leaves no
+// trace, as a rolled back transaction does. Changes are not safe to make concurrently.
+
+// now returns the time of a change. Each change gets a later time than the one before, so
+// versions always change even when changes are made within the same microsecond.
+func (r *memoryRepository) now() time.Time {
+	ts := time.Now().UTC().Truncate(time.Microsecond)
+	if ts.After(r.lastChange) == false {
+		ts = r.lastChange.Add(time.Microsecond)
+	}
+	r.lastChange = ts
+	return ts
+}
+
+// moveNode returns the details of a node used by the shared move and audit helpers
+func (r *memoryRepository) moveNode(n *memoryNode) *moveNode {
+	return &moveNode{ID: n.ID, PID: n.PID, ParentID: sql.NullInt64{Int64: n.ParentID, Valid: n.ParentID != 0},
+		Ancestry: sql.NullString{String: n.Ancestry, Valid: n.Ancestry != ""}, Sequence: n.Sequence,
+		Container: r.typeByID(n.TypeID).Container}
+}
+
+// liveNode returns a node that is neither deleted nor an old revision, as getMoveNode does
+func (r *memoryRepository) liveNode(nodeID int64) (*memoryNode, error) {
+	n, ok := r.nodesByID[nodeID]
+	if !ok || n.visible() == false {
+		return nil, refuseChange(http.StatusNotFound, "node %d not found", nodeID)
+	}
+	return n, nil
+}
+
+// checkVersion returns a versionError if the client version of a node is not current
+func (r *memoryRepository) checkVersion(nodeID int64, clientVersion string) error {
+	version, err := r.NodeVersion(nodeID)
+	if err != nil {
+		return err
+	}
+	if version != clientVersion {
+		return &versionError{NodeID: nodeID, Version: version}
+	}
+	return nil
+}
+
+// children returns the visible children of a node in sequence order, as getChildren does
+func (r *memoryRepository) children(parentID int64) []moveNode {
+	out := make([]moveNode, 0)
+	for _, n := range r.nodes {
+		if n.ParentID == parentID && n.visible() {
+			out = append(out, *r.moveNode(n))
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Sequence == out[j].Sequence {
+			return out[i].ID < out[j].ID
+		}
+		return out[i].Sequence < out[j].Sequence
+	})
+	return out
+}
+
+// resequence renumbers siblings in the order from sequenceOrder, as resequenceChildren does
+func (r *memoryRepository) resequence(children []moveNode, containerOrder []int64, ts time.Time) {
+	current := make(map[int64]int)
+	for _, child := range children {
+		current[child.ID] = child.Sequence
+	}
+	for seq, id := range sequenceOrder(children, containerOrder) {
+		if current[id] == seq {
+			continue
+		}
+		r.nodesByID[id].Sequence = seq
+		r.nodesByID[id].UpdatedAt = &ts
+	}
+}
+
+// inSubtree reports if a node is the root, one of its revisions or one of its descendants; subtreeFilter
+func inSubtree(n *memoryNode, root *moveNode) bool {
+	return n.ID == root.ID || strings.HasPrefix(n.PID, root.PID+".") || inAncestry(n.Ancestry, root.childAncestry())
+}
+
+// inAncestry reports if an ancestry is the prefix or starts with it
+func inAncestry(ancestry string, prefix string) bool {
+	return ancestry == prefix || strings.HasPrefix(ancestry, prefix+"/")
+}
+
+// logAudit records an audit entry and queues the webhook event for it
+func (r *memoryRepository) logAudit(entry AuditEntry, ts time.Time) {
+	entry.ID = r.nextAuditID
+	r.nextAuditID++
+	entry.CreatedAt = ts
+	r.audit = append(r.audit, entry)
+	if evt, ok := auditWebhookEvent(entry); ok {
+		r.queueWebhookEvent(entry.CollectionID, evt, ts)
+	}
+}
+
+// queueWebhookEvent adds a delivery of the event for every active subscriber that wants it
+func (r *memoryRepository) queueWebhookEvent(collectionID int64, evt WebhookEvent, ts time.Time) {
+	if evt.Collection == "" && collectionID > 0 {
+		evt.Collection = r.nodesByID[collectionID].PID
+	}
+	if evt.OccurredAt.IsZero() {
+		evt.OccurredAt = ts
+	}
+	payload, _ := json.Marshal(evt)
+	for _, hook := range r.webhooks {
+		if hook.Active == false || (hook.CollectionID.Valid && hook.CollectionID.Int64 != collectionID) {
+			continue
+		}
+		if hook.Events != "" && strings.Contains(","+hook.Events+",", ","+evt.Event+",") == false {
+			continue
+		}
+		r.deliveries = append(r.deliveries, &WebhookDelivery{ID: r.nextDeliveryID, WebhookID: hook.ID,
+			Event: evt.Event, Payload: string(payload), Status: "pending", NextAttemptAt: ts, CreatedAt: ts})
+		r.nextDeliveryID++
+	}
+}
+
+func (r *memoryRepository) UpdateNode(update *nodeUpdate) (string, error) {
+	if _, err := r.liveNode(update.NodeID); err != nil {
+		return "", err
+	}
+	if err := r.checkVersion(update.NodeID, update.Version); err != nil {
+		return "", err
+	}
+	// identifiers are checked before anything is written, as the MySQL transaction is rolled back
+	for _, typeName := range update.identifierTypes() {
+		value := update.Identifiers[typeName]
+		matches, _ := r.FindIdentifier(typeName, value, update.NodeID)
+		if identifierCheck(log.Default(), update.RejectDuplicateIDs, typeName, value, matches).Allowed == false {
+			return "", refuseChange(http.StatusConflict, "%s %s is already used by another item", typeName, value)
+		}
+	}
+	ts := r.now()
+	r.updateAttribute(update.NodeID, 2, "title", update.Title, update.User, ts)
+	r.updateAttribute(update.NodeID, 12, "description", update.Description, update.User, ts)
+	for _, typeName := range update.identifierTypes() {
+		nodeType, _ := r.GetNodeType(typeName)
+		r.updateAttribute(update.NodeID, nodeType.ID, typeName, update.Identifiers[typeName], update.User, ts)
+	}
+	return r.NodeVersion(update.NodeID)
+}
+
+// updateAttribute sets the value of the attributes of one type belonging to a node and audits each change
+func (r *memoryRepository) updateAttribute(parentID int64, typeID int64, typeName string, value string, user string, ts time.Time) {
+	for _, n := range r.nodes {
+		if n.ParentID != parentID || n.TypeID != typeID || n.visible() == false || n.Value == value {
+			continue
+		}
+		oldValue := n.Value
+		n.Value = value
+		n.UpdatedAt = &ts
+		r.logAudit(auditRecord(user, "update", r.moveNode(n), typeName, "value", oldValue, value), ts)
+	}
+}
+
+func (r *memoryRepository) MoveNode(move *nodeMove) error {
+	node, err := r.liveNode(move.NodeID)
+	if err != nil {
+		return err
+	}
+	if err = r.checkVersion(move.NodeID, move.Version); err != nil {
+		return err
+	}
+	parent, err := r.liveNode(move.ParentID)
+	if err != nil {
+		return err
+	}
+	if err = r.checkVersion(move.ParentID, move.ParentVersion); err != nil {
+		return err
+	}
+	moved := r.moveNode(node)
+	if err = checkMove(moved, r.moveNode(parent)); err != nil {
+		return err
+	}
+
+	ts := r.now()
+	oldParent := r.nodesByID[node.ParentID]
+	oldPrefix := moved.childAncestry()
+	node.ParentID = parent.ID
+	node.Ancestry = r.moveNode(parent).childAncestry()
+	node.UpdatedAt = &ts
+	moved = r.moveNode(node)
+	newPrefix := moved.childAncestry()
+	for _, n := range r.nodes {
+		if inAncestry(n.Ancestry, oldPrefix) {
+			n.Ancestry = newPrefix + n.Ancestry[len(oldPrefix):]
+		}
+	}
+	if oldParent.ID != parent.ID {
+		r.resequence(r.children(oldParent.ID), nil, ts)
+	}
+	siblings, order := placeChild(r.children(parent.ID), moved, move.Position)
+	r.resequence(siblings, order, ts)
+
+	r.logAudit(auditRecord(move.User, "move", moved, r.typeByID(node.TypeID).Name, "parent", oldParent.PID, parent.PID), ts)
+	return nil
+}
+
+func (r *memoryRepository) ReorderChildren(parentID int64, version string, childPIDs []string, user string) error {
+	parent, err := r.liveNode(parentID)
+	if err != nil {
+		return err
+	}
+	if err = r.checkVersion(parentID, version); err != nil {
+		return err
+	}
+	children := r.children(parentID)
+	order, oldOrder, err := containerOrder(r.moveNode(parent), children, childPIDs)
+	if err != nil {
+		return err
+	}
+	ts := r.now()
+	r.resequence(children, order, ts)
+	newOrder := strings.Join(childPIDs, ",")
+	if newOrder != strings.Join(oldOrder, ",") {
+		r.logAudit(auditRecord(user, "reorder", r.moveNode(parent), r.typeByID(parent.TypeID).Name,
+			"children", strings.Join(oldOrder, ","), newOrder), ts)
+	}
+	return nil
+}
+
+func (r *memoryRepository) DeleteNode(nodeID int64, version string, user string) (int64, error) {
+	node, err := r.liveNode(nodeID)
+	if err != nil {
+		return 0, err
+	}
+	if node.ParentID == 0 {
+		return 0, refuseChange(http.StatusBadRequest, "%s is a collection and cannot be deleted", node.PID)
+	}
+	if err = r.checkVersion(nodeID, version); err != nil {
+		return 0, err
+	}
+
+	ts := r.now()
+	root := r.moveNode(node)
+	cnt := int64(0)
+	for _, n := range r.nodes {
+		if n.Deleted == false && inSubtree(n, root) {
+			n.Deleted = true
+			n.DeletedAt = &ts
+			n.UpdatedAt = &ts
+			cnt++
+		}
+	}
+	r.logAudit(auditRecord(user, "delete", root, r.typeByID(node.TypeID).Name, "deleted", "", fmt.Sprintf("%d nodes", cnt)), ts)
+	return cnt, nil
+}
+
+func (r *memoryRepository) RestoreNode(nodeID int64, version string, user string) (int64, error) {
+	node, ok := r.nodesByID[nodeID]
+	if !ok || node.Deleted == false || node.Current == false {
+		return 0, refuseChange(http.StatusNotFound, "node %d is not in the trash", nodeID)
+	}
+	if err := r.checkVersion(nodeID, version); err != nil {
+		return 0, err
+	}
+	if parent, ok := r.nodesByID[node.ParentID]; ok && parent.Deleted {
+		return 0, refuseChange(http.StatusConflict, "the parent of %s is deleted and must be restored first", node.PID)
+	}
+
+	ts := r.now()
+	root := r.moveNode(node)
+	deletedAt := *node.DeletedAt
+	cnt := int64(0)
+	for _, n := range r.nodes {
+		if n.Deleted && n.DeletedAt.Equal(deletedAt) && inSubtree(n, root) {
+			n.Deleted = false
+			n.DeletedAt = nil
+			n.UpdatedAt = &ts
+			cnt++
+		}
+	}
+	r.logAudit(auditRecord(user, "restore", root, r.typeByID(node.TypeID).Name,
+		"deleted", deletedAt.Format(time.RFC3339), fmt.Sprintf("%d nodes", cnt)), ts)
+	return cnt, nil
+}
+
+func (r *memoryRepository) PurgeTrash(days int, user string) (int64, error) {
+	ts := r.now()
+	cutoff := ts.AddDate(0, 0, -days)
+	kept := make([]*memoryNode, 0, len(r.nodes))
+	for _, n := range r.nodes {
+		if n.Deleted && n.DeletedAt.Before(cutoff) {
+			if n.Current && r.typeByID(n.TypeID).Container {
+				r.tombstones = append(r.tombstones, Change{ID: n.ID, PID: n.PID,
+					Ancestry: sql.NullString{String: n.Ancestry, Valid: n.Ancestry != ""}, CreatedAt: n.CreatedAt,
+					Deleted: true, ChangedAt: *n.DeletedAt})
+			}
+			delete(r.nodesByID, n.ID)
+			continue
+		}
+		kept = append(kept, n)
+	}
+	cnt := int64(len(r.nodes) - len(kept))
+	r.nodes = kept
+	if cnt > 0 {
+		r.logAudit(purgeRecord(user, days, cnt), ts)
+	}
+	return cnt, nil
+}
+
+func (r *memoryRepository) BulkReplace(req *bulkReplace) (*BulkReplaceResults, error) {
+	root, err := r.liveNode(req.RootID)
+	if err != nil {
+		return nil, err
+	}
+	rootAncestry := r.moveNode(root).childAncestry()
+	candidates := make([]BulkChange, 0)
+	for _, n := range r.nodes {
+		if n.TypeID != req.NodeType.ID || n.visible() == false || inAncestry(n.Ancestry, rootAncestry) == false {
+			continue
+		}
+		item := r.nodesByID[n.ParentID]
+		candidates = append(candidates, BulkChange{ID: n.ID, PID: n.PID, ItemID: item.ID, ItemPID: item.PID, Before: n.Value})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].ID < candidates[j].ID })
+
+	collectionID := ancestryRootID(root.ID, root.Ancestry)
+	out, err := planBulkReplace(log.Default(), req, candidates, r.nodesByID[collectionID].PID,
+		func(value string, excludeItemID int64) ([]IdentifierMatch, error) {
+			return r.FindIdentifier(req.Type, value, excludeItemID)
+		})
+	if err != nil || req.Apply == false {
+		return out, err
+	}
+
+	ts := r.now()
+	for _, change := range out.Changes {
+		r.reviseNodeValue(change.ID, change.After, ts)
+		r.logAudit(AuditEntry{ComputingID: req.User, Action: "update", CollectionID: collectionID,
+			NodeID: change.ID, NodePID: change.PID, NodeType: req.Type,
+			Field: "value", OldValue: change.Before, NewValue: change.After}, ts)
+	}
+	out.Applied = true
+	return out, nil
+}
+
+// reviseNodeValue saves a copy of a node as its next revision, then updates its value
+func (r *memoryRepository) reviseNodeValue(nodeID int64, value string, ts time.Time) {
+	n := r.nodesByID[nodeID]
+	revision := 1
+	for _, other := range r.nodes {
+		if strings.HasPrefix(other.PID, n.PID+".") {
+			revision++
+		}
+	}
+	rev := *n
+	rev.ID = r.nextNodeID
+	rev.PID = fmt.Sprintf("%s.%d", n.PID, revision)
+	rev.Current = false
+	r.nextNodeID++
+	r.nodes = append(r.nodes, &rev)
+	r.nodesByID[rev.ID] = &rev
+	n.Value = value
+	n.UpdatedAt = &ts
+}
+
+func (r *memoryRepository) Publish(pubs *PublicationResults, collectionID int64, evt WebhookEvent) error {
+	pubs.PublishedAt = r.now()
+	for idx := range pubs.Publications {
+		pub := &pubs.Publications[idx]
+		pub.ID = r.nextPublicationID
+		r.nextPublicationID++
+		pub.PublishedAt = pubs.PublishedAt
+		r.publications = append(r.publications, *pub)
+	}
+	evt.OccurredAt = pubs.PublishedAt
+	r.queueWebhookEvent(collectionID, evt, pubs.PublishedAt)
+	return nil
+}
+
+func (r *memoryRepository) GetTrash(collectionID int64) ([]TrashEntry, error) {
+	collAncestry := fmt.Sprintf("%d", collectionID)
+	out := make([]TrashEntry, 0)
+	for _, n := range r.nodes {
+		if n.Deleted == false || n.Current == false || inAncestry(n.Ancestry, collAncestry) == false {
+			continue
+		}
+		parent, ok := r.nodesByID[n.ParentID]
+		if !ok || (parent.Deleted && parent.DeletedAt.Equal(*n.DeletedAt)) {
+			continue
+		}
+		entry := TrashEntry{ID: n.ID, PID: n.PID, Type: r.typeByID(n.TypeID).Name, Value: n.Value, DeletedAt: *n.DeletedAt}
+		titleSeq := -1
+		childAncestry := r.moveNode(n).childAncestry()
+		for _, d := range r.nodes {
+			if d.ParentID == n.ID && d.TypeID == 2 && d.Current && (titleSeq < 0 || d.Sequence < titleSeq) {
+				entry.Title = d.Value
+				titleSeq = d.Sequence
+			}
+			if d.Deleted && d.Current && d.DeletedAt.Equal(*n.DeletedAt) && inAncestry(d.Ancestry, childAncestry) {
+				entry.Descendants++
+			}
+		}
+		version, err := r.NodeVersion(n.ID)
+		if err != nil {
+			return nil, err
+		}
+		entry.Version = version
+		out = append(out, entry)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].DeletedAt.Equal(out[j].DeletedAt) {
+			return out[i].ID < out[j].ID
+		}
+		return out[i].DeletedAt.After(out[j].DeletedAt)
+	})
+	return out, nil
+}
+
+// changedAt is the time a node last changed; COALESCE(updated_at, created_at)
+func (n *memoryNode) changedAt() time.Time {
+	if n.UpdatedAt != nil {
+		return *n.UpdatedAt
+	}
+	return n.CreatedAt
+}
+
+func (r *memoryRepository) GetChanges(collectionID int64, pos changeCursor, limit int) ([]Change, error) {
+	// map every node changed since the cursor to the container it belongs to
+	changed := make(map[int64]time.Time)
+	collAncestry := fmt.Sprintf("%d", collectionID)
+	for _, n := range r.nodes {
+		ts := n.changedAt()
+		if n.Current == false || ts.Before(pos.ChangedAt) {
+			continue
+		}
+		if collectionID != 0 && n.ID != collectionID && inAncestry(n.Ancestry, collAncestry) == false {
+			continue
+		}
+		cid := n.ID
+		if r.typeByID(n.TypeID).Container == false {
+			if n.ParentID == 0 {
+				continue
+			}
+			cid = n.ParentID
+		}
+		if ts.After(changed[cid]) {
+			changed[cid] = ts
+		}
+	}
+
+	out := make([]Change, 0)
+	collPIDs := r.collectionPIDs()
+	for cid, ts := range changed {
+		c, ok := r.nodesByID[cid]
+		if !ok || ts.Before(pos.ChangedAt) || (ts.Equal(pos.ChangedAt) && c.ID <= pos.ID) {
+			continue
+		}
+		out = append(out, Change{ID: c.ID, PID: c.PID, Ancestry: sql.NullString{String: c.Ancestry, Valid: c.Ancestry != ""},
+			CollectionPID: collPIDs[ancestryRootID(c.ID, c.Ancestry)], CreatedAt: c.CreatedAt, Deleted: c.Deleted, ChangedAt: ts})
+	}
+	for _, t := range r.tombstones {
+		if t.ChangedAt.Before(pos.ChangedAt) || (t.ChangedAt.Equal(pos.ChangedAt) && t.ID <= pos.ID) {
+			continue
+		}
+		if collectionID != 0 && t.ID != collectionID && inAncestry(t.Ancestry.String, collAncestry) == false {
+			continue
+		}
+		t.CollectionPID = collPIDs[ancestryRootID(t.ID, t.Ancestry.String)]
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ChangedAt.Equal(out[j].ChangedAt) {
+			return out[i].ID < out[j].ID
+		}
+		return out[i].ChangedAt.Before(out[j].ChangedAt)
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (r *memoryRepository) GetPublications(pid string, target string) ([]Publication, error) {
+	out := make([]Publication, 0)
+	for _, pub := range r.publications {
+		if pub.PID == pid && (target == "" || pub.Target == target) {
+			out = append(out, pub)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].PublishedAt.Equal(out[j].PublishedAt) {
+			return out[i].ID > out[j].ID
+		}
+		return out[i].PublishedAt.After(out[j].PublishedAt)
+	})
+	return out, nil
+}
+
+func (r *memoryRepository) GetChangedSincePublished(collectionID int64, target string) ([]ChangedItem, error) {
+	latest := make(map[int64]Publication)
+	for _, pub := range r.publications {
+		if pub.Target == target && pub.ID > latest[pub.NodeID].ID {
+			latest[pub.NodeID] = pub
+		}
+	}
+	collAncestry := fmt.Sprintf("%d", collectionID)
+	inCollection := func(n *memoryNode) bool {
+		return n.ID == collectionID || inAncestry(n.Ancestry, collAncestry)
+	}
+	published := make([]ChangedItem, 0)
+	for _, n := range r.nodes {
+		pub, ok := latest[n.ID]
+		if !ok || n.Current == false || inCollection(n) == false {
+			continue
+		}
+		published = append(published, ChangedItem{ID: n.ID, PID: n.PID,
+			Ancestry: sql.NullString{String: n.Ancestry, Valid: n.Ancestry != ""}, Deleted: n.Deleted,
+			PublishedAt: pub.PublishedAt, PublishedBy: pub.ComputingID, RecordHash: pub.RecordHash})
+	}
+	if len(published) == 0 {
+		return published, nil
+	}
+
+	earliest := published[0].PublishedAt
+	for _, rec := range published {
+		if rec.PublishedAt.Before(earliest) {
+			earliest = rec.PublishedAt
+		}
+	}
+	changed := make([]nodeChange, 0)
+	for _, n := range r.nodes {
+		if inCollection(n) && n.changedAt().After(earliest) {
+			changed = append(changed, nodeChange{ID: n.ID,
+				Ancestry: sql.NullString{String: n.Ancestry, Valid: n.Ancestry != ""}, ChangedAt: n.changedAt()})
+		}
+	}
+	return changedSincePublished(published, changed), nil
+}
+
+// auditEntries returns the audit entries matching the filter, newest first
+func (r *memoryRepository) auditEntries(filter *auditFilter) []AuditEntry {
+	out := make([]AuditEntry, 0)
+	for idx := range r.audit {
+		if filter.matches(&r.audit[idx]) {
+			out = append(out, r.audit[idx])
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].ID > out[j].ID
+		}
+		return out[i].CreatedAt.After(out[j].CreatedAt)
+	})
+	return out
+}
+
+func (r *memoryRepository) GetAuditLog(filter *auditFilter, offset int, limit int) (int, []AuditEntry, error) {
+	all := r.auditEntries(filter)
+	out := make([]AuditEntry, 0)
+	for idx := offset; idx < len(all) && idx < offset+limit; idx++ {
+		out = append(out, all[idx])
+	}
+	return len(all), out, nil
+}
+
+func (r *memoryRepository) ExportAuditLog(filter *auditFilter, each func(entry *AuditEntry) error) error {
+	for _, entry := range r.auditEntries(filter) {
+		if err := each(&entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *memoryRepository) GetWebhooks() ([]Webhook, error) {
+	out := make([]Webhook, 0)
+	for _, hook := range r.webhooks {
+		listed := *hook
+		listed.Secret = ""
+		if hook.CollectionID.Valid {
+			listed.CollectionPID = r.nodesByID[hook.CollectionID.Int64].PID
+		}
+		for _, d := range r.deliveries {
+			if d.WebhookID != hook.ID {
+				continue
+			}
+			switch d.Status {
+			case "pending", "sending":
+				listed.Pending++
+			case "delivered":
+				listed.Delivered++
+			case "failed":
+				listed.Failed++
+			}
+		}
+		out = append(out, listed)
+	}
+	return out, nil
+}
+
+func (r *memoryRepository) AddWebhook(hook *Webhook) error {
+	hook.ID = r.nextWebhookID
+	r.nextWebhookID++
+	hook.Active = true
+	hook.CreatedAt = time.Now().UTC()
+	stored := *hook
+	r.webhooks = append(r.webhooks, &stored)
+	return nil
+}
+
+func (r *memoryRepository) DeleteWebhook(hookID int64) (bool, error) {
+	found := false
+	hooks := make([]*Webhook, 0, len(r.webhooks))
+	for _, hook := range r.webhooks {
+		if hook.ID == hookID {
+			found = true
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+	r.webhooks = hooks
+	deliveries := make([]*WebhookDelivery, 0, len(r.deliveries))
+	for _, d := range r.deliveries {
+		if d.WebhookID != hookID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	r.deliveries = deliveries
+	return found, nil
+}
+
+func (r *memoryRepository) GetWebhookDeliveries(hookID int64, status string, limit int) ([]*WebhookDelivery, error) {
+	out := make([]*WebhookDelivery, 0)
+	for idx := len(r.deliveries) - 1; idx >= 0 && len(out) < limit; idx-- {
+		d := r.deliveries[idx]
+		if d.WebhookID == hookID && (status == "" || d.Status == status) {
+			listed := *d
+			out = append(out, &listed)
+		}
+	}
+	return out, nil
+}
+
+// webhook returns the subscriber with an ID, or nil if there is none
+func (r *memoryRepository) webhook(hookID int64) *Webhook {
+	for _, hook := range r.webhooks {
+		if hook.ID == hookID {
+			return hook
+		}
+	}
+	return nil
+}
+
+func (r *memoryRepository) ClaimDeliveries(worker string, limit int) ([]WebhookDelivery, error) {
+	ts := r.now()
+	claimed := 0
+	for _, d := range r.deliveries {
+		if claimed >= limit {
+			break
+		}
+		hook := r.webhook(d.WebhookID)
+		due := (d.Status == "pending" && d.NextAttemptAt.After(ts) == false) ||
+			(d.Status == "sending" && d.ClaimedAt.Before(ts.Add(-claimTimeout)))
+		if hook == nil || hook.Active == false || due == false {
+			continue
+		}
+		d.Status = "sending"
+		d.ClaimedBy = sql.NullString{String: worker, Valid: true}
+		d.ClaimedAt = &ts
+		claimed++
+	}
+	out := make([]WebhookDelivery, 0)
+	for _, d := range r.deliveries {
+		if d.Status == "sending" && d.ClaimedBy.String == worker {
+			sending := *d
+			hook := r.webhook(d.WebhookID)
+			sending.URL = hook.URL
+			sending.Secret = hook.Secret
+			out = append(out, sending)
+		}
+	}
+	return out, nil
+}
+
+func (r *memoryRepository) ReleaseDeliveries(worker string) error {
+	for _, d := range r.deliveries {
+		if d.Status == "sending" && d.ClaimedBy.String == worker {
+			d.Status = "pending"
+			d.ClaimedBy = sql.NullString{}
+			d.ClaimedAt = nil
+		}
+	}
+	return nil
+}
+
+func (r *memoryRepository) RecordDelivery(delivery *WebhookDelivery, retryIn time.Duration) error {
+	for _, d := range r.deliveries {
+		if d.ID != delivery.ID {
+			continue
+		}
+		if d.Status != "sending" || d.ClaimedBy.String != delivery.ClaimedBy.String {
+			return errClaimLost
+		}
+		ts := r.now()
+		d.Status = delivery.Status
+		d.Attempts = delivery.Attempts
+		d.LastStatus = delivery.LastStatus
+		d.ClaimedBy = sql.NullString{}
+		d.ClaimedAt = nil
+		if d.Status == "delivered" {
+			d.LastError = sql.NullString{}
+			d.DeliveredAt = &ts
+		} else {
+			d.LastError = delivery.LastError
+			d.NextAttemptAt = ts.Add(retryIn)
+		}
+		return nil
+	}
+	return errClaimLost
+}
+
+func (r *memoryRepository) QueueCreatedEvents() (int, error) {
+	ts := r.now()
+	scanTo := ts.Add(-createdScanLag)
+	if scanTo.After(r.scannedTo) == false {
+		return 0, nil
+	}
+	var nodes []createdNode
+	for _, n := range r.nodes {
+		nodeType := r.typeByID(n.TypeID)
+		if nodeType.Container == false || n.visible() == false || n.CreatedAt.After(r.scannedTo) == false || n.CreatedAt.After(scanTo) {
+			continue
+		}
+		nodes = append(nodes, createdNode{ID: n.ID, PID: n.PID, Ancestry: sql.NullString{String: n.Ancestry, Valid: n.Ancestry != ""},
+			NodeType: nodeType.Name, CreatedAt: n.CreatedAt})
+	}
+	events := createdEvents(nodes)
+	for _, created := range events {
+		r.queueWebhookEvent(created.CollectionID, created.Event, ts)
+	}
+	r.scannedTo = scanTo
+	return len(events), nil
+}
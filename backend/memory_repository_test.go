@@ -0,0 +1,674 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memoryNode is one row of the nodes table held in memory
+type memoryNode struct {
+	ID        int64
+	PID       string
+	ParentID  int64
+	Ancestry  string
+	Sequence  int
+	TypeID    int64
+	Value     string
+	Deleted   bool
+	DeletedAt *time.Time
+	Current   bool
+	CreatedAt time.Time
+	UpdatedAt *time.Time
+}
+
+// visible is true for nodes that are neither deleted nor old revisions
+func (n *memoryNode) visible() bool {
+	return n.Deleted == false && n.Current
+}
+
+// ancestors returns the IDs in the ancestry of the node, collection first
+func (n *memoryNode) ancestors() []int64 {
+	out := make([]int64, 0)
+	if n.Ancestry == "" {
+		return out
+	}
+	for _, idStr := range strings.Split(n.Ancestry, "/") {
+		id, _ := strconv.ParseInt(idStr, 10, 64)
+		out = append(out, id)
+	}
+	return out
+}
+
+// memoryRepository is a Repository that holds collections in memory for the tests. It starts with
+// the standard node types and is filled with LoadCollectionXML. It follows the same rules as the
+// MySQL repository so handlers behave the same with either one. It is not safe for concurrent changes.
+type memoryRepository struct {
+	nodes      []*memoryNode
+	nodesByID  map[int64]*memoryNode
+	types      []*NodeType
+	values     []*ControlledValue
+	nextNodeID int64
+	nextTypeID int64
+	nextCVID   int64
+
+	// purged containers, the history of changes, publications, the webhook outbox and how far the scan for created
+	// containers has reached
+	tombstones        []Change
+	audit             []AuditEntry
+	publications      []Publication
+	webhooks          []*Webhook
+	deliveries        []*WebhookDelivery
+	nextAuditID       int64
+	nextPublicationID int64
+	nextWebhookID     int64
+	nextDeliveryID    int64
+	lastChange        time.Time
+	scannedTo         time.Time
+}
+
+// newMemoryRepository creates an empty in-memory repository with the standard node types.
+// IDs match the MySQL schema since some queries depend on them.
+func newMemoryRepository() *memoryRepository {
+	repo := memoryRepository{nodesByID: make(map[int64]*memoryNode), nextNodeID: 1, nextTypeID: 100, nextCVID: 1,
+		nextAuditID: 1, nextPublicationID: 1, nextWebhookID: 1, nextDeliveryID: 1, scannedTo: time.Now().UTC()}
+	seed := []struct {
+		id        int64
+		name      string
+		container bool
+		vocab     bool
+	}{
+		{1, "collection", true, false}, {2, "title", false, false}, {3, "volume", true, false},
+		{4, "issue", true, false}, {5, "externalPID", false, false}, {6, "digitalObject", false, false},
+		{7, "year", true, false}, {8, "month", true, false}, {9, "barcode", false, false},
+		{10, "catalogKey", false, false}, {11, "useRights", false, true}, {12, "description", false, false},
+		{13, "callNumber", false, false}, {15, "wslsTopic", false, true}, {16, "wslsPlace", false, true},
+		{17, "wslsColor", false, true}, {18, "wslsTag", false, true}, {23, "wslsID", false, false},
+		{29, "dpla", false, false},
+	}
+	for _, t := range seed {
+		repo.types = append(repo.types, &NodeType{ID: t.id, PID: fmt.Sprintf("uva-ant%d", t.id), Name: t.name,
+			ControlledVocab: t.vocab, Container: t.container})
+	}
+	return &repo
+}
+
+// xmlElement is a parsed element of a collection XML document
+type xmlElement struct {
+	Name     string
+	Text     string
+	Children []*xmlElement
+}
+
+// LoadCollectionXML adds a collection in the XML format used by apolloingest. Elements with child
+// elements are containers; all others are attributes and their text is the value. Types that
+// are not known yet are added. All nodes are created at the specified time.
+func (r *memoryRepository) LoadCollectionXML(src io.Reader, createdAt time.Time) (*NodeIdentifier, error) {
+	decoder := xml.NewDecoder(src)
+	var stack []*xmlElement
+	var root *xmlElement
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			elem := &xmlElement{Name: t.Name.Local}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, elem)
+			} else if root == nil {
+				root = elem
+			}
+			stack = append(stack, elem)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].Text += string(t)
+			}
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("no collection found")
+	}
+
+	coll := r.addElement(root, nil, 0, createdAt)
+	return &NodeIdentifier{ID: coll.ID, PID: coll.PID}, nil
+}
+
+// addElement adds the node for an XML element and all of its children. IDs are assigned in
+// document order so parents always have lower IDs than their children, as with ingest.
+func (r *memoryRepository) addElement(elem *xmlElement, parent *memoryNode, sequence int, createdAt time.Time) *memoryNode {
+	nodeType := r.nodeTypeFor(elem.Name, len(elem.Children) > 0)
+	node := memoryNode{ID: r.nextNodeID, Sequence: sequence, TypeID: nodeType.ID, Current: true, CreatedAt: createdAt}
+	node.PID = fmt.Sprintf("uva-an%d", node.ID)
+	r.nextNodeID++
+	if parent != nil {
+		node.ParentID = parent.ID
+		node.Ancestry = strconv.FormatInt(parent.ID, 10)
+		if parent.Ancestry != "" {
+			node.Ancestry = parent.Ancestry + "/" + node.Ancestry
+		}
+	}
+	if nodeType.Container == false {
+		node.Value = strings.TrimSpace(elem.Text)
+		if nodeType.ControlledVocab {
+			node.Value = strconv.FormatInt(r.controlledValueFor(nodeType, node.Value).ID, 10)
+		}
+	}
+	r.nodes = append(r.nodes, &node)
+	r.nodesByID[node.ID] = &node
+	for idx, child := range elem.Children {
+		r.addElement(child, &node, idx, createdAt)
+	}
+	return &node
+}
+
+// nodeTypeFor finds a node type by name, adding it if it does not exist
+func (r *memoryRepository) nodeTypeFor(name string, container bool) *NodeType {
+	for _, t := range r.types {
+		if t.Name == name {
+			return t
+		}
+	}
+	nodeType := NodeType{ID: r.nextTypeID, PID: fmt.Sprintf("uva-ant%d", r.nextTypeID), Name: name, Container: container}
+	r.nextTypeID++
+	r.types = append(r.types, &nodeType)
+	return &nodeType
+}
+
+// controlledValueFor finds a controlled value of a type, adding it if it does not exist
+func (r *memoryRepository) controlledValueFor(nodeType *NodeType, value string) *ControlledValue {
+	for _, cv := range r.values {
+		if cv.TypeID == nodeType.ID && cv.Value == value {
+			return cv
+		}
+	}
+	cv := ControlledValue{ID: r.nextCVID, PID: fmt.Sprintf("uva-acv%d", r.nextCVID), TypeID: nodeType.ID, Value: value}
+	r.nextCVID++
+	r.values = append(r.values, &cv)
+	return &cv
+}
+
+func (r *memoryRepository) typeByID(id int64) *NodeType {
+	for _, t := range r.types {
+		if t.ID == id {
+			return t
+		}
+	}
+	return &NodeType{}
+}
+
+func (r *memoryRepository) valueByID(id int64) *ControlledValue {
+	for _, cv := range r.values {
+		if cv.ID == id {
+			return cv
+		}
+	}
+	return nil
+}
+
+// controlledValue returns the controlled value a node refers to, if its type is a controlled vocabulary
+func (r *memoryRepository) controlledValue(n *memoryNode) *ControlledValue {
+	if r.typeByID(n.TypeID).ControlledVocab == false {
+		return nil
+	}
+	id, _ := strconv.ParseInt(n.Value, 10, 64)
+	return r.valueByID(id)
+}
+
+// buildTree assembles the visible nodes accepted by include under the root the same way queryNodes does
+func (r *memoryRepository) buildTree(rootID int64, include func(n *memoryNode) bool) (*Node, error) {
+	nodes := make(map[int64]*Node)
+	var ordered []*memoryNode
+	var root *Node
+	for _, mn := range r.nodes {
+		if mn.visible() == false || (mn.ID != rootID && include(mn) == false) {
+			continue
+		}
+		nt := r.typeByID(mn.TypeID)
+		n := Node{NodeIdentifier: NodeIdentifier{ID: mn.ID, PID: mn.PID}, Sequence: mn.Sequence,
+			Type:  &NodeType{PID: nt.PID, Name: nt.Name, ControlledVocab: nt.ControlledVocab, Container: nt.Container},
+			Value: mn.Value, CreatedAt: mn.CreatedAt, UpdatedAt: mn.UpdatedAt,
+			Ancestry: sql.NullString{String: mn.Ancestry, Valid: mn.Ancestry != ""}}
+		if cv := r.controlledValue(mn); cv != nil {
+			n.Value = cv.Value
+			n.ValueURI = cv.ValueURI.String
+		}
+		nodes[n.ID] = &n
+		ordered = append(ordered, mn)
+		if n.ID == rootID {
+			root = &n
+		}
+	}
+	for _, mn := range ordered {
+		if mn.ID == rootID || mn.ParentID == 0 {
+			continue
+		}
+		parent, ok := nodes[mn.ParentID]
+		if !ok {
+			return nil, fmt.Errorf("Unable to to find parentID %d for node %d", mn.ParentID, mn.ID)
+		}
+		parent.Children = append(parent.Children, nodes[mn.ID])
+		nodes[mn.ID].Parent = parent
+	}
+	if root == nil {
+		return nil, fmt.Errorf("node %d not found", rootID)
+	}
+	sortNodes(root)
+	return root, nil
+}
+
+// depthBelow returns how many levels below the ancestor a node is, or -1 if it is not a descendant
+func depthBelow(n *memoryNode, ancestorID int64) int {
+	ids := n.ancestors()
+	for idx, id := range ids {
+		if id == ancestorID {
+			return len(ids) - idx
+		}
+	}
+	return -1
+}
+
+// withLog returns the repository itself since it does no logging
+func (r *memoryRepository) withLog(logger *log.Logger) Repository {
+	return r
+}
+
+func (r *memoryRepository) LookupIdentifier(identifier string) (*NodeIdentifier, error) {
+	for _, n := range r.nodes {
+		if n.PID == identifier && n.Deleted == false {
+			return &NodeIdentifier{ID: n.ID, PID: n.PID}, nil
+		}
+	}
+	for _, n := range r.nodes {
+		if n.visible() && isIdentifierType(r.typeByID(n.TypeID).Name) && strings.EqualFold(n.Value, identifier) &&
+			r.nodesByID[n.ParentID].Deleted == false {
+			parent := r.nodesByID[n.ParentID]
+			return &NodeIdentifier{ID: parent.ID, PID: parent.PID}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s was not found", identifier)
+}
+
+func (r *memoryRepository) LookupTrashed(pid string) (*NodeIdentifier, error) {
+	for _, n := range r.nodes {
+		if n.PID == pid && n.Deleted && n.Current {
+			return &NodeIdentifier{ID: n.ID, PID: n.PID}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not in the trash", pid)
+}
+
+func (r *memoryRepository) LookupCollectionNode(collectionID int64, identifier string) (*NodeIdentifier, error) {
+	nodeID, err := r.LookupIdentifier(identifier)
+	if err != nil {
+		return nil, err
+	}
+	n := r.nodesByID[nodeID.ID]
+	if ancestryRootID(n.ID, n.Ancestry) != collectionID {
+		return nil, fmt.Errorf("%s is not part of collection %d", identifier, collectionID)
+	}
+	return nodeID, nil
+}
+
+func (r *memoryRepository) GetNode(nodeID int64) (*Node, error) {
+	return r.buildTree(nodeID, func(n *memoryNode) bool {
+		return n.ParentID == nodeID && n.Value != ""
+	})
+}
+
+func (r *memoryRepository) GetTree(rootID int64) (*Node, error) {
+	return r.buildTree(rootID, func(n *memoryNode) bool {
+		return depthBelow(n, rootID) > 0
+	})
+}
+
+func (r *memoryRepository) GetSubtree(rootID int64, depth int) (*Node, error) {
+	root, err := r.buildTree(rootID, func(n *memoryNode) bool {
+		below := depthBelow(n, rootID)
+		return below > 0 && below <= depth+1
+	})
+	if err != nil {
+		return nil, err
+	}
+	pruneTree(root, depth)
+	return root, nil
+}
+
+func (r *memoryRepository) GetNodeCollection(node *Node) (*Node, error) {
+	if node.Ancestry.String == "" {
+		return node, nil
+	}
+	rootID := ancestryRootID(node.ID, node.Ancestry.String)
+	return r.buildTree(rootID, func(n *memoryNode) bool {
+		return n.ParentID == rootID && n.Value != ""
+	})
+}
+
+func (r *memoryRepository) GetCollections() []Collection {
+	var out []Collection
+	for _, n := range r.nodes {
+		if n.ParentID != 0 {
+			continue
+		}
+		coll := Collection{ID: n.ID, PID: n.PID}
+		for _, child := range r.nodes {
+			if child.ParentID == n.ID && child.TypeID == 2 {
+				coll.Title = child.Value
+				break
+			}
+		}
+		out = append(out, coll)
+	}
+	return out
+}
+
+// summary returns the ContainerSummary for a node
+func (r *memoryRepository) summary(n *memoryNode) ContainerSummary {
+	out := ContainerSummary{ID: n.ID, PID: n.PID, Sequence: n.Sequence, Type: r.typeByID(n.TypeID).Name}
+	titleSeq := -1
+	for _, child := range r.nodes {
+		if child.ParentID != n.ID || child.visible() == false {
+			continue
+		}
+		if r.typeByID(child.TypeID).Container {
+			out.ChildCount++
+		} else if child.TypeID == 2 && (titleSeq < 0 || child.Sequence < titleSeq) {
+			out.Title = child.Value
+			titleSeq = child.Sequence
+		}
+	}
+	return out
+}
+
+// childContainers returns the visible child containers of a node in sequence order
+func (r *memoryRepository) childContainers(parentID int64) []*memoryNode {
+	out := make([]*memoryNode, 0)
+	for _, n := range r.nodes {
+		if n.ParentID == parentID && n.visible() && r.typeByID(n.TypeID).Container {
+			out = append(out, n)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Sequence == out[j].Sequence {
+			return out[i].ID < out[j].ID
+		}
+		return out[i].Sequence < out[j].Sequence
+	})
+	return out
+}
+
+func (r *memoryRepository) GetChildSummaries(parentID int64, offset int, limit int) (int, []ContainerSummary, error) {
+	children := r.childContainers(parentID)
+	out := make([]ContainerSummary, 0)
+	for idx := offset; idx < len(children) && idx < offset+limit; idx++ {
+		out = append(out, r.summary(children[idx]))
+	}
+	return len(children), out, nil
+}
+
+func (r *memoryRepository) GetItemContext(itemID int64) (*ItemContext, error) {
+	item, ok := r.nodesByID[itemID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	out := ItemContext{Ancestors: make([]ContainerSummary, 0), Item: r.summary(item)}
+	if item.Ancestry == "" || item.ParentID == 0 {
+		out.Position = 1
+		out.SiblingCount = 1
+		return &out, nil
+	}
+	for _, id := range item.ancestors() {
+		if a, ok := r.nodesByID[id]; ok {
+			out.Ancestors = append(out.Ancestors, r.summary(a))
+		}
+	}
+
+	siblings := r.childContainers(item.ParentID)
+	out.SiblingCount = len(siblings)
+	out.Position = 1
+	for idx, sib := range siblings {
+		before := sib.Sequence < item.Sequence || (sib.Sequence == item.Sequence && sib.ID < item.ID)
+		after := sib.Sequence > item.Sequence || (sib.Sequence == item.Sequence && sib.ID > item.ID)
+		if before {
+			out.Position++
+			prev := r.summary(siblings[idx])
+			out.Previous = &prev
+		} else if after && out.Next == nil {
+			next := r.summary(siblings[idx])
+			out.Next = &next
+		}
+	}
+	return &out, nil
+}
+
+func (r *memoryRepository) NodeVersion(nodeID int64) (string, error) {
+	n, ok := r.nodesByID[nodeID]
+	if !ok || n.Current == false {
+		return "", fmt.Errorf("node %d not found", nodeID)
+	}
+	latest := n.CreatedAt
+	if n.UpdatedAt != nil {
+		latest = *n.UpdatedAt
+	}
+	children := 0
+	for _, child := range r.nodes {
+		if child.ParentID != nodeID || child.visible() == false {
+			continue
+		}
+		children++
+		ts := child.CreatedAt
+		if child.UpdatedAt != nil {
+			ts = *child.UpdatedAt
+		}
+		if ts.After(latest) {
+			latest = ts
+		}
+	}
+	return makeVersion(nodeID, latest.UTC().Format(time.RFC3339Nano), children), nil
+}
+
+func (r *memoryRepository) GetNodeTypes() ([]NodeType, error) {
+	out := make([]NodeType, 0, len(r.types))
+	for _, t := range r.types {
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.ToLower(out[i].Name) < strings.ToLower(out[j].Name)
+	})
+	return out, nil
+}
+
+func (r *memoryRepository) GetNodeType(name string) (*NodeType, error) {
+	for _, t := range r.types {
+		if strings.EqualFold(t.Name, name) {
+			out := *t
+			return &out, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *memoryRepository) GetControlledValues(typeName string) ([]ControlledValue, error) {
+	var out []ControlledValue
+	for _, cv := range r.values {
+		if strings.EqualFold(r.typeByID(cv.TypeID).Name, typeName) {
+			out = append(out, *cv)
+		}
+	}
+	return out, nil
+}
+
+func (r *memoryRepository) GetSuggestions(nodeType *NodeType, prefix string, limit int) ([]Suggestion, error) {
+	prefix = strings.ToLower(prefix)
+	out := make([]Suggestion, 0)
+	if nodeType.ControlledVocab {
+		for _, cv := range r.values {
+			if cv.TypeID != nodeType.ID || strings.HasPrefix(strings.ToLower(cv.Value), prefix) == false {
+				continue
+			}
+			sugg := Suggestion{PID: cv.PID, Value: cv.Value, ValueURI: cv.ValueURI.String}
+			for _, n := range r.nodes {
+				if n.TypeID == nodeType.ID && n.visible() && n.Value == strconv.FormatInt(cv.ID, 10) {
+					sugg.Count++
+				}
+			}
+			out = append(out, sugg)
+		}
+	} else {
+		counts := make(map[string]int)
+		for _, n := range r.nodes {
+			if n.TypeID == nodeType.ID && n.visible() && strings.HasPrefix(strings.ToLower(n.Value), prefix) {
+				if counts[n.Value] == 0 {
+					out = append(out, Suggestion{Value: n.Value})
+				}
+				counts[n.Value]++
+			}
+		}
+		for idx := range out {
+			out[idx].Count = counts[out[idx].Value]
+		}
+	}
+	return topSuggestions(out, limit), nil
+}
+
+func (r *memoryRepository) SearchNodes(query string) ([]searchRow, error) {
+	matcher := newMatcher(query)
+	rows := make([]searchRow, 0)
+	for _, n := range r.nodes {
+		parent, ok := r.nodesByID[n.ParentID]
+		if n.TypeID == 6 || n.visible() == false || !ok || parent.Deleted {
+			continue
+		}
+		nodeType := r.typeByID(n.TypeID)
+		row := searchRow{ID: n.ID, PID: n.PID, ParentID: parent.ID, ParentPID: parent.PID,
+			Type: nodeType.Name, Ancestry: n.Ancestry, Value: n.Value}
+		if cv := r.controlledValue(n); cv != nil {
+			row.ControlledValue = cv.Value
+		}
+		if matcher.MatchString(row.Value) == false && (row.ControlledValue == "" || matcher.MatchString(row.ControlledValue) == false) {
+			continue
+		}
+		if row.Type != "title" {
+			for _, sib := range r.nodes {
+				if sib.ParentID == parent.ID && sib.TypeID == 2 && sib.visible() {
+					row.ItemTitle = sib.Value
+					break
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// identifierRows returns the visible identifier nodes accepted by include as rows for their items
+func (r *memoryRepository) identifierRows(include func(n *memoryNode, typeName string) bool) []identifierRow {
+	rows := make([]identifierRow, 0)
+	for _, n := range r.nodes {
+		typeName := r.typeByID(n.TypeID).Name
+		if n.visible() == false || isIdentifierType(typeName) == false || include(n, typeName) == false {
+			continue
+		}
+		item := r.nodesByID[n.ParentID]
+		rows = append(rows, identifierRow{Identifier: n.Value, Type: typeName, ID: item.ID, PID: item.PID,
+			Ancestry: sql.NullString{String: item.Ancestry, Valid: item.Ancestry != ""}})
+	}
+	return rows
+}
+
+// collectionPIDs returns a map of collection ID to PID for every collection
+func (r *memoryRepository) collectionPIDs() map[int64]string {
+	out := make(map[int64]string)
+	for _, n := range r.nodes {
+		if n.ParentID == 0 {
+			out[n.ID] = n.PID
+		}
+	}
+	return out
+}
+
+func (r *memoryRepository) ResolveIdentifiers(identifiers []string) (*ResolveResults, error) {
+	idents := cleanIdentifiers(identifiers)
+	wanted := make(map[string]bool)
+	for _, ident := range idents {
+		wanted[strings.ToLower(ident)] = true
+	}
+	var rows []identifierRow
+	for _, n := range r.nodes {
+		if n.visible() && wanted[strings.ToLower(n.PID)] {
+			rows = append(rows, identifierRow{Identifier: n.PID, Type: "apolloPID", ID: n.ID, PID: n.PID,
+				Ancestry: sql.NullString{String: n.Ancestry, Valid: n.Ancestry != ""}})
+		}
+	}
+	identRows := r.identifierRows(func(n *memoryNode, typeName string) bool {
+		return wanted[strings.ToLower(n.Value)] && r.nodesByID[n.ParentID].Deleted == false
+	})
+	sort.SliceStable(identRows, func(i, j int) bool { return identRows[i].ID < identRows[j].ID })
+	rows = append(rows, identRows...)
+	return resolveResults(idents, rows, r.collectionPIDs()), nil
+}
+
+func (r *memoryRepository) FindIdentifier(typeName string, value string, excludeItemID int64) ([]IdentifierMatch, error) {
+	value = strings.TrimSpace(value)
+	rows := r.identifierRows(func(n *memoryNode, name string) bool {
+		return name == typeName && strings.EqualFold(n.Value, value) && n.ParentID != excludeItemID &&
+			r.nodesByID[n.ParentID].Deleted == false
+	})
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+	collPIDs := r.collectionPIDs()
+	out := make([]IdentifierMatch, 0)
+	seen := make(map[int64]bool)
+	for _, row := range rows {
+		if seen[row.ID] == false {
+			seen[row.ID] = true
+			out = append(out, row.match(collPIDs))
+		}
+	}
+	return out, nil
+}
+
+func (r *memoryRepository) GetIdentifierCollisions(typeName string) ([]IdentifierCollision, error) {
+	if typeName != "" && isIdentifierType(typeName) == false {
+		return nil, fmt.Errorf("%s is not an identifier type", typeName)
+	}
+	all := r.identifierRows(func(n *memoryNode, name string) bool {
+		return n.Value != "" && (typeName == "" || name == typeName) && r.nodesByID[n.ParentID].Deleted == false
+	})
+	items := make(map[string]map[int64]bool)
+	for _, row := range all {
+		key := row.Type + "|" + strings.ToLower(row.Identifier)
+		if items[key] == nil {
+			items[key] = make(map[int64]bool)
+		}
+		items[key][row.ID] = true
+	}
+	rows := make([]identifierRow, 0)
+	for _, row := range all {
+		if len(items[row.Type+"|"+strings.ToLower(row.Identifier)]) > 1 {
+			rows = append(rows, row)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Type != rows[j].Type {
+			return rows[i].Type < rows[j].Type
+		}
+		if strings.ToLower(rows[i].Identifier) != strings.ToLower(rows[j].Identifier) {
+			return strings.ToLower(rows[i].Identifier) < strings.ToLower(rows[j].Identifier)
+		}
+		return rows[i].ID < rows[j].ID
+	})
+	return collisionResults(rows, r.collectionPIDs()), nil
+}
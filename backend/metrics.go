@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics for the service. They are served at /metrics along with the Go runtime,
+// process and DB pool metrics.
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apollo_http_requests_total",
+		Help: "HTTP requests by method, route and status.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "apollo_http_request_duration_seconds",
+		Help:    "HTTP request latency by method, route and status.",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"method", "route", "status"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "apollo_db_query_duration_seconds",
+		Help:    "Time to run repository queries by kind.",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"query"})
+
+	treeNodes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "apollo_tree_nodes",
+		Help:    "Number of nodes in each tree or subtree loaded.",
+		Buckets: prometheus.ExponentialBuckets(10, 4, 8),
+	}, []string{"query"})
+
+	exportBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apollo_export_bytes_total",
+		Help: "Uncompressed bytes of exported records by format.",
+	}, []string{"format"})
+
+	searchHits = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "apollo_search_hits",
+		Help:    "Number of hits returned by each search.",
+		Buckets: []float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	})
+)
+
+// registerDBMetrics adds the connection pool stats of the DB to the metrics
+func registerDBMetrics(db *DB, dbName string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db.DB.DB, dbName))
+}
+
+// metricsHandler serves the metrics. Compression is left to the gzip middleware.
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{DisableCompression: true}))
+}
+
+// metricsMiddleware counts and times every request by its route pattern, so all
+// requests for /api/collections/:pid are reported together
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	status := strconv.Itoa(c.Writer.Status())
+	httpRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+	httpDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+}
+
+// observeQuery records the time taken by a query; call it deferred with the start time
+func observeQuery(kind string, start time.Time) {
+	queryDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+}
+
+// observeTree records the number of nodes in a loaded tree
+func observeTree(kind string, root *Node) {
+	if root != nil {
+		treeNodes.WithLabelValues(kind).Observe(float64(countNodes(root)))
+	}
+}
+
+func countNodes(node *Node) int {
+	cnt := 1
+	for _, child := range node.Children {
+		cnt += countNodes(child)
+	}
+	return cnt
+}
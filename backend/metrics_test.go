@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	router := newTestRouter(t)
+	doRequest(router, "GET", "/api/collections/uva-an1?format=xml", "", "")
+	doRequest(router, "GET", "/api/search?q=roanoke", "", "")
+	resp := doRequest(router, "GET", "/metrics", "", "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("metrics returned %d: %s", resp.Code, resp.Body.String())
+	}
+	for _, want := range []string{
+		`apollo_http_requests_total{method="GET",route="/api/collections/:pid",status="200"}`,
+		`apollo_export_bytes_total{format="xml"}`,
+		`apollo_search_hits_count`,
+	} {
+		if strings.Contains(resp.Body.String(), want) == false {
+			t.Errorf("metrics are missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// The schema migrations are built into the server. They use the file naming and the
+// schema_migrations table of golang-migrate, so databases migrated with its CLI carry on from
+// where they are.
+//
+//go:embed db/migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the name of the MySQL advisory lock held while migrating, so only one
+// instance migrates when several start at once
+const migrationLock = "apollo_schema_migrations"
+
+// migrationLockWait is how long to wait for another instance to finish migrating
+const migrationLockWait = 10 * time.Minute
+
+// migration is one numbered schema change along with the SQL to undo it
+type migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migrations are all of the embedded migrations in version order
+var migrations = mustLoadMigrations(migrationFiles, "db/migrations")
+
+// schemaVersion is the version of the last migration; the schema this code expects
+var schemaVersion = migrations[len(migrations)-1].Version
+
+func mustLoadMigrations(files fs.FS, dir string) []migration {
+	out, err := loadMigrations(files, dir)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// loadMigrations reads the NNNNNN_name.up.sql and NNNNNN_name.down.sql files in dir
+func loadMigrations(files fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		verStr, title, ok2 := strings.Cut(base, "_")
+		version, err := strconv.ParseInt(verStr, 10, 64)
+		if !ok || !ok2 || err != nil || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration file %s is not named VERSION_name.up.sql or VERSION_name.down.sql", name)
+		}
+		sqlBytes, err := fs.ReadFile(files, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version, Name: title}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(sqlBytes)
+		} else {
+			m.Down = string(sqlBytes)
+		}
+	}
+	if len(byVersion) == 0 {
+		return nil, fmt.Errorf("no migrations found in %s", dir)
+	}
+	out := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if strings.TrimSpace(m.Up) == "" {
+			return nil, fmt.Errorf("migration %d has no up sql", m.Version)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// migrationDB opens a connection for migrating. Migration files hold several statements, and
+// statements may wait on the lock or run longer than the request timeouts allow, so this
+// doesn't use the service connection.
+func migrationDB(cfg *dbConfig) (*sql.DB, error) {
+	connectStr := fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true&timeout=%ds&multiStatements=true",
+		cfg.User, cfg.Pass, cfg.Host, cfg.Database, cfg.Timeout)
+	db, err := sql.Open("mysql", connectStr)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("database connection failed: %s", err.Error())
+	}
+	return db, nil
+}
+
+// queryRower is a *sql.DB, *sql.Conn or *DB
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// getSchemaVersion returns the applied migration version. It is 0 when no migration has run.
+func getSchemaVersion(ctx context.Context, db queryRower) (version int64, dirty bool, err error) {
+	err = db.QueryRowContext(ctx, "select version, dirty from schema_migrations limit 1").Scan(&version, &dirty)
+	var myErr *mysql.MySQLError
+	if errors.Is(err, sql.ErrNoRows) || (errors.As(err, &myErr) && myErr.Number == 1146) {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
+
+// checkSchemaVersion returns an error if the schema is older than the code expects or a
+// migration failed part way
+func checkSchemaVersion(ctx context.Context, db queryRower) error {
+	version, dirty, err := getSchemaVersion(ctx, db)
+	if err != nil {
+		return fmt.Errorf("unable to read schema version: %s", err.Error())
+	}
+	if dirty {
+		return fmt.Errorf("schema version %d is dirty; a migration failed and must be fixed by hand, then run: apollosvr migrate force %d", version, version)
+	}
+	if version < schemaVersion {
+		return fmt.Errorf("schema version %d is older than %d; run apollosvr migrate up or start with -auto-migrate", version, schemaVersion)
+	}
+	if version > schemaVersion {
+		log.Printf("WARNING: schema version %d is newer than %d; this server is older than the database", version, schemaVersion)
+	}
+	return nil
+}
+
+// migrator runs migrations on a single connection that holds the advisory lock
+type migrator struct {
+	conn *sql.Conn
+}
+
+// lockMigrations gets a connection and takes the migration lock, waiting for another instance to
+// finish if it holds it. Call unlock when done.
+func lockMigrations(ctx context.Context, db *sql.DB) (*migrator, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "select get_lock(?, ?)", migrationLock, int(migrationLockWait.Seconds())).Scan(&locked)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to get migration lock: %s", err.Error())
+	}
+	if locked.Int64 != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("timed out waiting for migration lock %s", migrationLock)
+	}
+	return &migrator{conn: conn}, nil
+}
+
+func (m *migrator) unlock() {
+	m.conn.ExecContext(context.Background(), "select release_lock(?)", migrationLock)
+	m.conn.Close()
+}
+
+func (m *migrator) ensureTable(ctx context.Context) error {
+	_, err := m.conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)")
+	return err
+}
+
+// setVersion records the version, marked dirty while its sql is running. Version 0 clears it.
+func (m *migrator) setVersion(ctx context.Context, version int64, dirty bool) error {
+	if _, err := m.conn.ExecContext(ctx, "delete from schema_migrations"); err != nil {
+		return err
+	}
+	if version == 0 {
+		return nil
+	}
+	_, err := m.conn.ExecContext(ctx, "insert into schema_migrations (version, dirty) values (?, ?)", version, dirty)
+	return err
+}
+
+// run applies the sql of a migration, leaving the version dirty if it fails
+func (m *migrator) run(ctx context.Context, version int64, sqlText string) error {
+	if err := m.setVersion(ctx, version, true); err != nil {
+		return err
+	}
+	if strings.TrimSpace(sqlText) != "" {
+		if _, err := m.conn.ExecContext(ctx, sqlText); err != nil {
+			return err
+		}
+	}
+	return m.setVersion(ctx, version, false)
+}
+
+// up applies all migrations newer than the schema version and returns the number applied
+func (m *migrator) up(ctx context.Context) (int, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return 0, err
+	}
+	version, dirty, err := getSchemaVersion(ctx, m.conn)
+	if err != nil {
+		return 0, err
+	}
+	if dirty {
+		return 0, fmt.Errorf("schema version %d is dirty; fix it by hand, then run: apollosvr migrate force %d", version, version)
+	}
+	applied := 0
+	for _, mig := range migrations {
+		if mig.Version <= version {
+			continue
+		}
+		log.Printf("INFO: migrate up to %d %s", mig.Version, mig.Name)
+		start := time.Now()
+		if err := m.run(ctx, mig.Version, mig.Up); err != nil {
+			return applied, fmt.Errorf("migration %d %s failed: %s", mig.Version, mig.Name, err.Error())
+		}
+		log.Printf("INFO: migrated up to %d in %s", mig.Version, time.Since(start))
+		applied++
+	}
+	return applied, nil
+}
+
+// down reverts the given number of migrations, newest first
+func (m *migrator) down(ctx context.Context, steps int) (int, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return 0, err
+	}
+	version, dirty, err := getSchemaVersion(ctx, m.conn)
+	if err != nil {
+		return 0, err
+	}
+	if dirty {
+		return 0, fmt.Errorf("schema version %d is dirty; fix it by hand, then run: apollosvr migrate force %d", version, version)
+	}
+	plan, err := planDown(migrations, version, steps)
+	if err != nil {
+		return 0, err
+	}
+	reverted := 0
+	for _, step := range plan {
+		log.Printf("INFO: migrate down from %d %s", step.mig.Version, step.mig.Name)
+		if err := m.run(ctx, step.prev, step.mig.Down); err != nil {
+			return reverted, fmt.Errorf("migration %d %s down failed: %s", step.mig.Version, step.mig.Name, err.Error())
+		}
+		reverted++
+	}
+	return reverted, nil
+}
+
+// downStep is a migration to revert and the version left once it is
+type downStep struct {
+	mig  migration
+	prev int64
+}
+
+// planDown lists the migrations to revert to go down steps from version. It fails before
+// anything is reverted if one of them has no down sql.
+func planDown(all []migration, version int64, steps int) ([]downStep, error) {
+	plan := make([]downStep, 0, steps)
+	for i := len(all) - 1; i >= 0 && len(plan) < steps; i-- {
+		if all[i].Version > version {
+			continue
+		}
+		if strings.TrimSpace(all[i].Down) == "" {
+			return nil, fmt.Errorf("migration %d %s has no down sql and can't be reverted", all[i].Version, all[i].Name)
+		}
+		prev := int64(0)
+		if i > 0 {
+			prev = all[i-1].Version
+		}
+		plan = append(plan, downStep{mig: all[i], prev: prev})
+	}
+	return plan, nil
+}
+
+// force sets the schema version and clears the dirty flag without running any sql
+func (m *migrator) force(ctx context.Context, version int64) error {
+	if err := m.ensureTable(ctx); err != nil {
+		return err
+	}
+	return m.setVersion(ctx, version, false)
+}
+
+// autoMigrate applies any new migrations at startup under the migration lock
+func autoMigrate(cfg *dbConfig) error {
+	db, err := migrationDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.Background()
+	log.Printf("INFO: waiting for migration lock")
+	m, err := lockMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer m.unlock()
+	applied, err := m.up(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: %d migrations applied; schema is at version %d", applied, schemaVersion)
+	return nil
+}
+
+// migrateCommand runs apollosvr migrate up|down [N]|force VERSION|status, followed by the usual
+// config flags for the database
+func migrateCommand(args []string) error {
+	usage := fmt.Errorf("usage: apollosvr migrate up|down [N]|force VERSION|status [flags]")
+	if len(args) == 0 {
+		return usage
+	}
+	action := args[0]
+	args = args[1:]
+	var num int64
+	if action == "down" || action == "force" {
+		num = 1
+		if len(args) > 0 && strings.HasPrefix(args[0], "-") == false {
+			n, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%s needs a number; got %s", action, args[0])
+			}
+			num = n
+			args = args[1:]
+		} else if action == "force" {
+			return usage
+		}
+	} else if action != "up" && action != "status" {
+		return usage
+	}
+
+	cfg, _, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	db, err := migrationDB(&cfg.DB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	if action == "status" {
+		return printMigrationStatus(ctx, db)
+	}
+
+	m, err := lockMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer m.unlock()
+	switch action {
+	case "up":
+		applied, err := m.up(ctx)
+		log.Printf("INFO: %d migrations applied", applied)
+		return err
+	case "down":
+		reverted, err := m.down(ctx, int(num))
+		log.Printf("INFO: %d migrations reverted", reverted)
+		return err
+	default:
+		log.Printf("INFO: force schema version to %d", num)
+		return m.force(ctx, num)
+	}
+}
+
+func printMigrationStatus(ctx context.Context, db *sql.DB) error {
+	version, dirty, err := getSchemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, mig := range migrations {
+		state := "pending"
+		if mig.Version <= version {
+			state = "applied"
+		}
+		if mig.Version == version && dirty {
+			state = "dirty"
+		}
+		fmt.Printf("%06d  %-25s %s\n", mig.Version, mig.Name, state)
+	}
+	fmt.Printf("schema version %d, expected %d", version, schemaVersion)
+	if dirty {
+		fmt.Printf(" (dirty)")
+	}
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	for i, mig := range migrations {
+		if mig.Version != int64(i+1) {
+			t.Errorf("migration %s has version %d, expected %d", mig.Name, mig.Version, i+1)
+		}
+	}
+	if schemaVersion != migrations[len(migrations)-1].Version {
+		t.Errorf("schema version %d is not the last migration", schemaVersion)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	files := fstest.MapFS{
+		"m/000002_second.up.sql":   {Data: []byte("ALTER TABLE a ADD b int;")},
+		"m/000002_second.down.sql": {Data: []byte("ALTER TABLE a DROP b;")},
+		"m/000001_first.up.sql":    {Data: []byte("CREATE TABLE a (id int);")},
+	}
+	got, err := loadMigrations(files, "m")
+	if err != nil {
+		t.Fatalf("unable to load migrations: %s", err.Error())
+	}
+	if len(got) != 2 || got[0].Name != "first" || got[1].Version != 2 || got[1].Down == "" || got[0].Down != "" {
+		t.Errorf("unexpected migrations: %+v", got)
+	}
+
+	files["m/notes.txt"] = &fstest.MapFile{Data: []byte("x")}
+	if _, err := loadMigrations(files, "m"); err == nil {
+		t.Errorf("badly named migration file was accepted")
+	}
+}
+
+func TestPlanDown(t *testing.T) {
+	all := []migration{{Version: 1, Name: "first", Up: "a"}, {Version: 2, Name: "second", Up: "b", Down: "c"},
+		{Version: 3, Name: "third", Up: "d", Down: "e"}}
+	plan, err := planDown(all, 3, 2)
+	if err != nil {
+		t.Fatalf("unable to plan down: %s", err.Error())
+	}
+	if len(plan) != 2 || plan[0].mig.Version != 3 || plan[0].prev != 2 || plan[1].prev != 1 {
+		t.Errorf("unexpected plan: %+v", plan)
+	}
+	if _, err := planDown(all, 2, 2); err == nil {
+		t.Errorf("migration with no down sql was planned")
+	}
+}
+
+func TestMigrateCommandUsage(t *testing.T) {
+	for _, args := range [][]string{{}, {"sideways"}, {"force"}, {"down", "two"}} {
+		if err := migrateCommand(args); err == nil {
+			t.Errorf("migrate %v should fail before connecting", args)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// moveNode holds the details about a node needed to move or reorder it
+type moveNode struct {
+	ID        int64          `db:"id"`
+	PID       string         `db:"pid"`
+	ParentID  sql.NullInt64  `db:"parent_id"`
+	Ancestry  sql.NullString `db:"ancestry"`
+	Sequence  int            `db:"sequence"`
+	Container bool           `db:"container"`
+}
+
+// childAncestry returns the ancestry string that the children of this node will have
+func (n *moveNode) childAncestry() string {
+	if n.Ancestry.String == "" {
+		return fmt.Sprintf("%d", n.ID)
+	}
+	return fmt.Sprintf("%s/%d", n.Ancestry.String, n.ID)
+}
+
+// nodeMove is a request to move a node under a new parent. The versions of both are required.
+// Position is the 0-based index among the child containers of the new parent; without one the
+// node goes after the existing children.
+type nodeMove struct {
+	NodeID        int64
+	Version       string
+	ParentID      int64
+	ParentVersion string
+	Position      *int
+	User          string
+}
+
+// MoveNode moves a node and all of its descendants under a new parent container in the same collection.
+// The node is added after the existing children of the new parent unless a position is specified.
+// Position is the 0-based index among the child containers of the new parent. The versions of
+// both the node and the new parent are required, so a move into a container that was reordered or
+// emptied since the client loaded it is rejected.
+func (app *Apollo) MoveNode(c *gin.Context) {
+	var req struct {
+		Parent        string `json:"parent"`
+		Position      *int   `json:"position"`
+		Version       string `json:"version"`
+		ParentVersion string `json:"parentVersion"`
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		requestLog(c).Printf("ERROR: invalid move request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Parent == "" {
+		c.String(http.StatusBadRequest, "parent is required")
+		return
+	}
+
+	nodeIDs, dbErr := app.repo(c).LookupIdentifier(c.Param("id"))
+	if dbErr != nil {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
+		return
+	}
+	parentIDs, dbErr := app.repo(c).LookupIdentifier(req.Parent)
+	if dbErr != nil {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
+		return
+	}
+	move := nodeMove{NodeID: nodeIDs.ID, Version: requestVersion(c, req.Version), ParentID: parentIDs.ID,
+		ParentVersion: req.ParentVersion, Position: req.Position, User: c.GetString("computingID")}
+	if versionMissing(c, move.Version) || versionMissing(c, move.ParentVersion) {
+		return
+	}
+
+	requestLog(c).Printf("INFO: move %s to %s", nodeIDs.PID, parentIDs.PID)
+	err = app.repo(c).MoveNode(&move)
+	if err != nil {
+		// a stale parent is returned with its children, as for a reorder
+		depth := 0
+		var stale *versionError
+		if errors.As(err, &stale) && stale.NodeID == parentIDs.ID {
+			depth = 1
+		}
+		app.changeFailed(c, err, depth)
+		return
+	}
+	c.String(http.StatusOK, "moved")
+}
+
+// ReorderChildren sets the order of the child containers of a node. The request must list the
+// PIDs of all child containers in the new order along with the version of the node. Attributes keep their positions, and the
+// sequence of all children is renumbered without gaps.
+func (app *Apollo) ReorderChildren(c *gin.Context) {
+	var req struct {
+		Children []string `json:"children"`
+		Version  string   `json:"version"`
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		requestLog(c).Printf("ERROR: invalid reorder request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	nodeIDs, dbErr := app.repo(c).LookupIdentifier(c.Param("id"))
+	if dbErr != nil {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
+		return
+	}
+	version := requestVersion(c, req.Version)
+	if versionMissing(c, version) {
+		return
+	}
+
+	requestLog(c).Printf("INFO: reorder %d children of %s", len(req.Children), nodeIDs.PID)
+	err = app.repo(c).ReorderChildren(nodeIDs.ID, version, req.Children, c.GetString("computingID"))
+	if err != nil {
+		app.changeFailed(c, err, 1)
+		return
+	}
+	c.String(http.StatusOK, "reordered")
+}
+
+// moveToParent moves a node under a new parent in a single transaction
+func moveToParent(db *DB, move *nodeMove) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	node, err := getMoveNode(tx, move.NodeID)
+	if err != nil {
+		return refuseChange(http.StatusNotFound, "node %d not found", move.NodeID)
+	}
+	err = checkVersion(tx, move.NodeID, move.Version)
+	if err != nil {
+		return err
+	}
+	_, err = getMoveNode(tx, move.ParentID)
+	if err != nil {
+		return refuseChange(http.StatusNotFound, "node %d not found", move.ParentID)
+	}
+	err = checkVersion(tx, move.ParentID, move.ParentVersion)
+	if err != nil {
+		return err
+	}
+
+	err = moveSubtree(tx, move.NodeID, move.ParentID, move.Position)
+	if err != nil {
+		return err
+	}
+	var oldParentPID, newParentPID string
+	err = tx.Get(&oldParentPID, "SELECT pid FROM nodes WHERE id=?", node.ParentID.Int64)
+	if err == nil {
+		err = tx.Get(&newParentPID, "SELECT pid FROM nodes WHERE id=?", move.ParentID)
+	}
+	if err == nil {
+		err = logAudit(tx, auditRecord(move.User, "move", node, nodeTypeName(tx, db.Log, node.ID),
+			"parent", oldParentPID, newParentPID))
+	}
+	if err != nil {
+		return fmt.Errorf("unable to audit move of %s: %s", node.PID, err.Error())
+	}
+	return tx.Commit()
+}
+
+// reorderChildren sets the order of the child containers of a node in a single transaction
+func reorderChildren(db *DB, parentID int64, version string, childPIDs []string, computingID string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	parent, err := getMoveNode(tx, parentID)
+	if err != nil {
+		return refuseChange(http.StatusNotFound, "node %d not found", parentID)
+	}
+	err = checkVersion(tx, parentID, version)
+	if err != nil {
+		return err
+	}
+	children, err := getChildren(tx, parentID)
+	if err != nil {
+		return err
+	}
+	order, oldOrder, err := containerOrder(parent, children, childPIDs)
+	if err != nil {
+		return err
+	}
+	err = resequenceChildren(tx, children, order)
+	if err != nil {
+		return err
+	}
+	newOrder := strings.Join(childPIDs, ",")
+	if newOrder != strings.Join(oldOrder, ",") {
+		err = logAudit(tx, auditRecord(computingID, "reorder", parent, nodeTypeName(tx, db.Log, parent.ID),
+			"children", strings.Join(oldOrder, ","), newOrder))
+		if err != nil {
+			return fmt.Errorf("unable to audit reorder of %s: %s", parent.PID, err.Error())
+		}
+	}
+	return tx.Commit()
+}
+
+// containerOrder checks that a requested order of child PIDs lists exactly the current child containers
+// of the parent and returns their IDs in that order, along with the PIDs in their current order
+func containerOrder(parent *moveNode, children []moveNode, childPIDs []string) ([]int64, []string, error) {
+	containers := make(map[string]int64)
+	oldOrder := make([]string, 0)
+	for _, child := range children {
+		if child.Container {
+			containers[child.PID] = child.ID
+			oldOrder = append(oldOrder, child.PID)
+		}
+	}
+	if len(childPIDs) != len(containers) {
+		return nil, nil, refuseChange(http.StatusBadRequest, "%s has %d child containers but %d were specified",
+			parent.PID, len(containers), len(childPIDs))
+	}
+	order := make([]int64, 0, len(childPIDs))
+	for _, pid := range childPIDs {
+		id, ok := containers[pid]
+		if !ok {
+			return nil, nil, refuseChange(http.StatusBadRequest, "%s is not a child container of %s", pid, parent.PID)
+		}
+		delete(containers, pid)
+		order = append(order, id)
+	}
+	return order, oldOrder, nil
+}
+
+// getMoveNode gets the details of a node needed for a move and locks it for the rest of the transaction
+func getMoveNode(tx *sqlx.Tx, nodeID int64) (*moveNode, error) {
+	var n moveNode
+	qs := `SELECT n.id, n.pid, n.parent_id, n.ancestry, n.sequence, nt.container FROM nodes n
+		INNER JOIN node_types nt ON nt.id = n.node_type_id
+		WHERE n.id=? and n.deleted=0 and n.current=1 FOR UPDATE`
+	err := tx.Get(&n, qs, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// getChildren returns all current children of a node in sequence order and locks them for the rest of the transaction
+func getChildren(tx *sqlx.Tx, parentID int64) ([]moveNode, error) {
+	children := make([]moveNode, 0)
+	qs := `SELECT n.id, n.pid, n.parent_id, n.ancestry, n.sequence, nt.container FROM nodes n
+		INNER JOIN node_types nt ON nt.id = n.node_type_id
+		WHERE n.parent_id=? and n.deleted=0 and n.current=1
+		ORDER BY n.sequence ASC, n.id ASC FOR UPDATE`
+	err := tx.Select(&children, qs, parentID)
+	return children, err
+}
+
+// moveSubtree moves a node under a new parent and rewrites the ancestry of all descendants.
+// The old and new siblings are renumbered. A move that is not allowed returns a changeError.
+func moveSubtree(tx *sqlx.Tx, nodeID int64, newParentID int64, position *int) error {
+	node, err := getMoveNode(tx, nodeID)
+	if err != nil {
+		return refuseChange(http.StatusNotFound, "node %d not found", nodeID)
+	}
+	newParent, err := getMoveNode(tx, newParentID)
+	if err != nil {
+		return refuseChange(http.StatusNotFound, "node %d not found", newParentID)
+	}
+	err = checkMove(node, newParent)
+	if err != nil {
+		return err
+	}
+	oldPrefix := node.childAncestry()
+	oldParentID := node.ParentID.Int64
+
+	// Move the node itself, then rewrite the ancestry of every descendant (including
+	// non-current revisions) by swapping the old ancestry prefix for the new one
+	_, err = tx.Exec("UPDATE nodes SET parent_id=?, ancestry=?, updated_at=NOW(6) WHERE id=?",
+		newParent.ID, newParent.childAncestry(), node.ID)
+	if err != nil {
+		return err
+	}
+	node.Ancestry = sql.NullString{String: newParent.childAncestry(), Valid: true}
+	newPrefix := node.childAncestry()
+	_, err = tx.Exec(`UPDATE nodes SET ancestry=CONCAT(?, SUBSTRING(ancestry, ?))
+		WHERE ancestry=? or ancestry LIKE ?`,
+		newPrefix, len(oldPrefix)+1, oldPrefix, oldPrefix+"/%")
+	if err != nil {
+		return err
+	}
+
+	// close the gap left in the old siblings
+	if oldParentID != newParent.ID {
+		oldSiblings, childErr := getChildren(tx, oldParentID)
+		if childErr != nil {
+			return childErr
+		}
+		childErr = resequenceChildren(tx, oldSiblings, nil)
+		if childErr != nil {
+			return childErr
+		}
+	}
+
+	siblings, err := getChildren(tx, newParent.ID)
+	if err != nil {
+		return err
+	}
+	siblings, order := placeChild(siblings, node, position)
+	return resequenceChildren(tx, siblings, order)
+}
+
+// checkMove returns a changeError if a node can't be moved under the new parent
+func checkMove(node *moveNode, newParent *moveNode) error {
+	if node.ParentID.Valid == false {
+		return refuseChange(http.StatusBadRequest, "%s is a collection and cannot be moved", node.PID)
+	}
+	if newParent.Container == false {
+		return refuseChange(http.StatusBadRequest, "%s is not a container", newParent.PID)
+	}
+	if ancestryRootID(newParent.ID, newParent.Ancestry.String) != ancestryRootID(node.ID, node.Ancestry.String) {
+		return refuseChange(http.StatusBadRequest, "%s is not in the same collection as %s", newParent.PID, node.PID)
+	}
+	if newParent.ID == node.ID || strings.HasPrefix(newParent.Ancestry.String+"/", node.childAncestry()+"/") {
+		return refuseChange(http.StatusBadRequest, "%s cannot be moved into itself", node.PID)
+	}
+	return nil
+}
+
+// placeChild puts a node that was just moved in the requested position among its new siblings.
+// With no position, it goes at the end. Attributes are not part of the container order and always
+// go at the end. It returns the siblings in sequence order and the new order of the containers.
+func placeChild(siblings []moveNode, node *moveNode, position *int) ([]moveNode, []int64) {
+	for idx := range siblings {
+		if siblings[idx].ID == node.ID {
+			siblings[idx].Sequence = len(siblings)
+		}
+	}
+	sort.SliceStable(siblings, func(i, j int) bool {
+		return siblings[i].Sequence < siblings[j].Sequence
+	})
+	order := make([]int64, 0, len(siblings))
+	for _, s := range siblings {
+		if s.Container && s.ID != node.ID {
+			order = append(order, s.ID)
+		}
+	}
+	if node.Container {
+		pos := len(order)
+		if position != nil && *position >= 0 && *position < pos {
+			pos = *position
+		}
+		order = append(order[:pos], append([]int64{node.ID}, order[pos:]...)...)
+	}
+	return siblings, order
+}
+
+// sequenceOrder returns the IDs of a list of siblings in their new order. If a container order
+// is specified, the child containers are placed in that order in the slots currently held by
+// containers. Attributes keep their positions.
+func sequenceOrder(children []moveNode, containerOrder []int64) []int64 {
+	ordered := make([]int64, 0, len(children))
+	nextContainer := 0
+	for _, child := range children {
+		if child.Container && containerOrder != nil {
+			ordered = append(ordered, containerOrder[nextContainer])
+			nextContainer++
+		} else {
+			ordered = append(ordered, child.ID)
+		}
+	}
+	return ordered
+}
+
+// resequenceChildren renumbers the sequence of a list of siblings from 0 with no gaps, in the order
+// from sequenceOrder. Only nodes with a changed sequence are updated.
+func resequenceChildren(tx *sqlx.Tx, children []moveNode, containerOrder []int64) error {
+	current := make(map[int64]int)
+	for _, child := range children {
+		current[child.ID] = child.Sequence
+	}
+	for seq, id := range sequenceOrder(children, containerOrder) {
+		if current[id] == seq {
+			continue
+		}
+		_, err := tx.Exec("UPDATE nodes SET sequence=?, updated_at=NOW(6) WHERE id=?", seq, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
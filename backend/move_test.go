@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// getChildPage returns the child container page of a node from the API
+func getChildPage(t *testing.T, router http.Handler, pid string) ChildPage {
+	t.Helper()
+	var page ChildPage
+	checkJSON(t, doRequest(router, "GET", "/api/nodes/"+pid+"/children", "", ""), http.StatusOK, &page)
+	return page
+}
+
+func childPIDs(page ChildPage) []string {
+	out := make([]string, 0, len(page.Children))
+	for _, child := range page.Children {
+		out = append(out, child.PID)
+	}
+	return out
+}
+
+func TestMoveNode(t *testing.T) {
+	router := newTestRouter(t)
+	version := currentVersion(t, router, "uva-an12")
+	parentVersion := getChildPage(t, router, "uva-an20").Version
+
+	// a stale node version is rejected and nothing moves
+	body := fmt.Sprintf(`{"parent":"uva-an20","version":"stale","parentVersion":"%s"}`, parentVersion)
+	resp := doRequest(router, "POST", "/api/nodes/uva-an12/move", body, "user1")
+	if resp.Code != http.StatusConflict {
+		t.Fatalf("stale move returned %d, expected %d: %s", resp.Code, http.StatusConflict, resp.Body.String())
+	}
+	body = fmt.Sprintf(`{"parent":"uva-an20","version":"%s"}`, version)
+	resp = doRequest(router, "POST", "/api/nodes/uva-an12/move", body, "user1")
+	if resp.Code != http.StatusPreconditionRequired {
+		t.Fatalf("move without a parent version returned %d, expected %d", resp.Code, http.StatusPreconditionRequired)
+	}
+
+	body = fmt.Sprintf(`{"parent":"uva-an20","position":0,"version":"%s","parentVersion":"%s"}`, version, parentVersion)
+	resp = doRequest(router, "POST", "/api/nodes/uva-an12/move", body, "user1")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("move returned %d: %s", resp.Code, resp.Body.String())
+	}
+	if got := childPIDs(getChildPage(t, router, "uva-an20")); !reflect.DeepEqual(got, []string{"uva-an12", "uva-an23"}) {
+		t.Errorf("vol 2 has children %v after the move", got)
+	}
+	if got := childPIDs(getChildPage(t, router, "uva-an9")); !reflect.DeepEqual(got, []string{"uva-an16"}) {
+		t.Errorf("vol 1 has children %v after the move", got)
+	}
+
+	// the parent version changed with the move, so a second move with the old one is rejected
+	body = fmt.Sprintf(`{"parent":"uva-an20","version":"%s","parentVersion":"%s"}`, currentVersion(t, router, "uva-an16"), parentVersion)
+	resp = doRequest(router, "POST", "/api/nodes/uva-an16/move", body, "user1")
+	if resp.Code != http.StatusConflict {
+		t.Errorf("move into a stale parent returned %d, expected %d", resp.Code, http.StatusConflict)
+	}
+}
+
+func TestReorderChildren(t *testing.T) {
+	router := newTestRouter(t)
+	page := getChildPage(t, router, "uva-an9")
+	if got := childPIDs(page); !reflect.DeepEqual(got, []string{"uva-an12", "uva-an16"}) {
+		t.Fatalf("vol 1 starts with children %v", got)
+	}
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"children":["uva-an16","uva-an12"]}`, http.StatusPreconditionRequired},
+		{`{"children":["uva-an16","uva-an12"],"version":"stale"}`, http.StatusConflict},
+		{fmt.Sprintf(`{"children":["uva-an16"],"version":"%s"}`, page.Version), http.StatusBadRequest},
+		{fmt.Sprintf(`{"children":["uva-an16","uva-an12"],"version":"%s"}`, page.Version), http.StatusOK},
+		// the version changed with the reorder
+		{fmt.Sprintf(`{"children":["uva-an12","uva-an16"],"version":"%s"}`, page.Version), http.StatusConflict},
+	}
+	for _, tc := range tests {
+		resp := doRequest(router, "POST", "/api/nodes/uva-an9/reorder", tc.body, "user1")
+		if resp.Code != tc.status {
+			t.Errorf("reorder %s returned %d, expected %d: %s", tc.body, resp.Code, tc.status, resp.Body.String())
+		}
+	}
+
+	after := getChildPage(t, router, "uva-an9")
+	if got := childPIDs(after); !reflect.DeepEqual(got, []string{"uva-an16", "uva-an12"}) {
+		t.Errorf("vol 1 has children %v after the reorder", got)
+	}
+	if after.Version == page.Version {
+		t.Errorf("vol 1 version did not change with the reorder")
+	}
+}
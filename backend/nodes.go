@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"sort"
 	"strconv"
@@ -13,6 +12,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
 )
 
 // nodeSelect is the bas query used to get a variety of node dat from the DB
@@ -21,42 +21,236 @@ const nodeSelect = `SELECT n.id, n.parent_id, n.ancestry, n.sequence, n.pid, n.v
  FROM nodes n
  INNER JOIN node_types nt ON nt.id = n.node_type_id`
 
+// nodeUpdate is a request to set the title and description of a node. Identifiers maps identifier
+// types to new values for the identifiers the node already has; others are left unchanged.
+type nodeUpdate struct {
+	NodeID             int64
+	Version            string
+	Title              string
+	Description        string
+	Identifiers        map[string]string
+	User               string
+	RejectDuplicateIDs bool
+}
+
+// identifierTypes returns the identifier types in the update in name order, so they are always
+// checked and written in the same order
+func (u *nodeUpdate) identifierTypes() []string {
+	out := make([]string, 0, len(u.Identifiers))
+	for typeName := range u.Identifiers {
+		out = append(out, typeName)
+	}
+	sort.Strings(out)
+	return out
+}
+
 func (app *Apollo) updateNode(c *gin.Context) {
 	nodeID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
 	if nodeID == 0 {
-		log.Printf("ERROR: invalid node id %s in update request", c.Param("id"))
+		requestLog(c).Printf("ERROR: invalid node id %s in update request", c.Param("id"))
 		c.String(http.StatusBadRequest, fmt.Sprintf("%s is not a vailid node id", c.Param("id")))
 		return
 	}
 
 	var req struct {
-		Title       string `json:"title"`
-		Description string `json:"description"`
+		Title       string            `json:"title"`
+		Description string            `json:"description"`
+		Identifiers map[string]string `json:"identifiers"`
+		Version     string            `json:"version"`
 	}
 	err := c.BindJSON(&req)
 	if err != nil {
-		log.Printf("ERROR: invalid update node update request: %s", err.Error())
+		requestLog(c).Printf("ERROR: invalid update node update request: %s", err.Error())
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
+	for typeName, value := range req.Identifiers {
+		if isIdentifierType(typeName) == false {
+			c.String(http.StatusBadRequest, fmt.Sprintf("%s is not an identifier type", typeName))
+			return
+		}
+		if strings.TrimSpace(value) == "" {
+			c.String(http.StatusBadRequest, fmt.Sprintf("%s can't be blank", typeName))
+			return
+		}
+		req.Identifiers[typeName] = strings.TrimSpace(value)
+	}
 
-	// update title
-	_, err = app.DB.Exec("update nodes set value=? where parent_id=? and node_type_id=?", req.Title, nodeID, 2)
+	version := requestVersion(c, req.Version)
+	if versionMissing(c, version) {
+		return
+	}
+	version, err = app.repo(c).UpdateNode(&nodeUpdate{NodeID: nodeID, Version: version, Title: req.Title,
+		Description: req.Description, Identifiers: req.Identifiers, User: c.GetString("computingID"),
+		RejectDuplicateIDs: app.RejectDuplicateIDs})
 	if err != nil {
-		log.Printf("ERROR: update title for parent %d failed: %s", nodeID, err.Error())
-		c.String(http.StatusBadRequest, err.Error())
+		app.changeFailed(c, err, 0)
 		return
 	}
+	c.Header("ETag", fmt.Sprintf("\"%s\"", version))
+	c.String(http.StatusOK, "updated")
+}
 
-	// update description
-	_, err = app.DB.Exec("update nodes set value=? where parent_id=? and node_type_id=?", req.Description, nodeID, 12)
+// updateNodeAttributes sets the title, description and identifiers of a node and returns its new
+// version. Identifier values are checked for duplicates in the transaction that writes them.
+func updateNodeAttributes(db *DB, update *nodeUpdate) (string, error) {
+	tx, err := db.Beginx()
 	if err != nil {
-		log.Printf("ERROR: update description for parent %d failed: %s", nodeID, err.Error())
-		c.String(http.StatusBadRequest, err.Error())
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = getMoveNode(tx, update.NodeID)
+	if err != nil {
+		return "", refuseChange(http.StatusNotFound, "node %d not found", update.NodeID)
+	}
+	err = checkVersion(tx, update.NodeID, update.Version)
+	if err != nil {
+		return "", err
+	}
+	err = updateAttribute(tx, update.NodeID, 2, "title", update.Title, update.User)
+	if err != nil {
+		return "", fmt.Errorf("update title for parent %d failed: %s", update.NodeID, err.Error())
+	}
+	err = updateAttribute(tx, update.NodeID, 12, "description", update.Description, update.User)
+	if err != nil {
+		return "", fmt.Errorf("update description for parent %d failed: %s", update.NodeID, err.Error())
+	}
+	for _, typeName := range update.identifierTypes() {
+		value := update.Identifiers[typeName]
+		matches, err := findIdentifier(tx, typeName, value, update.NodeID)
+		if err != nil {
+			return "", fmt.Errorf("unable to check %s %s: %s", typeName, value, err.Error())
+		}
+		if identifierCheck(db.Log, update.RejectDuplicateIDs, typeName, value, matches).Allowed == false {
+			return "", refuseChange(http.StatusConflict, "%s %s is already used by another item", typeName, value)
+		}
+		var typeID int64
+		err = tx.Get(&typeID, "SELECT id FROM node_types WHERE name=?", typeName)
+		if err != nil {
+			return "", fmt.Errorf("unable to get %s type: %s", typeName, err.Error())
+		}
+		err = updateAttribute(tx, update.NodeID, typeID, typeName, value, update.User)
+		if err != nil {
+			return "", fmt.Errorf("update %s for parent %d failed: %s", typeName, update.NodeID, err.Error())
+		}
+	}
+	version, err := nodeVersion(tx, update.NodeID)
+	if err != nil {
+		return "", err
+	}
+	return version, tx.Commit()
+}
+
+// updateAttribute sets the value of the attributes of one type belonging to a parent node.
+// Each attribute that actually changes is recorded in the audit log.
+func updateAttribute(tx *sqlx.Tx, parentID int64, typeID int64, typeName string, value string, computingID string) error {
+	var attrs []struct {
+		moveNode
+		Value string `db:"value"`
+	}
+	err := tx.Select(&attrs, `SELECT id, pid, parent_id, ancestry, sequence, value FROM nodes
+		WHERE parent_id=? and node_type_id=? and deleted=0 and current=1 and value<>? FOR UPDATE`,
+		parentID, typeID, value)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		_, err = tx.Exec("UPDATE nodes SET value=?, updated_at=NOW(6) WHERE id=?", value, attr.ID)
+		if err != nil {
+			return err
+		}
+		err = logAudit(tx, auditRecord(computingID, "update", &attr.moveNode, typeName, "value", attr.Value, value))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summarySelect is the base query used to get a ContainerSummary for container nodes
+const summarySelect = `SELECT n.id, n.pid, n.sequence, nt.name as type,
+ COALESCE((SELECT t.value FROM nodes t
+   WHERE t.parent_id=n.id and t.node_type_id=2 and t.deleted=0 and t.current=1
+   ORDER BY t.sequence ASC LIMIT 1), '') as title,
+ (SELECT count(*) FROM nodes cn INNER JOIN node_types cnt ON cnt.id = cn.node_type_id
+   WHERE cn.parent_id=n.id and cnt.container=1 and cn.deleted=0 and cn.current=1) as child_count
+ FROM nodes n
+ INNER JOIN node_types nt ON nt.id = n.node_type_id`
+
+// ContainerSummary is brief information about a container node; enough to list it or link to it
+type ContainerSummary struct {
+	ID         int64  `db:"id" json:"id"`
+	PID        string `db:"pid" json:"pid"`
+	Sequence   int    `db:"sequence" json:"sequence"`
+	Type       string `db:"type" json:"type"`
+	Title      string `db:"title" json:"title"`
+	ChildCount int    `db:"child_count" json:"childCount"`
+}
+
+// ChildPage is one page of the child containers of a node. Version is the version of the node;
+// it is needed to reorder the children.
+type ChildPage struct {
+	PID      string             `json:"pid"`
+	Version  string             `json:"version"`
+	Total    int                `json:"total"`
+	Offset   int                `json:"offset"`
+	Limit    int                `json:"limit"`
+	Children []ContainerSummary `json:"children"`
+}
+
+// GetNodeChildren returns a page of the child containers of a node in sequence order.
+// Paging is controlled with the offset and limit query params.
+func (app *Apollo) GetNodeChildren(c *gin.Context) {
+	pid := c.Param("id")
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	nodeIDs, dbErr := app.repo(c).LookupIdentifier(pid)
+	if dbErr != nil {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
 		return
 	}
 
-	c.String(http.StatusOK, "updated")
+	requestLog(c).Printf("INFO: get children of %s; offset %d, limit %d", nodeIDs.PID, offset, limit)
+	version, err := app.repo(c).NodeVersion(nodeIDs.ID)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to get version of %s: %s", nodeIDs.PID, err.Error())
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+	out := ChildPage{PID: nodeIDs.PID, Version: version, Offset: offset, Limit: limit}
+	out.Total, out.Children, err = app.repo(c).GetChildSummaries(nodeIDs.ID, offset, limit)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to get children of %s: %s", nodeIDs.PID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// getChildSummaries returns the total number of child containers of a node and one page of them in sequence order
+func getChildSummaries(db *DB, parentID int64, offset int, limit int) (int, []ContainerSummary, error) {
+	total := 0
+	cq := `SELECT count(*) FROM nodes n INNER JOIN node_types nt ON nt.id = n.node_type_id
+		WHERE n.parent_id=? and nt.container=1 and n.deleted=0 and n.current=1`
+	err := db.Get(&total, cq, parentID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	children := make([]ContainerSummary, 0)
+	qs := fmt.Sprintf(`%s WHERE n.parent_id=? and nt.container=1 and n.deleted=0 and n.current=1
+		ORDER BY n.sequence ASC, n.id ASC LIMIT ? OFFSET ?`, summarySelect)
+	err = db.Select(&children, qs, parentID, limit, offset)
+	return total, children, err
 }
 
 // GetItemDetails will return a block of JSON metadata for the specified ITEM PID. This includes
@@ -64,22 +258,48 @@ func (app *Apollo) updateNode(c *gin.Context) {
 // belongs to.
 func (app *Apollo) GetItemDetails(c *gin.Context) {
 	pid := c.Param("pid")
-	itemIDs, dbErr := lookupIdentifier(&app.DB, pid)
+	itemIDs, dbErr := app.repo(c).LookupIdentifier(pid)
 	if dbErr != nil {
-		log.Printf("ERROR: %s", dbErr.Error())
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
 		c.String(http.StatusNotFound, dbErr.Error())
 		return
 	}
 
-	item, dbErr := getNode(&app.DB, itemIDs.ID)
+	depth, err := parseDepth(c)
+	if err != nil {
+		requestLog(c).Printf("ERROR: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var item *Node
+	if depth >= 0 {
+		item, dbErr = app.repo(c).GetSubtree(itemIDs.ID, depth)
+	} else {
+		item, dbErr = app.repo(c).GetNode(itemIDs.ID)
+	}
 	if dbErr != nil {
-		log.Printf("ERROR: %s", dbErr.Error())
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
 		c.String(http.StatusNotFound, dbErr.Error())
 		return
 	}
 
+	// The item version only covers the item and its immediate children, so it is
+	// only a valid ETag when the default item details are requested
+	if depth < 0 {
+		version, err := app.repo(c).NodeVersion(item.ID)
+		if err != nil {
+			requestLog(c).Printf("ERROR: unable to get version of %s: %s", item.PID, err.Error())
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		if setETag(c, version) {
+			return
+		}
+	}
+
 	// note: if above was successful, this will be as well
-	parent, _ := getNodeCollection(&app.DB, item)
+	parent, _ := app.repo(c).GetNodeCollection(item)
 
 	jsonItem, _ := json.MarshalIndent(item, "", "  ")
 	jsonParent, _ := json.MarshalIndent(parent, "", "  ")
@@ -88,6 +308,44 @@ func (app *Apollo) GetItemDetails(c *gin.Context) {
 	c.String(http.StatusOK, out)
 }
 
+// maxDepth is the largest depth param accepted. Collections are only a few levels deep, and the
+// depth becomes a regex repetition count, which MySQL limits.
+const maxDepth = 50
+
+// parseDepth reads the optional depth query param. A negative result means no depth was
+// requested and the full tree should be returned.
+func parseDepth(c *gin.Context) (int, error) {
+	depthStr := c.Query("depth")
+	if depthStr == "" {
+		return -1, nil
+	}
+	depth, err := strconv.Atoi(depthStr)
+	if err != nil || depth < 0 {
+		return 0, fmt.Errorf("%s is not a valid depth", depthStr)
+	}
+	if depth > maxDepth {
+		return 0, fmt.Errorf("depth %d is more than the limit of %d", depth, maxDepth)
+	}
+	return depth, nil
+}
+
+// lookupCollectionNode finds a node by any known identifier and ensures that it is part of the specified collection
+func lookupCollectionNode(db *DB, collectionID int64, identifier string) (*NodeIdentifier, error) {
+	nodeID, err := lookupIdentifier(db, identifier)
+	if err != nil {
+		return nil, err
+	}
+	var ancestry sql.NullString
+	err = db.Get(&ancestry, "select ancestry from nodes where id=?", nodeID.ID)
+	if err != nil {
+		return nil, err
+	}
+	if ancestryRootID(nodeID.ID, ancestry.String) != collectionID {
+		return nil, fmt.Errorf("%s is not part of collection %d", identifier, collectionID)
+	}
+	return nodeID, nil
+}
+
 // getNode returns the node specified by nodeID and all of its immediate children
 func getNode(db *DB, nodeID int64) (*Node, error) {
 	// Get all children with the above nodeID PID as the end of their ancestry
@@ -102,7 +360,7 @@ func getNode(db *DB, nodeID int64) (*Node, error) {
 func getTree(db *DB, rootID int64) (*Node, error) {
 	// Get all children with the root ID as the start of their ancestry -- OR
 	// any nodes that contain the ID as part of their ancestry (this is necessary for subtrees)
-	log.Printf("INFO: get tree rooted at ID %d", rootID)
+	db.Log.Printf("INFO: get tree rooted at ID %d", rootID)
 	qs := fmt.Sprintf(`
 		%s WHERE deleted=0 and current=1 AND (n.id=? or ancestry REGEXP '(^.+/|^)%d($|/.+)')
 		ORDER BY n.id ASC`,
@@ -110,9 +368,51 @@ func getTree(db *DB, rootID int64) (*Node, error) {
 	return queryNodes(db, qs, rootID)
 }
 
+// getSubtree returns the node tree rooted at the specified node ID, limited to depth levels of
+// child containers. Every container includes its own attributes. Containers at the depth limit
+// do not include their child containers; instead they report how many there are in ChildCount.
+func getSubtree(db *DB, rootID int64, depth int) (*Node, error) {
+	// Containers at the depth limit are one level above the attributes of the deepest
+	// containers, so grab nodes up to depth+1 levels below the root. Container nodes at that
+	// last level are only needed to count the children and will be pruned.
+	db.Log.Printf("INFO: get tree rooted at ID %d with depth %d", rootID, depth)
+	qs := fmt.Sprintf(`
+		%s WHERE deleted=0 and current=1 AND (n.id=? or ancestry REGEXP '(^.+/|^)%d(/[0-9]+){0,%d}$')
+		ORDER BY n.id ASC`,
+		nodeSelect, rootID, depth)
+	root, err := queryNodes(db, qs, rootID)
+	if err != nil {
+		return nil, err
+	}
+	pruneTree(root, depth)
+	return root, nil
+}
+
+// pruneTree removes child containers below the specified depth and replaces them with a count
+func pruneTree(node *Node, depth int) {
+	if depth > 0 {
+		for _, child := range node.Children {
+			if child.Type.Container {
+				pruneTree(child, depth-1)
+			}
+		}
+		return
+	}
+
+	attributes := make([]*Node, 0, len(node.Children))
+	for _, child := range node.Children {
+		if child.Type.Container {
+			node.ChildCount++
+		} else {
+			attributes = append(attributes, child)
+		}
+	}
+	node.Children = attributes
+}
+
 // getNodeCollection returns details about the collection that contains the source node
 func getNodeCollection(db *DB, node *Node) (*Node, error) {
-	log.Printf("INFO: get Parent for %s with ancestry [%s]", node.PID, node.Ancestry.String)
+	db.Log.Printf("INFO: get Parent for %s with ancestry [%s]", node.PID, node.Ancestry.String)
 
 	// Get the ancestry string. If there is none, this node is the collection
 	ancestry := node.Ancestry.String
@@ -122,7 +422,7 @@ func getNodeCollection(db *DB, node *Node) (*Node, error) {
 
 	// The collection node is the one with  ID matching the first ancestry substring
 	rootID, _ := strconv.ParseInt(strings.Split(ancestry, "/")[0], 10, 64)
-	log.Printf("INFO: ancestry rootID: %d", rootID)
+	db.Log.Printf("INFO: ancestry rootID: %d", rootID)
 
 	// Dont want deleted or non-current nodes. Non-root nodes without values are the start of
 	// child containers of the collection; skip them. Only take the parent node itself (id match)
@@ -133,14 +433,14 @@ func getNodeCollection(db *DB, node *Node) (*Node, error) {
 }
 
 func queryNodes(db *DB, query string, rootID int64) (*Node, error) {
-	// log.Printf("DEBUG: %s, %d", query, rootID)
+	// db.Log.Printf("DEBUG: %s, %d", query, rootID)
 	nodes := make(map[int64]*Node)
 	nodeParents := make(map[int64]int64)
 	var root *Node
 	controlledValues := make(map[int64]*ControlledValue)
 	rows, err := db.Query(query, rootID)
 	if err != nil {
-		log.Printf("ERROR: unable to retrieve nodes: %s", err.Error())
+		db.Log.Printf("ERROR: unable to retrieve nodes: %s", err.Error())
 		return nil, err
 	}
 	defer rows.Close()
@@ -169,7 +469,7 @@ func queryNodes(db *DB, query string, rootID int64) (*Node, error) {
 			} else {
 				cv, err := getControlledValueByID(db, id)
 				if err != nil {
-					log.Printf("ERROR: no controlled value match for %d: %s", id, err.Error())
+					db.Log.Printf("ERROR: no controlled value match for %d: %s", id, err.Error())
 				} else {
 					n.Value = cv.Value
 					n.ValueURI = cv.ValueURI.String
@@ -199,11 +499,14 @@ func queryNodes(db *DB, query string, rootID int64) (*Node, error) {
 				node.Parent = parent
 			} else {
 				msg := fmt.Sprintf("Unable to to find parentID %d for node %d", parentID, node.ID)
-				log.Printf("ERROR: %s", msg)
+				db.Log.Printf("ERROR: %s", msg)
 				return nil, errors.New(msg)
 			}
 		}
 	}
+	if root == nil {
+		return nil, fmt.Errorf("node %d not found", rootID)
+	}
 	sortNodes(root)
 
 	return root, nil
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestChildPaging(t *testing.T) {
+	router := newTestRouter(t)
+	tests := []struct {
+		query    string
+		offset   int
+		limit    int
+		children []string
+	}{
+		{"", 0, 50, []string{"uva-an9", "uva-an20"}},
+		{"?limit=1", 0, 1, []string{"uva-an9"}},
+		{"?limit=1&offset=1", 1, 1, []string{"uva-an20"}},
+		{"?offset=2", 2, 50, []string{}},
+		// out of range params fall back to the defaults
+		{"?limit=1000&offset=-1", 0, 50, []string{"uva-an9", "uva-an20"}},
+	}
+	for _, tc := range tests {
+		var page ChildPage
+		checkJSON(t, doRequest(router, "GET", "/api/nodes/uva-an1/children"+tc.query, "", ""), http.StatusOK, &page)
+		if page.Total != 2 || page.Offset != tc.offset || page.Limit != tc.limit || reflect.DeepEqual(childPIDs(page), tc.children) == false {
+			t.Errorf("children%s are %v with total %d, offset %d, limit %d", tc.query, childPIDs(page), page.Total, page.Offset, page.Limit)
+		}
+	}
+
+	// an issue has only attributes and digital objects, which are not containers
+	page := getChildPage(t, router, "uva-an12")
+	if page.Total != 0 || len(page.Children) != 0 {
+		t.Errorf("children of uva-an12 are %v", childPIDs(page))
+	}
+	if resp := doRequest(router, "GET", "/api/nodes/uva-an99999/children", "", ""); resp.Code != http.StatusNotFound {
+		t.Errorf("children of an unknown node returned %d, expected %d", resp.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// publicationTargets are the systems that Apollo records can be published to
+var publicationTargets = []string{"dpla", "virgo", "archivesspace"}
+
+// Publication records a single publication of an item or collection to a target
+type Publication struct {
+	ID          int64     `db:"id" json:"id"`
+	NodeID      int64     `db:"node_id" json:"-"`
+	PID         string    `db:"pid" json:"pid"`
+	Target      string    `db:"target" json:"target"`
+	ComputingID string    `db:"computing_id" json:"user"`
+	RecordHash  string    `db:"record_hash" json:"hash"`
+	PublishedAt time.Time `db:"published_at" json:"publishedAt"`
+}
+
+// PublicationResults lists all of the records published together by one request
+type PublicationResults struct {
+	Target       string        `json:"target"`
+	PublishedAt  time.Time     `json:"publishedAt"`
+	Total        int           `json:"total"`
+	Publications []Publication `json:"publications"`
+}
+
+// ChangedItem is a published node that has changed since its last publication to a target
+type ChangedItem struct {
+	ID          int64          `db:"id" json:"-"`
+	PID         string         `db:"pid" json:"pid"`
+	Ancestry    sql.NullString `db:"ancestry" json:"-"`
+	Deleted     bool           `db:"deleted" json:"deleted"`
+	PublishedAt time.Time      `db:"published_at" json:"publishedAt"`
+	PublishedBy string         `db:"computing_id" json:"publishedBy"`
+	RecordHash  string         `db:"record_hash" json:"hash"`
+	ChangedAt   time.Time      `db:"-" json:"changedAt"`
+}
+
+// PublishNode marks a node as published to a target. Request json: {"target": "dpla"}.
+// When the node is a collection or other container, every item in it is marked as well.
+// Each record is stored with a hash of its export to the target so later changes can be detected.
+// Only nodes in the configured DPLA collections can be published to the DPLA.
+func (app *Apollo) PublishNode(c *gin.Context) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		requestLog(c).Printf("ERROR: invalid publish request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	target, ok := publicationTarget(req.Target)
+	if !ok {
+		requestLog(c).Printf("ERROR: publish requested for unknown target %s", req.Target)
+		c.String(http.StatusBadRequest, fmt.Sprintf("target must be one of %s", strings.Join(publicationTargets, ", ")))
+		return
+	}
+
+	nodeIDs, dbErr := app.repo(c).LookupIdentifier(c.Param("id"))
+	if dbErr != nil {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
+		return
+	}
+	requestLog(c).Printf("INFO: %s requests publish of %s to %s", c.GetString("computingID"), nodeIDs.PID, target)
+	root, dbErr := app.repo(c).GetTree(nodeIDs.ID)
+	if dbErr != nil {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
+		return
+	}
+	if root.Type.Container == false {
+		c.String(http.StatusBadRequest, fmt.Sprintf("%s is not an item or collection", nodeIDs.PID))
+		return
+	}
+
+	if target == "dpla" {
+		coll, collErr := app.repo(c).GetNodeCollection(root)
+		if collErr != nil || app.isDPLACollection(coll.PID) == false {
+			c.String(http.StatusBadRequest, fmt.Sprintf("%s is not in a DPLA collection", nodeIDs.PID))
+			return
+		}
+	}
+
+	records := []*Node{root}
+	findPublishedItems(root, &records)
+	out := PublicationResults{Target: target, Publications: make([]Publication, 0, len(records))}
+	for _, node := range records {
+		hash, hashErr := app.recordHash(requestLog(c), node, target)
+		if hashErr != nil {
+			requestLog(c).Printf("ERROR: unable to export %s: %s", node.PID, hashErr.Error())
+			c.String(http.StatusInternalServerError, hashErr.Error())
+			return
+		}
+		out.Publications = append(out.Publications, Publication{NodeID: node.ID, PID: node.PID, Target: target,
+			ComputingID: c.GetString("computingID"), RecordHash: hash})
+	}
+	out.Total = len(out.Publications)
+
+	err = app.repo(c).Publish(&out, ancestryRootID(root.ID, root.Ancestry.String), WebhookEvent{Event: "published",
+		PID: root.PID, NodeType: root.Type.Name, User: c.GetString("computingID"), Target: target,
+		Hash: out.Publications[0].RecordHash, Count: out.Total})
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to record publication of %s: %s", nodeIDs.PID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	requestLog(c).Printf("INFO: %d records under %s published to %s", out.Total, nodeIDs.PID, target)
+	c.JSON(http.StatusOK, out)
+}
+
+// GetPublications returns the publication history of a node, newest first.
+// Restrict it to a single target with the target query param.
+func (app *Apollo) GetPublications(c *gin.Context) {
+	// publications outlive the nodes they record, so the history of a purged node is found by its PID
+	pid := c.Param("id")
+	nodeIDs, dbErr := app.repo(c).LookupIdentifier(pid)
+	if dbErr == nil {
+		pid = nodeIDs.PID
+	}
+	target := ""
+	if c.Query("target") != "" {
+		var ok bool
+		target, ok = publicationTarget(c.Query("target"))
+		if !ok {
+			c.String(http.StatusBadRequest, fmt.Sprintf("target must be one of %s", strings.Join(publicationTargets, ", ")))
+			return
+		}
+	}
+
+	requestLog(c).Printf("INFO: get publications of %s", pid)
+	out, err := app.repo(c).GetPublications(pid, target)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to get publications of %s: %s", pid, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if dbErr != nil && len(out) == 0 {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// GetChangedSincePublished lists the items and containers in a collection that have changed since they
+// were last published to the target in the required target query param. A record has changed
+// if it or any of its descendants were updated, moved or deleted after the publication.
+func (app *Apollo) GetChangedSincePublished(c *gin.Context) {
+	target, ok := publicationTarget(c.Query("target"))
+	if !ok {
+		c.String(http.StatusBadRequest, fmt.Sprintf("target must be one of %s", strings.Join(publicationTargets, ", ")))
+		return
+	}
+	collIDs, dbErr := app.repo(c).LookupIdentifier(c.Param("pid"))
+	if dbErr != nil {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
+		return
+	}
+
+	requestLog(c).Printf("INFO: get records in %s changed since published to %s", collIDs.PID, target)
+	out, err := app.repo(c).GetChangedSincePublished(collIDs.ID, target)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to get changed records in %s: %s", collIDs.PID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	requestLog(c).Printf("INFO: %d records in %s changed since published to %s", len(out), collIDs.PID, target)
+	c.JSON(http.StatusOK, out)
+}
+
+// nodeChange is the time a node in a collection last changed
+type nodeChange struct {
+	ID        int64          `db:"id"`
+	Ancestry  sql.NullString `db:"ancestry"`
+	ChangedAt time.Time      `db:"changed_at"`
+}
+
+// publish records the publications with a shared timestamp, and queues the event for them
+func publish(db *DB, pubs *PublicationResults, collectionID int64, evt WebhookEvent) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.Get(&pubs.PublishedAt, "SELECT NOW(6)")
+	if err != nil {
+		return fmt.Errorf("unable to get publication time: %s", err.Error())
+	}
+	for idx := range pubs.Publications {
+		pub := &pubs.Publications[idx]
+		pub.PublishedAt = pubs.PublishedAt
+		res, insErr := tx.Exec(`INSERT INTO publications (node_id, pid, target, computing_id, record_hash, published_at)
+			VALUES (?, ?, ?, ?, ?, ?)`, pub.NodeID, pub.PID, pub.Target, pub.ComputingID, pub.RecordHash, pub.PublishedAt)
+		if insErr != nil {
+			return fmt.Errorf("unable to record publication of %s: %s", pub.PID, insErr.Error())
+		}
+		pub.ID, _ = res.LastInsertId()
+	}
+	evt.OccurredAt = pubs.PublishedAt
+	err = queueWebhookEvent(tx, collectionID, evt)
+	if err != nil {
+		return fmt.Errorf("unable to queue publication event for %s: %s", evt.PID, err.Error())
+	}
+	return tx.Commit()
+}
+
+// getPublications returns the publications of a PID to the target, or to all targets when it is blank
+func getPublications(db *DB, pid string, target string) ([]Publication, error) {
+	qs := `SELECT id, node_id, pid, target, computing_id, record_hash, published_at FROM publications WHERE pid=?`
+	args := []interface{}{pid}
+	if target != "" {
+		qs += " and target=?"
+		args = append(args, target)
+	}
+	out := make([]Publication, 0)
+	err := db.Select(&out, qs+" ORDER BY published_at DESC, id DESC", args...)
+	return out, err
+}
+
+// getChangedSincePublished finds the latest publication to the target of each record in a collection,
+// along with every node in the collection changed since the earliest of them
+func getChangedSincePublished(db *DB, collectionID int64, target string) ([]ChangedItem, error) {
+	collAncestry := fmt.Sprintf("%d", collectionID)
+	var published []ChangedItem
+	err := db.Select(&published, `SELECT n.id, n.pid, n.ancestry, n.deleted, p.published_at, p.computing_id, p.record_hash
+		FROM publications p
+		INNER JOIN (SELECT node_id, MAX(id) as id FROM publications WHERE target=? GROUP BY node_id) lp ON lp.id = p.id
+		INNER JOIN nodes n ON n.id = p.node_id
+		WHERE n.current=1 and (n.id=? or n.ancestry=? or n.ancestry LIKE ?)`,
+		target, collectionID, collAncestry, collAncestry+"/%")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get published records: %s", err.Error())
+	}
+	if len(published) == 0 {
+		return make([]ChangedItem, 0), nil
+	}
+
+	earliest := published[0].PublishedAt
+	for _, rec := range published {
+		if rec.PublishedAt.Before(earliest) {
+			earliest = rec.PublishedAt
+		}
+	}
+	var changed []nodeChange
+	err = db.Select(&changed, `SELECT id, ancestry, COALESCE(updated_at, created_at) as changed_at FROM nodes
+		WHERE (id=? or ancestry=? or ancestry LIKE ?)
+		  and (updated_at > ? or (updated_at IS NULL and created_at > ?))`,
+		collectionID, collAncestry, collAncestry+"/%", earliest, earliest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get changes: %s", err.Error())
+	}
+	return changedSincePublished(published, changed), nil
+}
+
+// changedSincePublished credits each change to the published records it is part of; the node itself
+// and its ancestors. It returns the records changed after their publication, most recent change first.
+func changedSincePublished(published []ChangedItem, changed []nodeChange) []ChangedItem {
+	records := make(map[int64]*ChangedItem)
+	for idx := range published {
+		records[published[idx].ID] = &published[idx]
+	}
+	for _, node := range changed {
+		ids := []int64{node.ID}
+		if node.Ancestry.String != "" {
+			for _, idStr := range strings.Split(node.Ancestry.String, "/") {
+				id, _ := strconv.ParseInt(idStr, 10, 64)
+				ids = append(ids, id)
+			}
+		}
+		for _, id := range ids {
+			if rec, ok := records[id]; ok && node.ChangedAt.After(rec.ChangedAt) {
+				rec.ChangedAt = node.ChangedAt
+			}
+		}
+	}
+	out := make([]ChangedItem, 0)
+	for _, rec := range published {
+		if rec.ChangedAt.After(rec.PublishedAt) {
+			out = append(out, rec)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].ChangedAt.Equal(out[j].ChangedAt) {
+			return out[i].ID < out[j].ID
+		}
+		return out[i].ChangedAt.After(out[j].ChangedAt)
+	})
+	return out
+}
+
+// publicationTarget normalizes a target name and reports if it is a known target
+func publicationTarget(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, tgt := range publicationTargets {
+		if tgt == name {
+			return tgt, true
+		}
+	}
+	return name, false
+}
+
+// findPublishedItems adds all descendant containers that are published items to the list.
+// Published items are those with an externalPID.
+func findPublishedItems(node *Node, items *[]*Node) {
+	for _, child := range node.Children {
+		if child.Type.Container == false {
+			continue
+		}
+		for _, attr := range child.Children {
+			if attr.Type.Name == "externalPID" && attr.Value != "" {
+				*items = append(*items, child)
+				break
+			}
+		}
+		findPublishedItems(child, items)
+	}
+}
+
+// recordHash returns the sha1 hash of a node as it is exported to the target
+func (app *Apollo) recordHash(logger *log.Logger, node *Node, target string) (string, error) {
+	data, err := app.recordExport(logger, node, target)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha1.Sum(data)), nil
+}
+
+// recordExport returns a node as it is sent to a publication target. DPLA gets the QDC of each item
+// and the list of DPLA PIDs for the containers holding them; Virgo gets the uvamap XML. There is
+// no ArchivesSpace export yet, so its records are the json of the node and its descendants.
+func (app *Apollo) recordExport(logger *log.Logger, node *Node, target string) ([]byte, error) {
+	switch target {
+	case "dpla":
+		data := app.qdcData(logger, node)
+		if data.PID == "" {
+			pids := list.New()
+			traverseTreeForDPLA(logger, pids, node)
+			return []byte(joinPIDs(pids)), nil
+		}
+		if data.Title == "" {
+			return nil, fmt.Errorf("%s has no title", node.PID)
+		}
+		return app.renderQDC(data)
+	case "virgo":
+		xml, err := generateXML(logger, node, "uvamap")
+		return []byte(xml), err
+	}
+	return json.Marshal(node)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// getChanged returns the PIDs of the records in a collection changed since they were published to the target
+func getChanged(t *testing.T, router http.Handler, pid string, target string) []string {
+	t.Helper()
+	var changed []ChangedItem
+	checkJSON(t, doRequest(router, "GET", fmt.Sprintf("/api/collections/%s/changed?target=%s", pid, target), "", ""),
+		http.StatusOK, &changed)
+	out := make([]string, 0, len(changed))
+	for _, rec := range changed {
+		out = append(out, rec.PID)
+	}
+	return out
+}
+
+func TestPublishErrors(t *testing.T) {
+	router := newTestRouter(t)
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"POST", "/api/nodes/uva-an109873/publish", `{"target":"nope"}`, http.StatusBadRequest},
+		{"POST", "/api/nodes/uva-an99999/publish", `{"target":"virgo"}`, http.StatusNotFound},
+		{"POST", "/api/nodes/uva-an2/publish", `{"target":"virgo"}`, http.StatusBadRequest},
+		{"POST", "/api/nodes/uva-an1/publish", `{"target":"dpla"}`, http.StatusBadRequest},
+		{"GET", "/api/nodes/uva-an1/publications?target=nope", "", http.StatusBadRequest},
+		{"GET", "/api/nodes/uva-an99999/publications", "", http.StatusNotFound},
+		{"GET", "/api/collections/uva-an1/changed", "", http.StatusBadRequest},
+		{"GET", "/api/collections/uva-an99999/changed?target=dpla", "", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		resp := doRequest(router, tc.method, tc.path, tc.body, "user1")
+		if resp.Code != tc.status {
+			t.Errorf("%s %s returned %d, expected %d: %s", tc.method, tc.path, resp.Code, tc.status, resp.Body.String())
+		}
+	}
+	if resp := doRequest(router, "POST", "/api/nodes/uva-an1/publish", `{"target":"virgo"}`, ""); resp.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous publish returned %d, expected %d", resp.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	router := newTestRouter(t)
+	var results PublicationResults
+	checkJSON(t, doRequest(router, "POST", "/api/nodes/uva-an109873/publish", `{"target":"DPLA"}`, "user1"),
+		http.StatusOK, &results)
+	if results.Target != "dpla" || results.Total != 3 || len(results.Publications) != 3 {
+		t.Fatalf("unexpected publish results %+v", results)
+	}
+	for _, pub := range results.Publications {
+		if pub.ID == 0 || pub.RecordHash == "" || pub.ComputingID != "user1" || pub.PublishedAt.Equal(results.PublishedAt) == false {
+			t.Errorf("unexpected publication %+v", pub)
+		}
+	}
+	if changed := getChanged(t, router, "uva-an109873", "dpla"); len(changed) != 0 {
+		t.Errorf("%v changed right after they were published", changed)
+	}
+
+	var pubs []Publication
+	checkJSON(t, doRequest(router, "GET", "/api/nodes/uva-an109877/publications", "", "user1"), http.StatusOK, &pubs)
+	if len(pubs) != 1 || pubs[0].Target != "dpla" || pubs[0].RecordHash != results.Publications[1].RecordHash {
+		t.Errorf("unexpected publications %+v", pubs)
+	}
+
+	// an edit to an item changes it and the collection that contains it
+	body := fmt.Sprintf(`{"title":"The Roanoke Valley Horse Show, 1951","version":"%s"}`, currentVersion(t, router, "uva-an109877"))
+	resp := doRequest(router, "POST", "/api/nodes/109877/update", body, "user1")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("update returned %d: %s", resp.Code, resp.Body.String())
+	}
+	changed := getChanged(t, router, "uva-an109873", "dpla")
+	if len(changed) != 2 || changed[0] != "uva-an109873" || changed[1] != "uva-an109877" {
+		t.Errorf("changed since published to dpla is %v", changed)
+	}
+	if changed := getChanged(t, router, "uva-an109873", "virgo"); len(changed) != 0 {
+		t.Errorf("%v changed since published to virgo, but nothing was", changed)
+	}
+
+	checkJSON(t, doRequest(router, "POST", "/api/nodes/uva-an109877/publish", `{"target":"dpla"}`, "user1"),
+		http.StatusOK, &results)
+	if results.Total != 1 {
+		t.Errorf("item publish returned %d publications", results.Total)
+	}
+	checkJSON(t, doRequest(router, "GET", "/api/nodes/uva-an109877/publications?target=dpla", "", "user1"), http.StatusOK, &pubs)
+	if len(pubs) != 2 || pubs[0].RecordHash != results.Publications[0].RecordHash || pubs[0].RecordHash == pubs[1].RecordHash {
+		t.Errorf("unexpected publications after the edit %+v", pubs)
+	}
+	if changed := getChanged(t, router, "uva-an109873", "dpla"); len(changed) != 1 || changed[0] != "uva-an109873" {
+		t.Errorf("changed since republished to dpla is %v", changed)
+	}
+	checkJSON(t, doRequest(router, "GET", "/api/nodes/uva-an109877/publications?target=virgo", "", "user1"), http.StatusOK, &pubs)
+	if len(pubs) != 0 {
+		t.Errorf("%d virgo publications, expected none", len(pubs))
+	}
+}
@@ -44,18 +44,18 @@ func (d *wslsQdcData) CleanXMLSting(val string) string {
 	return out
 }
 
-func (d *wslsQdcData) FixDate(origDate string) string {
+func (d *wslsQdcData) FixDate(logger *log.Logger, origDate string) string {
 	if origDate == "" {
 		return "[1951..1971]"
 	}
 	if strings.Contains(origDate, "/") == false {
 		return origDate
 	}
-	log.Printf("NOTICE: Date with slashes %s", origDate)
+	logger.Printf("NOTICE: Date with slashes %s", origDate)
 	r := regexp.MustCompile("^0/0/")
 	if r.MatchString(origDate) {
 		yr := strings.Split(origDate, "/")[2]
-		log.Printf("   Fixed: %s", yr)
+		logger.Printf("   Fixed: %s", yr)
 		return yr
 	}
 	r = regexp.MustCompile("/0/")
@@ -72,69 +72,87 @@ func (d *wslsQdcData) FixDate(origDate string) string {
 		}
 		out = fmt.Sprintf("%s-%s-%s", bits[2], m, bits[1])
 	}
-	log.Printf("   Fixed: %s", out)
+	logger.Printf("   Fixed: %s", out)
 	return out
 }
 
 // GetDPLAPIDs returns a list of PIDs for items that are published to the DPLA
 func (app *Apollo) GetDPLAPIDs(c *gin.Context) {
-	pid := "uva-an109873"
-	log.Printf("INFO: get collection for Apollo PID %s", pid)
-	rootID, dbErr := lookupIdentifier(&app.DB, pid)
-	if dbErr != nil {
-		log.Printf("ERROR: %s", dbErr.Error())
-		c.String(http.StatusNotFound, dbErr.Error())
-		return
-	}
-
-	root, dbErr := getTree(&app.DB, rootID.ID)
-	if dbErr != nil {
-		log.Printf("ERROR: %s", dbErr.Error())
-		c.String(http.StatusInternalServerError, dbErr.Error())
-		return
-	}
-	log.Printf("INFO: collection tree retrieved from DB; find items with video")
 	pidList := list.New()
-	traverseTreeForDPLA(pidList, root)
-	out := ""
-	cnt := 0
-	for e := pidList.Front(); e != nil; e = e.Next() {
-		if out != "" {
-			out += ","
+	for _, pid := range app.DPLACollections {
+		requestLog(c).Printf("INFO: get collection for Apollo PID %s", pid)
+		rootID, dbErr := app.repo(c).LookupIdentifier(pid)
+		if dbErr != nil {
+			requestLog(c).Printf("ERROR: %s", dbErr.Error())
+			c.String(http.StatusNotFound, dbErr.Error())
+			return
 		}
-		cnt++
-		out += fmt.Sprintf("%s", e.Value)
+
+		root, dbErr := app.repo(c).GetTree(rootID.ID)
+		if dbErr != nil {
+			requestLog(c).Printf("ERROR: %s", dbErr.Error())
+			c.String(http.StatusInternalServerError, dbErr.Error())
+			return
+		}
+		requestLog(c).Printf("INFO: collection tree retrieved from DB; find items with video")
+		traverseTreeForDPLA(requestLog(c), pidList, root)
 	}
-	log.Printf("INFO: %d DPLA PIDS found", cnt)
+	out := joinPIDs(pidList)
+	requestLog(c).Printf("INFO: %d DPLA PIDS found", pidList.Len())
+	exportBytes.WithLabelValues("dpla_pids").Add(float64(len(out)))
 	c.String(http.StatusOK, out)
 }
 
 // GetQDC returns QDC for a WSLS item
 func (app *Apollo) GetQDC(c *gin.Context) {
 	pid := c.Param("pid")
-	log.Printf("INFO: Get QDC for %s", pid)
-	itemIDs, dbErr := lookupIdentifier(&app.DB, pid)
+	requestLog(c).Printf("INFO: Get QDC for %s", pid)
+	itemIDs, dbErr := app.repo(c).LookupIdentifier(pid)
 	if dbErr != nil {
-		log.Printf("ERROR: %s", dbErr.Error())
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
 		c.String(http.StatusNotFound, dbErr.Error())
 		return
 	}
 
-	item, dbErr := getNode(&app.DB, itemIDs.ID)
+	item, dbErr := app.repo(c).GetNode(itemIDs.ID)
 	if dbErr != nil {
-		log.Printf("ERROR: %s", dbErr.Error())
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
 		c.String(http.StatusNotFound, dbErr.Error())
 		return
 	}
 
 	// note: if above was successful, this will be as well
-	parent, _ := getNodeCollection(&app.DB, item)
-	if parent.PID != "uva-an109873" {
-		log.Printf("%s is not a QDC candidate", pid)
+	parent, _ := app.repo(c).GetNodeCollection(item)
+	if app.isDPLACollection(parent.PID) == false {
+		requestLog(c).Printf("%s is not a QDC candidate", pid)
 		c.String(http.StatusBadRequest, fmt.Sprintf("%s is not q QDC candidate", pid))
 		return
 	}
 
+	data := app.qdcData(requestLog(c), item)
+	if data.PID == "" {
+		requestLog(c).Printf("ERROR: %s has not been published", pid)
+		c.String(http.StatusNotFound, fmt.Sprintf("%s not published", pid))
+		return
+	}
+	if data.Title == "" {
+		requestLog(c).Printf("ERROR: %s has no title", pid)
+		c.String(http.StatusNotFound, fmt.Sprintf("%s has no title", pid))
+		return
+	}
+
+	qdc, err := app.renderQDC(data)
+	if err != nil {
+		requestLog(c).Printf("ERROR: %s", err.Error())
+		c.String(http.StatusInternalServerError, "unable to generate qdc")
+		return
+	}
+	exportBytes.WithLabelValues("qdc").Add(float64(len(qdc)))
+	c.String(http.StatusOK, string(qdc))
+}
+
+// qdcData collects the QDC values for a WSLS item from its attributes
+func (app *Apollo) qdcData(logger *log.Logger, item *Node) *wslsQdcData {
 	// default data to CNE. if a wslsRights element is found, this will be overridden
 	var data wslsQdcData
 	data.Rights = "http://rightsstatements.org/vocab/CNE/1.0/"
@@ -156,7 +174,7 @@ func (app *Apollo) GetQDC(c *gin.Context) {
 		case "abstract":
 			data.Description = data.CleanXMLSting(child.Value)
 		case "dateCreated":
-			data.DateCreated = data.FixDate(child.Value)
+			data.DateCreated = data.FixDate(logger, child.Value)
 		case "duration":
 			if child.Value != "mag" {
 				data.Duration = child.Value
@@ -173,28 +191,41 @@ func (app *Apollo) GetQDC(c *gin.Context) {
 			data.Places = append(data.Places, cv)
 		}
 	}
+	return &data
+}
 
-	if data.PID == "" {
-		log.Printf("ERROR: %s has not been published", pid)
-		c.String(http.StatusNotFound, fmt.Sprintf("%s not published", pid))
-		return
+// renderQDC fills the QDC template with the data for an item
+func (app *Apollo) renderQDC(data *wslsQdcData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := app.QDCTemplate.Execute(&buf, data); err != nil {
+		return nil, err
 	}
-	if data.Title == "" {
-		log.Printf("ERROR: %s has no title", pid)
-		c.String(http.StatusNotFound, fmt.Sprintf("%s has no title", pid))
-		return
+	return buf.Bytes(), nil
+}
+
+// isDPLACollection is true for the collections configured as published to the DPLA
+func (app *Apollo) isDPLACollection(pid string) bool {
+	for _, dplaPID := range app.DPLACollections {
+		if dplaPID == pid {
+			return true
+		}
 	}
+	return false
+}
 
-	var buf bytes.Buffer
-	if err := app.QDCTemplate.Execute(&buf, data); err != nil {
-		log.Printf("ERROR: %s", err.Error())
-		c.String(http.StatusInternalServerError, "unable to generate qdc")
-		return
+// joinPIDs returns a comma separated list of the PIDs
+func joinPIDs(pids *list.List) string {
+	out := ""
+	for e := pids.Front(); e != nil; e = e.Next() {
+		if out != "" {
+			out += ","
+		}
+		out += fmt.Sprintf("%s", e.Value)
 	}
-	c.String(http.StatusOK, buf.String())
+	return out
 }
 
-func traverseTreeForDPLA(pids *list.List, node *Node) {
+func traverseTreeForDPLA(logger *log.Logger, pids *list.List, node *Node) {
 	if node.Type.Container {
 		externalPID := ""
 		hasVideo := false
@@ -208,14 +239,14 @@ func traverseTreeForDPLA(pids *list.List, node *Node) {
 				}
 			}
 			if child.Type.Container {
-				traverseTreeForDPLA(pids, child)
+				traverseTreeForDPLA(logger, pids, child)
 			}
 		}
 		if externalPID != "" && node.Type.Name == "item" {
 			if hasVideo {
 				pids.PushBack(externalPID)
 			} else {
-				log.Printf("INFO: Skip %s with no video", externalPID)
+				logger.Printf("INFO: Skip %s with no video", externalPID)
 			}
 		}
 	}
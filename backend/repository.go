@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Repository is the storage behind the API: nodes, trees, vocabularies, search, identifiers, changes
+// and their history, publications and webhooks. The service uses the MySQL implementation. The tests
+// use an in-memory implementation, loaded from collection XML, so the handlers run without a database.
+//
+// Each change is made as a whole, with its audit entries and webhook events, or not at all. A change
+// refused because of the request returns a *changeError; one made with a version of the data that
+// is out of date returns a *versionError.
+type Repository interface {
+	// nodes and trees
+	LookupIdentifier(identifier string) (*NodeIdentifier, error)
+	LookupTrashed(pid string) (*NodeIdentifier, error)
+	LookupCollectionNode(collectionID int64, identifier string) (*NodeIdentifier, error)
+	GetNode(nodeID int64) (*Node, error)
+	GetTree(rootID int64) (*Node, error)
+	GetSubtree(rootID int64, depth int) (*Node, error)
+	GetNodeCollection(node *Node) (*Node, error)
+	GetCollections() []Collection
+	GetChildSummaries(parentID int64, offset int, limit int) (int, []ContainerSummary, error)
+	GetItemContext(itemID int64) (*ItemContext, error)
+	NodeVersion(nodeID int64) (string, error)
+
+	// vocabularies
+	GetNodeTypes() ([]NodeType, error)
+	GetNodeType(name string) (*NodeType, error)
+	GetControlledValues(typeName string) ([]ControlledValue, error)
+	GetSuggestions(nodeType *NodeType, prefix string, limit int) ([]Suggestion, error)
+
+	// search
+	SearchNodes(query string) ([]searchRow, error)
+
+	// identifiers
+	ResolveIdentifiers(identifiers []string) (*ResolveResults, error)
+	FindIdentifier(typeName string, value string, excludeItemID int64) ([]IdentifierMatch, error)
+	GetIdentifierCollisions(typeName string) ([]IdentifierCollision, error)
+
+	// changes
+	UpdateNode(update *nodeUpdate) (string, error)
+	MoveNode(move *nodeMove) error
+	ReorderChildren(parentID int64, version string, children []string, user string) error
+	DeleteNode(nodeID int64, version string, user string) (int64, error)
+	RestoreNode(nodeID int64, version string, user string) (int64, error)
+	PurgeTrash(days int, user string) (int64, error)
+	BulkReplace(req *bulkReplace) (*BulkReplaceResults, error)
+	Publish(pubs *PublicationResults, collectionID int64, evt WebhookEvent) error
+
+	// trash, change feed, publication history and audit log
+	GetTrash(collectionID int64) ([]TrashEntry, error)
+	GetChanges(collectionID int64, pos changeCursor, limit int) ([]Change, error)
+	GetPublications(pid string, target string) ([]Publication, error)
+	GetChangedSincePublished(collectionID int64, target string) ([]ChangedItem, error)
+	GetAuditLog(filter *auditFilter, offset int, limit int) (int, []AuditEntry, error)
+	ExportAuditLog(filter *auditFilter, each func(entry *AuditEntry) error) error
+
+	// webhooks and the outbox of events to deliver to them
+	GetWebhooks() ([]Webhook, error)
+	AddWebhook(hook *Webhook) error
+	DeleteWebhook(hookID int64) (bool, error)
+	GetWebhookDeliveries(hookID int64, status string, limit int) ([]*WebhookDelivery, error)
+	ClaimDeliveries(worker string, limit int) ([]WebhookDelivery, error)
+	ReleaseDeliveries(worker string) error
+	RecordDelivery(delivery *WebhookDelivery, retryIn time.Duration) error
+	QueueCreatedEvents() (int, error)
+
+	// withLog returns the repository with logging sent to logger
+	withLog(logger *log.Logger) Repository
+}
+
+// changeError is a change that was refused because of the request rather than a failure of the
+// storage. Status is the HTTP status to respond with.
+type changeError struct {
+	Status  int
+	Message string
+}
+
+func (e *changeError) Error() string {
+	return e.Message
+}
+
+// refuseChange returns a changeError with a formatted message
+func refuseChange(status int, format string, args ...interface{}) error {
+	return &changeError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+// versionError is a change that was refused because the version the client sent for a node is
+// not its current version
+type versionError struct {
+	NodeID  int64
+	Version string
+}
+
+func (e *versionError) Error() string {
+	return fmt.Sprintf("version for node %d is stale; current version is %s", e.NodeID, e.Version)
+}
+
+// mysqlRepository is the Repository backed by the Apollo MySQL database. The time taken by
+// each call and the size of the trees loaded are recorded in the metrics.
+type mysqlRepository struct {
+	db *DB
+}
+
+func (r *mysqlRepository) LookupIdentifier(identifier string) (*NodeIdentifier, error) {
+	defer observeQuery("lookup_identifier", time.Now())
+	return lookupIdentifier(r.db, identifier)
+}
+
+func (r *mysqlRepository) LookupTrashed(pid string) (*NodeIdentifier, error) {
+	defer observeQuery("lookup_trashed", time.Now())
+	return lookupTrashed(r.db, pid)
+}
+
+func (r *mysqlRepository) LookupCollectionNode(collectionID int64, identifier string) (*NodeIdentifier, error) {
+	defer observeQuery("lookup_collection_node", time.Now())
+	return lookupCollectionNode(r.db, collectionID, identifier)
+}
+
+func (r *mysqlRepository) GetNode(nodeID int64) (*Node, error) {
+	defer observeQuery("node", time.Now())
+	return getNode(r.db, nodeID)
+}
+
+func (r *mysqlRepository) GetTree(rootID int64) (*Node, error) {
+	defer observeQuery("tree", time.Now())
+	root, err := getTree(r.db, rootID)
+	observeTree("tree", root)
+	return root, err
+}
+
+func (r *mysqlRepository) GetSubtree(rootID int64, depth int) (*Node, error) {
+	defer observeQuery("subtree", time.Now())
+	root, err := getSubtree(r.db, rootID, depth)
+	observeTree("subtree", root)
+	return root, err
+}
+
+func (r *mysqlRepository) GetNodeCollection(node *Node) (*Node, error) {
+	defer observeQuery("node_collection", time.Now())
+	return getNodeCollection(r.db, node)
+}
+
+func (r *mysqlRepository) GetCollections() []Collection {
+	defer observeQuery("collections", time.Now())
+	return getCollections(r.db)
+}
+
+func (r *mysqlRepository) GetChildSummaries(parentID int64, offset int, limit int) (int, []ContainerSummary, error) {
+	defer observeQuery("child_summaries", time.Now())
+	return getChildSummaries(r.db, parentID, offset, limit)
+}
+
+func (r *mysqlRepository) GetItemContext(itemID int64) (*ItemContext, error) {
+	defer observeQuery("item_context", time.Now())
+	return getItemContext(r.db, itemID)
+}
+
+func (r *mysqlRepository) NodeVersion(nodeID int64) (string, error) {
+	defer observeQuery("node_version", time.Now())
+	return nodeVersion(r.db, nodeID)
+}
+
+func (r *mysqlRepository) GetNodeTypes() ([]NodeType, error) {
+	defer observeQuery("node_types", time.Now())
+	return getNodeTypes(r.db)
+}
+
+func (r *mysqlRepository) GetNodeType(name string) (*NodeType, error) {
+	defer observeQuery("node_type", time.Now())
+	return getNodeType(r.db, name)
+}
+
+func (r *mysqlRepository) GetControlledValues(typeName string) ([]ControlledValue, error) {
+	defer observeQuery("controlled_values", time.Now())
+	return getControlledValues(r.db, typeName)
+}
+
+func (r *mysqlRepository) GetSuggestions(nodeType *NodeType, prefix string, limit int) ([]Suggestion, error) {
+	defer observeQuery("suggestions", time.Now())
+	return getSuggestions(r.db, nodeType, prefix, limit)
+}
+
+func (r *mysqlRepository) SearchNodes(query string) ([]searchRow, error) {
+	defer observeQuery("search", time.Now())
+	return searchNodes(r.db, query)
+}
+
+func (r *mysqlRepository) ResolveIdentifiers(identifiers []string) (*ResolveResults, error) {
+	defer observeQuery("resolve_identifiers", time.Now())
+	return resolveIdentifiers(r.db, identifiers)
+}
+
+func (r *mysqlRepository) FindIdentifier(typeName string, value string, excludeItemID int64) ([]IdentifierMatch, error) {
+	defer observeQuery("find_identifier", time.Now())
+	return findIdentifier(r.db, typeName, value, excludeItemID)
+}
+
+func (r *mysqlRepository) GetIdentifierCollisions(typeName string) ([]IdentifierCollision, error) {
+	defer observeQuery("identifier_collisions", time.Now())
+	return getIdentifierCollisions(r.db, typeName)
+}
+
+func (r *mysqlRepository) UpdateNode(update *nodeUpdate) (string, error) {
+	defer observeQuery("update_node", time.Now())
+	return updateNodeAttributes(r.db, update)
+}
+
+func (r *mysqlRepository) MoveNode(move *nodeMove) error {
+	defer observeQuery("move_node", time.Now())
+	return moveToParent(r.db, move)
+}
+
+func (r *mysqlRepository) ReorderChildren(parentID int64, version string, children []string, user string) error {
+	defer observeQuery("reorder_children", time.Now())
+	return reorderChildren(r.db, parentID, version, children, user)
+}
+
+func (r *mysqlRepository) DeleteNode(nodeID int64, version string, user string) (int64, error) {
+	defer observeQuery("delete_node", time.Now())
+	return deleteNode(r.db, nodeID, version, user)
+}
+
+func (r *mysqlRepository) RestoreNode(nodeID int64, version string, user string) (int64, error) {
+	defer observeQuery("restore_node", time.Now())
+	return restoreNode(r.db, nodeID, version, user)
+}
+
+func (r *mysqlRepository) PurgeTrash(days int, user string) (int64, error) {
+	defer observeQuery("purge_trash", time.Now())
+	return purgeTrash(r.db, days, user)
+}
+
+func (r *mysqlRepository) BulkReplace(req *bulkReplace) (*BulkReplaceResults, error) {
+	defer observeQuery("bulk_replace", time.Now())
+	return bulkReplaceValues(r.db, req)
+}
+
+func (r *mysqlRepository) Publish(pubs *PublicationResults, collectionID int64, evt WebhookEvent) error {
+	defer observeQuery("publish", time.Now())
+	return publish(r.db, pubs, collectionID, evt)
+}
+
+func (r *mysqlRepository) GetTrash(collectionID int64) ([]TrashEntry, error) {
+	defer observeQuery("trash", time.Now())
+	return getTrash(r.db, collectionID)
+}
+
+func (r *mysqlRepository) GetChanges(collectionID int64, pos changeCursor, limit int) ([]Change, error) {
+	defer observeQuery("changes", time.Now())
+	return getChanges(r.db, collectionID, pos, limit)
+}
+
+func (r *mysqlRepository) GetPublications(pid string, target string) ([]Publication, error) {
+	defer observeQuery("publications", time.Now())
+	return getPublications(r.db, pid, target)
+}
+
+func (r *mysqlRepository) GetChangedSincePublished(collectionID int64, target string) ([]ChangedItem, error) {
+	defer observeQuery("changed_since_published", time.Now())
+	return getChangedSincePublished(r.db, collectionID, target)
+}
+
+func (r *mysqlRepository) GetAuditLog(filter *auditFilter, offset int, limit int) (int, []AuditEntry, error) {
+	defer observeQuery("audit_log", time.Now())
+	return getAuditLog(r.db, filter, offset, limit)
+}
+
+func (r *mysqlRepository) ExportAuditLog(filter *auditFilter, each func(entry *AuditEntry) error) error {
+	defer observeQuery("audit_export", time.Now())
+	return exportAuditLog(r.db, filter, each)
+}
+
+func (r *mysqlRepository) GetWebhooks() ([]Webhook, error) {
+	defer observeQuery("webhooks", time.Now())
+	return getWebhooks(r.db)
+}
+
+func (r *mysqlRepository) AddWebhook(hook *Webhook) error {
+	defer observeQuery("add_webhook", time.Now())
+	return addWebhook(r.db, hook)
+}
+
+func (r *mysqlRepository) DeleteWebhook(hookID int64) (bool, error) {
+	defer observeQuery("delete_webhook", time.Now())
+	return deleteWebhook(r.db, hookID)
+}
+
+func (r *mysqlRepository) GetWebhookDeliveries(hookID int64, status string, limit int) ([]*WebhookDelivery, error) {
+	defer observeQuery("webhook_deliveries", time.Now())
+	return getWebhookDeliveries(r.db, hookID, status, limit)
+}
+
+func (r *mysqlRepository) ClaimDeliveries(worker string, limit int) ([]WebhookDelivery, error) {
+	defer observeQuery("claim_deliveries", time.Now())
+	return claimDeliveries(r.db, worker, limit)
+}
+
+func (r *mysqlRepository) ReleaseDeliveries(worker string) error {
+	defer observeQuery("release_deliveries", time.Now())
+	return releaseDeliveries(r.db, worker)
+}
+
+func (r *mysqlRepository) RecordDelivery(delivery *WebhookDelivery, retryIn time.Duration) error {
+	defer observeQuery("record_delivery", time.Now())
+	return recordDelivery(r.db, delivery, retryIn)
+}
+
+func (r *mysqlRepository) QueueCreatedEvents() (int, error) {
+	defer observeQuery("queue_created_events", time.Now())
+	return queueCreatedEvents(r.db)
+}
+
+func (r *mysqlRepository) withLog(logger *log.Logger) Repository {
+	return &mysqlRepository{db: r.db.withLog(logger)}
+}
@@ -2,13 +2,13 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
 )
 
 // CollectionHit contains all of the search hits grouped by collection
@@ -22,11 +22,13 @@ type CollectionHit struct {
 
 // SearchHit is one match found in the search
 type SearchHit struct {
-	PID     string `json:"pid"`
-	Title   string `json:"title,omitempty"`
-	Type    string `json:"match_type"`
-	Match   string `json:"match"`
-	ItemURL string `json:"item_url"`
+	PID        string       `json:"pid"`
+	Title      string       `json:"title,omitempty"`
+	Type       string       `json:"match_type"`
+	Match      string       `json:"match"`
+	Highlights []MatchRange `json:"highlights"`
+	Snippets   []string     `json:"snippets"`
+	ItemURL    string       `json:"item_url"`
 }
 
 // SearchResults contains all of the results for a search operation
@@ -45,22 +47,19 @@ func (app *Apollo) SearchHandler(c *gin.Context) {
 		c.String(http.StatusBadRequest, "missing query term")
 		return
 	}
-	res := app.searchAll(qs)
+	res := app.searchAll(c, qs)
+	searchHits.Observe(float64(res.Hits))
 	c.JSON(http.StatusOK, res)
 }
 
 // Search will search node values for the query string and return a struct containing match results
-func (app *Apollo) searchAll(query string) *SearchResults {
+func (app *Apollo) searchAll(c *gin.Context, query string) *SearchResults {
 	query = strings.ToLower(query)
+	matcher := newMatcher(query)
 	start := time.Now()
-	searchQ := `select n.id,n.pid,n.parent_id,np.pid as parent_pid,n.ancestry,nt.name as type,n.value,cv.value as controlled_value from nodes n
-		inner join node_types nt on nt.id=n.node_type_id
-		inner join nodes np on np.id = n.parent_id
-		left join controlled_values cv on cv.id=n.value
-		where n.node_type_id != 6 and (n.value REGEXP ? or (cv.value REGEXP ? and nt.controlled_vocab = 1))`
-	rows, err := app.DB.Queryx(searchQ, query, query)
+	rows, err := app.repo(c).SearchNodes(query)
 	if err != nil {
-		log.Printf("ERROR: Search for %s failed: %s", query, err.Error())
+		requestLog(c).Printf("ERROR: Search for %s failed: %s", query, err.Error())
 		elapsed := time.Since(start)
 		elapsedMS := int64(elapsed / time.Millisecond)
 		return &SearchResults{Hits: 0, ResponseTimeMS: elapsedMS, Status: http.StatusNotFound, Message: err.Error()}
@@ -72,31 +71,18 @@ func (app *Apollo) searchAll(query string) *SearchResults {
 
 	// get minimal info on all collections; OID, PID and TItle. Only a few exist right
 	// now, so this brute force grab is OK
-	for _, coll := range getCollections(&app.DB) {
+	for _, coll := range app.repo(c).GetCollections() {
 		hits := make([]SearchHit, 0)
 		collInfo := CollectionHit{ID: coll.ID, PID: coll.PID, Title: coll.Title,
 			URL: fmt.Sprintf("%s/collections/%s", app.ApolloURL, coll.PID), Hits: &hits}
 		collections = append(collections, collInfo)
 	}
 
-	type hitRow struct {
-		ID              int64  `db:"id"`
-		PID             string `db:"pid"`
-		ParentID        int64  `db:"parent_id"`
-		ParentPID       string `db:"parent_pid"`
-		Type            string `db:"type"`
-		Ancestry        string `db:"ancestry"`
-		Value           string `db:"value"`
-		ControlledValue string `db:"controlled_value"`
-	}
-
 	// Walk the rows from the search query and generate hit list for response
 	var hitCollection *CollectionHit
-	for rows.Next() {
-		// Parse the hit row, figure out which collection it was from (first part of ancestry)
+	for _, hr := range rows {
+		// Figure out which collection the hit row was from (first part of ancestry)
 		// and find the matching CollectionHits object. It will be used to track this hit.
-		var hr hitRow
-		rows.StructScan(&hr)
 		hit := SearchHit{Type: hr.Type, PID: hr.ParentPID}
 		collID, _ := strconv.ParseInt(strings.Split(hr.Ancestry, "/")[0], 10, 64)
 		for _, coll := range collections {
@@ -110,20 +96,21 @@ func (app *Apollo) searchAll(query string) *SearchResults {
 		if hr.PID != hitCollection.PID {
 			hit.ItemURL = fmt.Sprintf("%s/collections/%s?item=%s", app.ApolloURL, hitCollection.PID, hit.PID)
 			if hit.Type != "title" {
-				// Non-title hit, grab the title for some context
-				pq := "select value from nodes where parent_id=? and node_type_id=2"
-				app.DB.Get(&hit.Title, pq, hr.ParentID)
+				// Non-title hit, include the title for some context
+				hit.Title = hr.ItemTitle
 			}
 		} else {
 			hit.ItemURL = fmt.Sprintf("%s/collections/%s", app.ApolloURL, hitCollection.PID)
 		}
 
 		// see if the hit was in value or controlled value...
-		if strings.Contains(strings.ToLower(hr.Value), query) {
-			hit.Match = hr.Value
-		} else {
+		hit.Match = hr.Value
+		hit.Highlights = findMatches(matcher, hr.Value)
+		if len(hit.Highlights) == 0 && hr.ControlledValue != "" {
 			hit.Match = hr.ControlledValue
+			hit.Highlights = findMatches(matcher, hr.ControlledValue)
 		}
+		hit.Snippets = buildSnippets(hit.Match, hit.Highlights)
 
 		hits++
 		*hitCollection.Hits = append(*hitCollection.Hits, hit)
@@ -138,7 +125,7 @@ func (app *Apollo) searchAll(query string) *SearchResults {
 			}
 		}
 	} else {
-		log.Printf("INFO: search for %s found no matches", query)
+		requestLog(c).Printf("INFO: search for %s found no matches", query)
 		out.Results = []CollectionHit{}
 	}
 	elapsed := time.Since(start)
@@ -148,31 +135,121 @@ func (app *Apollo) searchAll(query string) *SearchResults {
 	return &out
 }
 
+// searchRow is a node that matches a search
+type searchRow struct {
+	ID              int64  `db:"id"`
+	PID             string `db:"pid"`
+	ParentID        int64  `db:"parent_id"`
+	ParentPID       string `db:"parent_pid"`
+	Type            string `db:"type"`
+	Ancestry        string `db:"ancestry"`
+	Value           string `db:"value"`
+	ControlledValue string `db:"controlled_value"`
+	ItemTitle       string `db:"-"`
+}
+
+// searchNodes finds all nodes with a value or controlled value that matches the query regex.
+// For non-title matches, the title of the item containing the match is included.
+func searchNodes(db *DB, query string) ([]searchRow, error) {
+	searchQ := `select n.id,n.pid,n.parent_id,np.pid as parent_pid,n.ancestry,nt.name as type,n.value,
+		COALESCE(cv.value, '') as controlled_value from nodes n
+		inner join node_types nt on nt.id=n.node_type_id
+		inner join nodes np on np.id = n.parent_id
+		left join controlled_values cv on cv.id=n.value
+		where n.node_type_id != 6 and n.deleted=0 and n.current=1 and np.deleted=0
+		and (n.value REGEXP ? or (cv.value REGEXP ? and nt.controlled_vocab = 1))`
+	rows := make([]searchRow, 0)
+	err := db.Select(&rows, searchQ, query, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// the titles of the items with non-title matches are found together rather than one at a time
+	parentIDs := make([]int64, 0)
+	for _, r := range rows {
+		if r.Type != "title" {
+			parentIDs = append(parentIDs, r.ParentID)
+		}
+	}
+	titles, err := getItemTitles(db, parentIDs)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range rows {
+		if rows[idx].Type != "title" {
+			rows[idx].ItemTitle = titles[rows[idx].ParentID]
+		}
+	}
+	return rows, nil
+}
+
+// getItemTitles returns a map of item ID to the first title of each item
+func getItemTitles(db *DB, itemIDs []int64) (map[int64]string, error) {
+	out := make(map[int64]string)
+	for start := 0; start < len(itemIDs); start += resolveBatchSize {
+		batch := itemIDs[start:min(start+resolveBatchSize, len(itemIDs))]
+		query, args, err := sqlx.In(`SELECT parent_id, value FROM nodes
+			WHERE parent_id IN (?) and node_type_id=2 and deleted=0 and current=1
+			ORDER BY parent_id ASC, sequence ASC`, batch)
+		if err != nil {
+			return nil, err
+		}
+		var titles []struct {
+			ParentID int64  `db:"parent_id"`
+			Value    string `db:"value"`
+		}
+		err = db.Select(&titles, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range titles {
+			if _, ok := out[t.ParentID]; ok == false {
+				out[t.ParentID] = t.Value
+			}
+		}
+	}
+	return out, nil
+}
+
+// identifierTypeIDs are the node types that hold identifiers for an item;
+// externalPID, barcode, catalogKey, callNumber and wslsID
+const identifierTypeIDs = "5,9,10,13,23"
+
 // lookupIdentifier will accept any sort of known identifier and find a matching
 // Apollo ItemID which includes internal ID and PID
 func lookupIdentifier(db *DB, identifier string) (*NodeIdentifier, error) {
-	log.Printf("INFO: lookup identifier %s", identifier)
+	db.Log.Printf("INFO: lookup identifier %s", identifier)
 
-	// First easy case; the identifier is an apollo PID
+	// First easy case; the identifier is an apollo PID. Nodes in the trash are only found by lookupTrashed
 	var nodeID int64
-	db.QueryRow("select id from nodes where pid=?", identifier).Scan(&nodeID)
+	db.QueryRow("select id from nodes where pid=? and deleted=0", identifier).Scan(&nodeID)
 	if nodeID > 0 {
-		log.Printf("INFO: %s is an ApolloPID. ID: %d", identifier, nodeID)
+		db.Log.Printf("INFO: %s is an ApolloPID. ID: %d", identifier, nodeID)
 		return &NodeIdentifier{PID: identifier, ID: nodeID}, nil
 	}
 
 	// Next case; See if it is an externalPID, barcode, catalog key, call number or WSLS ID
 	var apolloPID string
 	var idType string
-	qs := `SELECT t.name, np.id, np.pid FROM nodes ns INNER JOIN nodes np ON np.id = ns.parent_id
+	qs := fmt.Sprintf(`SELECT t.name, np.id, np.pid FROM nodes ns INNER JOIN nodes np ON np.id = ns.parent_id
 			 inner join node_types t on t.id = ns.node_type_id
-	 		 WHERE ns.value=? and t.id in (5,9,10,13,23)`
+	 		 WHERE ns.value=? and ns.deleted=0 and ns.current=1 and np.deleted=0 and t.id in (%s)`, identifierTypeIDs)
 	db.QueryRow(qs, identifier).Scan(&idType, &nodeID, &apolloPID)
 	if apolloPID != "" {
-		log.Printf("INFO: %s matches type %s. ApolloPID: %s ID: %d",
+		db.Log.Printf("INFO: %s matches type %s. ApolloPID: %s ID: %d",
 			identifier, idType, apolloPID, nodeID)
 		return &NodeIdentifier{PID: apolloPID, ID: nodeID}, nil
 	}
 
 	return nil, fmt.Errorf("%s was not found", identifier)
 }
+
+// lookupTrashed finds a node in the trash by its Apollo PID
+func lookupTrashed(db *DB, pid string) (*NodeIdentifier, error) {
+	var nodeID int64
+	db.QueryRow("select id from nodes where pid=? and deleted=1 and current=1", pid).Scan(&nodeID)
+	if nodeID == 0 {
+		return nil, fmt.Errorf("%s is not in the trash", pid)
+	}
+	return &NodeIdentifier{PID: pid, ID: nodeID}, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-contrib/gzip"
+	"github.com/gin-gonic/contrib/static"
+	"github.com/gin-gonic/gin"
+)
+
+// serve runs the service until it receives SIGTERM or SIGINT. On shutdown, the server stops
+// accepting connections and in-flight requests get up to the shutdown timeout to finish. Then
+// background work is stopped and the DB pool is closed.
+func serve(app *Apollo, cfg *apolloConfig) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	var workers sync.WaitGroup
+	if cfg.WebhookInterval > 0 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			app.deliverWebhooks(ctx, time.Duration(cfg.WebhookInterval)*time.Second)
+		}()
+	}
+
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           newHandler(app),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Duration(cfg.ReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(cfg.WriteTimeout) * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	srvErr := make(chan error, 1)
+	go func() {
+		log.Printf("INFO: start Apollo on port %d", cfg.Port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			srvErr <- err
+		}
+	}()
+
+	select {
+	case err := <-srvErr:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	timeout := time.Duration(cfg.ShutdownTimeout) * time.Second
+	log.Printf("INFO: shutdown requested; wait up to %s for in-flight requests", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("WARNING: requests still running at shutdown: %s", err.Error())
+	}
+
+	workers.Wait()
+	log.Printf("INFO: close DB connections")
+	app.DB.Close()
+	return nil
+}
+
+// newHandler creates the http.Handler for the service; a gin engine with all middleware and routes
+func newHandler(app *Apollo) http.Handler {
+	gin.SetMode(gin.ReleaseMode)
+	gin.DisableConsoleColor()
+	router := gin.New()
+	router.Use(requestIDMiddleware, accessLogMiddleware, gin.Recovery(), metricsMiddleware)
+	router.Use(gzip.Gzip(gzip.DefaultCompression))
+	if len(app.CORSOrigins) == 0 || (len(app.CORSOrigins) == 1 && app.CORSOrigins[0] == "*") {
+		router.Use(cors.Default())
+	} else {
+		corsCfg := cors.DefaultConfig()
+		corsCfg.AllowOrigins = app.CORSOrigins
+		router.Use(cors.New(corsCfg))
+	}
+
+	router.GET("/version", app.versionInfo)
+	router.GET("/metrics", metricsHandler())
+	router.GET("/favicon.ico", app.ignoreFavicon)
+	router.GET("/healthcheck", app.readinessCheck)
+	router.GET("/healthz", app.livenessCheck)
+	router.GET("/readyz", app.readinessCheck)
+
+	// create an api routing group and gzip all of its responses
+	api := router.Group("/api")
+	{
+		api.GET("/collections", app.ListCollections)
+		api.GET("/collections/:pid", app.GetCollection)
+		api.GET("/items/:pid", app.GetItemDetails)
+		api.GET("/items/:pid/context", app.GetItemContext)
+		api.POST("/identifiers/resolve", app.ResolveIdentifiers)
+		api.POST("/identifiers/check", app.CheckIdentifier)
+		api.GET("/identifiers/duplicates", app.GetIdentifierCollisions)
+		api.GET("/search", app.SearchHandler)
+		api.GET("/suggest", app.SuggestHandler)
+		api.GET("/types", app.GetNodeTypes)
+		api.GET("/values/:name", app.GeControlledValues)
+		api.GET("/published/dpla", app.GetDPLAPIDs)
+		api.GET("/dpla/:pid", app.GetQDC)
+		api.GET("/nodes/:id/children", app.GetNodeChildren)
+		api.GET("/collections/:pid/trash", app.GetCollectionTrash)
+		api.GET("/collections/:pid/changed", app.GetChangedSincePublished)
+		api.GET("/collections/:pid/changes", app.GetCollectionChanges)
+		api.GET("/changes", app.GetChanges)
+	}
+
+	// all requests that change data, or show who changed it, require an authenticated user
+	edit := api.Group("", app.authMiddleware)
+	{
+		edit.POST("/nodes/:id/update", app.updateNode)
+		edit.POST("/nodes/:id/move", app.MoveNode)
+		edit.POST("/nodes/:id/reorder", app.ReorderChildren)
+		edit.POST("/nodes/:id/restore", app.RestoreNode)
+		edit.DELETE("/nodes/:id", app.DeleteNode)
+		edit.POST("/nodes/:id/replace", app.BulkReplace)
+		edit.POST("/nodes/:id/publish", app.PublishNode)
+		edit.GET("/nodes/:id/publications", app.GetPublications)
+		edit.GET("/audit", app.GetAuditLog)
+	}
+
+	admin := api.Group("/admin", app.authMiddleware, app.adminMiddleware)
+	{
+		admin.GET("/config", app.GetConfig)
+		admin.DELETE("/trash", app.PurgeTrash)
+		admin.GET("/webhooks", app.ListWebhooks)
+		admin.POST("/webhooks", app.AddWebhook)
+		admin.DELETE("/webhooks/:id", app.DeleteWebhook)
+		admin.GET("/webhooks/:id/deliveries", app.GetWebhookDeliveries)
+	}
+
+	// Note: in dev mode, this is never actually used. The front end is served
+	// by yarn and it proxies all requests to the API to the routes above
+	if app.Public != nil {
+		router.Use(static.Serve("/", newStaticFileSystem(app.Public)))
+	}
+
+	// add a catchall route that renders the index page.
+	// based on no-history config setup info here:
+	//    https://router.vuejs.org/guide/essentials/history-mode.html#example-server-configurations
+	router.NoRoute(func(c *gin.Context) {
+		if app.Public == nil {
+			c.String(http.StatusNotFound, "not found")
+			return
+		}
+		index, err := fs.ReadFile(app.Public, "index.html")
+		if err != nil {
+			c.String(http.StatusNotFound, "not found")
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", index)
+	})
+
+	return router
+}
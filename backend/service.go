@@ -1,11 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
-	"path/filepath"
-	"strings"
 	"text/template"
 	"time"
 
@@ -14,79 +14,102 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
-// DB wraps the database connection object
+// DB wraps the database connection object along with the logger for the request using it
 type DB struct {
 	*sqlx.DB
+	Log *log.Logger
+}
+
+// withLog returns a copy of the DB that logs to logger
+func (db *DB) withLog(logger *log.Logger) *DB {
+	out := *db
+	out.Log = logger
+	return &out
 }
 
 // Apollo is the applicatin object through which all requests are handled.
 // It contains common config information and services, like the DB
 type Apollo struct {
-	Version         string
-	ApolloURL       string
-	WSLSURL         string
-	DB              DB
-	DevAuthUser     string
-	AuthComputingID string
-	IIIF            string
-	QDCTemplate     *template.Template
+	Version            string
+	ApolloURL          string
+	WSLSURL            string
+	DB                 DB
+	Repo               Repository
+	DevAuthUser        string
+	AuthComputingID    string
+	IIIF               string
+	QDCTemplate        *template.Template
+	RejectDuplicateIDs bool
+	Admins             []string
+	TrashDays          int
+	PublicDir          string
+	Public             fs.FS
+	DPLACollections    []string
+	CORSOrigins        []string
+	Config             *apolloConfig
+	Started            time.Time
+	pool               poolWatch
 }
 
 func initService(version string, cfg *apolloConfig) (*Apollo, error) {
 	svc := Apollo{Version: version,
-		ApolloURL:   cfg.apolloURL,
-		DevAuthUser: cfg.devUser,
-		IIIF:        cfg.iiifManURL,
-		WSLSURL:     cfg.wslsURL,
+		Started:            time.Now(),
+		Config:             cfg,
+		ApolloURL:          cfg.ApolloURL,
+		DevAuthUser:        cfg.DevUser,
+		IIIF:               cfg.IIIFManURL,
+		WSLSURL:            cfg.WSLSURL,
+		RejectDuplicateIDs: cfg.RejectDups,
+		Admins:             cfg.Admins,
+		TrashDays:          cfg.TrashDays,
+		PublicDir:          cfg.PublicDir,
+		DPLACollections:    cfg.DPLACollections,
+		CORSOrigins:        cfg.CORSOrigins,
+	}
+
+	if cfg.AutoMigrate {
+		log.Printf("INFO: migrating DB...")
+		if err := autoMigrate(&cfg.DB); err != nil {
+			return nil, fmt.Errorf("migration failed: %s", err.Error())
+		}
 	}
 
 	log.Printf("INFO: connecting to DB...")
-	connectStr := fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true&timeout=%ss&readTimeout=%ss&writeTimeout=%ss",
-		cfg.dbConfig.User, cfg.dbConfig.Pass, cfg.dbConfig.Host, cfg.dbConfig.Database,
-		cfg.dbConfig.Timeout, cfg.dbConfig.Timeout, cfg.dbConfig.Timeout)
+	connectStr := fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true&timeout=%ds&readTimeout=%ds&writeTimeout=%ds",
+		cfg.DB.User, cfg.DB.Pass, cfg.DB.Host, cfg.DB.Database,
+		cfg.DB.Timeout, cfg.DB.Timeout, cfg.DB.Timeout)
 	db, err := sqlx.Connect("mysql", connectStr)
 	if err != nil {
 		return nil, fmt.Errorf("database connection failed: %s", err.Error())
 	}
-	db.SetConnMaxLifetime(time.Minute * 5)
-	db.SetMaxIdleConns(5)
-	db.SetMaxOpenConns(5)
-	svc.DB = DB{db}
+	db.SetConnMaxLifetime(time.Duration(cfg.DB.ConnMaxLifetime) * time.Second)
+	db.SetMaxIdleConns(cfg.DB.MaxIdleConns)
+	db.SetMaxOpenConns(cfg.DB.MaxOpenConns)
+	svc.DB = DB{db, log.Default()}
+	svc.Repo = &mysqlRepository{db: &svc.DB}
+	if err := checkSchemaVersion(context.Background(), svc.DB); err != nil {
+		db.Close()
+		return nil, err
+	}
+	registerDBMetrics(&svc.DB, cfg.DB.Database)
 	log.Printf("INFO: DB Connection established")
 
 	log.Printf("INFO: Load QDC template")
-	svc.QDCTemplate = template.Must(template.ParseFiles("./templates/wsls_qdc.xml"))
-
-	return &svc, nil
-}
-
-// HealthCheck will report health of this and associated services
-func (app *Apollo) healthCheck(c *gin.Context) {
-	err := app.DB.Ping()
+	svc.QDCTemplate, err = loadQDCTemplate(cfg.TemplateDir)
 	if err != nil {
-		log.Printf("ERROR: healthcheck failure: %s", err)
-		// gin.H is a shortcut for map[string]interface{}
-		c.JSON(http.StatusInternalServerError, gin.H{"alive": "true", "mysql": "false"})
-		return
+		return nil, fmt.Errorf("unable to load QDC template: %s", err.Error())
 	}
-	log.Printf("INFO: healthcheck OK")
-	c.JSON(http.StatusOK, gin.H{"alive": "true", "mysql": "true"})
-}
-
-// VersionInfo will report the version of the serivce
-func (app *Apollo) versionInfo(c *gin.Context) {
-	build := "unknown"
-
-	// cos our CWD is the bin directory
-	files, _ := filepath.Glob("../buildtag.*")
-	if len(files) == 1 {
-		build = strings.Replace(files[0], "../buildtag.", "", 1)
+	svc.Public, err = publicFS(cfg.PublicDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load frontend: %s", err.Error())
 	}
 
-	vMap := make(map[string]string)
-	vMap["version"] = app.Version
-	vMap["build"] = build
-	c.JSON(http.StatusOK, vMap)
+	return &svc, nil
+}
+
+// GetConfig shows the configuration the service is running with. Secrets are redacted.
+func (app *Apollo) GetConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, app.Config.redacted())
 }
 
 // IgnoreFavicon is a dummy to handle browser favicon requests without warnings
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// Suggestion is a single typeahead completion along with the number of nodes using it
+type Suggestion struct {
+	PID      string `db:"pid" json:"pid,omitempty"`
+	Value    string `db:"value" json:"value"`
+	ValueURI string `db:"value_uri" json:"valueURI,omitempty"`
+	Count    int    `db:"cnt" json:"count"`
+}
+
+// SuggestHandler returns prefix completions for the q query param. By default, completions
+// come from titles. If a type param is included, completions come from that type; for
+// controlled vocabulary types these are the controlled values themselves.
+func (app *Apollo) SuggestHandler(c *gin.Context) {
+	prefix := strings.TrimSpace(c.Query("q"))
+	if prefix == "" {
+		c.String(http.StatusBadRequest, "missing query term")
+		return
+	}
+	typeName := c.Query("type")
+	if typeName == "" {
+		typeName = "title"
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 || limit > 50 {
+		limit = 10
+	}
+
+	nodeType, err := app.repo(c).GetNodeType(typeName)
+	if err != nil {
+		requestLog(c).Printf("ERROR: suggest requested for unknown type %s: %s", typeName, err.Error())
+		c.String(http.StatusNotFound, typeName+" not found")
+		return
+	}
+	if nodeType.Container {
+		requestLog(c).Printf("ERROR: suggest requested for container type %s", typeName)
+		c.String(http.StatusBadRequest, typeName+" has no values")
+		return
+	}
+
+	requestLog(c).Printf("INFO: get %s suggestions for '%s'", typeName, prefix)
+	out, err := app.repo(c).GetSuggestions(nodeType, prefix, limit)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to get %s suggestions for '%s': %s", typeName, prefix, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// getSuggestions returns the most used values of a node type that start with prefix
+func getSuggestions(db *DB, nodeType *NodeType, prefix string, limit int) ([]Suggestion, error) {
+	out := make([]Suggestion, 0)
+	if nodeType.ControlledVocab == false {
+		err := db.Select(&out, `SELECT value, count(*) as cnt FROM nodes
+			WHERE node_type_id=? AND deleted=0 AND current=1 AND value LIKE ?
+			GROUP BY value ORDER BY cnt DESC, value ASC LIMIT ?`,
+			nodeType.ID, likePrefix(prefix), limit)
+		return out, err
+	}
+
+	// nodes hold the ID of their controlled value, so the matching values are found first and
+	// their use counted by ID. This uses the node type and value index instead of converting
+	// every ID in a join.
+	var values []struct {
+		ID int64 `db:"id"`
+		Suggestion
+	}
+	err := db.Select(&values, `SELECT id, pid, value, COALESCE(value_uri, '') as value_uri, 0 as cnt
+		FROM controlled_values WHERE node_type_id=? AND value LIKE ?`, nodeType.ID, likePrefix(prefix))
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for start := 0; start < len(values); start += resolveBatchSize {
+		end := min(start+resolveBatchSize, len(values))
+		ids := make([]string, 0, end-start)
+		for _, cv := range values[start:end] {
+			ids = append(ids, strconv.FormatInt(cv.ID, 10))
+		}
+		query, args, err := sqlx.In(`SELECT value, count(*) as cnt FROM nodes
+			WHERE node_type_id=? AND deleted=0 AND current=1 AND value IN (?) GROUP BY value`, nodeType.ID, ids)
+		if err != nil {
+			return nil, err
+		}
+		var used []Suggestion
+		err = db.Select(&used, db.Rebind(query), args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range used {
+			counts[u.Value] = u.Count
+		}
+	}
+	for _, cv := range values {
+		cv.Count = counts[strconv.FormatInt(cv.ID, 10)]
+		out = append(out, cv.Suggestion)
+	}
+	return topSuggestions(out, limit), nil
+}
+
+// topSuggestions sorts suggestions by count, most used first, then by value and returns the first limit
+func topSuggestions(out []Suggestion, limit int) []Suggestion {
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Count == out[j].Count {
+			return strings.ToLower(out[i].Value) < strings.ToLower(out[j].Value)
+		}
+		return out[i].Count > out[j].Count
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// likePrefix escapes LIKE wildcards in the user supplied prefix and makes it a prefix match
+func likePrefix(prefix string) string {
+	r := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return r.Replace(prefix) + "%"
+}
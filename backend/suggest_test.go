@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSuggest(t *testing.T) {
+	router := newTestRouter(t)
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/api/suggest?type=wslsPlace", http.StatusBadRequest},
+		{"/api/suggest?type=wslsPlace&q=%20", http.StatusBadRequest},
+		{"/api/suggest?type=item&q=a", http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		if resp := doRequest(router, "GET", tc.path, "", ""); resp.Code != tc.status {
+			t.Errorf("GET %s returned %d, expected %d: %s", tc.path, resp.Code, tc.status, resp.Body.String())
+		}
+	}
+
+	var out []Suggestion
+	checkJSON(t, doRequest(router, "GET", "/api/suggest?type=wslsPlace&q=(", "", ""), http.StatusOK, &out)
+	if len(out) != 0 {
+		t.Errorf("a prefix no value starts with has suggestions %+v", out)
+	}
+	// counts leave out nodes in the trash; a value nothing else uses is still suggested
+	resp := doRequest(router, "DELETE", "/api/nodes/uva-an109894?version="+currentVersion(t, router, "uva-an109894"), "", "user1")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("delete returned %d: %s", resp.Code, resp.Body.String())
+	}
+	checkJSON(t, doRequest(router, "GET", "/api/suggest?type=wslsPlace&q=roanoke", "", ""), http.StatusOK, &out)
+	if len(out) != 1 || out[0].Value != "Roanoke (Va.)" || out[0].Count != 1 || out[0].PID == "" {
+		t.Errorf("suggestions after the delete are %+v", out)
+	}
+	checkJSON(t, doRequest(router, "GET", "/api/suggest?type=wslsPlace&q=s", "", ""), http.StatusOK, &out)
+	if len(out) != 1 || out[0].Value != "Salem (Va.)" || out[0].Count != 0 {
+		t.Errorf("suggestions for a value only used in the trash are %+v", out)
+	}
+
+	checkJSON(t, doRequest(router, "GET", "/api/suggest?q=vol.%201&limit=2", "", ""), http.StatusOK, &out)
+	if len(out) != 2 || out[0].Value != "Vol. 1, 1909-1910" {
+		t.Errorf("limited title suggestions are %+v", out)
+	}
+}
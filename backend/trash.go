@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TrashEntry is a node that was deleted, along with the number of descendants that were deleted with it
+type TrashEntry struct {
+	ID          int64     `db:"id" json:"id"`
+	PID         string    `db:"pid" json:"pid"`
+	Type        string    `db:"type" json:"type"`
+	Title       string    `db:"title" json:"title,omitempty"`
+	Value       string    `db:"value" json:"value,omitempty"`
+	DeletedAt   time.Time `db:"deleted_at" json:"deletedAt"`
+	Descendants int       `db:"descendants" json:"descendants"`
+	Version     string    `db:"-" json:"version"`
+}
+
+// subtreeFilter matches a node, its revisions and all of its descendants. It takes 4 params;
+// the node ID, the revision PID pattern, the child ancestry and the descendant ancestry pattern.
+const subtreeFilter = "(id=? or pid LIKE ? or ancestry=? or ancestry LIKE ?)"
+
+// subtreeArgs returns the params for subtreeFilter
+func subtreeArgs(node *moveNode) []interface{} {
+	return []interface{}{node.ID, node.PID + ".%", node.childAncestry(), node.childAncestry() + "/%"}
+}
+
+// DeleteNode marks a node and all of its descendants as deleted. They can be restored from the trash
+// until they are purged. The version of the node is required in the If-Match header or version param.
+func (app *Apollo) DeleteNode(c *gin.Context) {
+	nodeIDs, dbErr := app.repo(c).LookupIdentifier(c.Param("id"))
+	if dbErr != nil {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
+		return
+	}
+	version := requestVersion(c, "")
+	if versionMissing(c, version) {
+		return
+	}
+
+	requestLog(c).Printf("INFO: %s requests delete of %s", c.GetString("computingID"), nodeIDs.PID)
+	cnt, err := app.repo(c).DeleteNode(nodeIDs.ID, version, c.GetString("computingID"))
+	if err != nil {
+		app.changeFailed(c, err, 0)
+		return
+	}
+	requestLog(c).Printf("INFO: %s and %d related nodes moved to trash", nodeIDs.PID, cnt-1)
+	c.String(http.StatusOK, "deleted")
+}
+
+// RestoreNode restores a deleted node along with all descendants that were deleted with it. The version
+// of the node from the trash listing is required in the If-Match header or version param.
+func (app *Apollo) RestoreNode(c *gin.Context) {
+	nodeIDs, dbErr := app.repo(c).LookupTrashed(c.Param("id"))
+	if dbErr != nil {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
+		return
+	}
+	version := requestVersion(c, "")
+	if versionMissing(c, version) {
+		return
+	}
+
+	requestLog(c).Printf("INFO: %s requests restore of %s", c.GetString("computingID"), nodeIDs.PID)
+	cnt, err := app.repo(c).RestoreNode(nodeIDs.ID, version, c.GetString("computingID"))
+	if err != nil {
+		app.changeFailed(c, err, 0)
+		return
+	}
+	requestLog(c).Printf("INFO: %s and %d related nodes restored from trash", nodeIDs.PID, cnt-1)
+	c.String(http.StatusOK, "restored")
+}
+
+// GetCollectionTrash lists the deleted nodes in a collection, newest first. Descendants deleted
+// along with a node are not listed separately; they are included in its descendants count.
+func (app *Apollo) GetCollectionTrash(c *gin.Context) {
+	pid := c.Param("pid")
+	collIDs, dbErr := app.repo(c).LookupIdentifier(pid)
+	if dbErr != nil {
+		requestLog(c).Printf("ERROR: %s", dbErr.Error())
+		c.String(http.StatusNotFound, dbErr.Error())
+		return
+	}
+
+	requestLog(c).Printf("INFO: get trash for collection %s", collIDs.PID)
+	out, err := app.repo(c).GetTrash(collIDs.ID)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to get trash for %s: %s", collIDs.PID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// PurgeTrash permanently removes nodes that have been in the trash longer than the configured
+// number of days. The days query param overrides the configured value.
+func (app *Apollo) PurgeTrash(c *gin.Context) {
+	days := app.TrashDays
+	if c.Query("days") != "" {
+		var err error
+		days, err = strconv.Atoi(c.Query("days"))
+		if err != nil || days < 0 {
+			c.String(http.StatusBadRequest, fmt.Sprintf("%s is not a valid number of days", c.Query("days")))
+			return
+		}
+	}
+
+	requestLog(c).Printf("INFO: %s requests purge of trash older than %d days", c.GetString("computingID"), days)
+	cnt, err := app.repo(c).PurgeTrash(days, c.GetString("computingID"))
+	if err != nil {
+		app.changeFailed(c, err, 0)
+		return
+	}
+	requestLog(c).Printf("INFO: %d nodes purged from trash", cnt)
+	c.JSON(http.StatusOK, gin.H{"purged": cnt})
+}
+
+// deleteNode moves a node and its descendants to the trash and returns the number of nodes deleted
+func deleteNode(db *DB, nodeID int64, version string, computingID string) (int64, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	node, err := getMoveNode(tx, nodeID)
+	if err != nil {
+		return 0, refuseChange(http.StatusNotFound, "node %d not found", nodeID)
+	}
+	if node.ParentID.Valid == false {
+		return 0, refuseChange(http.StatusBadRequest, "%s is a collection and cannot be deleted", node.PID)
+	}
+	err = checkVersion(tx, node.ID, version)
+	if err != nil {
+		return 0, err
+	}
+
+	// all nodes deleted together share a deleted_at timestamp. This is used to restore them as a group
+	qs := fmt.Sprintf("UPDATE nodes SET deleted=1, deleted_at=NOW(6), updated_at=NOW(6) WHERE deleted=0 and %s", subtreeFilter)
+	res, err := tx.Exec(qs, subtreeArgs(node)...)
+	if err != nil {
+		return 0, err
+	}
+	cnt, _ := res.RowsAffected()
+	err = logAudit(tx, auditRecord(computingID, "delete", node, nodeTypeName(tx, db.Log, node.ID),
+		"deleted", "", fmt.Sprintf("%d nodes", cnt)))
+	if err != nil {
+		return 0, fmt.Errorf("unable to audit delete of %s: %s", node.PID, err.Error())
+	}
+	return cnt, tx.Commit()
+}
+
+// restoreNode restores a node from the trash along with the descendants deleted with it and returns
+// the number of nodes restored
+func restoreNode(db *DB, nodeID int64, version string, computingID string) (int64, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var node moveNode
+	var deletedAt time.Time
+	row := tx.QueryRowx(`SELECT id, pid, parent_id, ancestry, deleted_at FROM nodes
+		WHERE id=? and deleted=1 and current=1 FOR UPDATE`, nodeID)
+	err = row.Scan(&node.ID, &node.PID, &node.ParentID, &node.Ancestry, &deletedAt)
+	if err != nil {
+		return 0, refuseChange(http.StatusNotFound, "node %d is not in the trash", nodeID)
+	}
+	err = checkVersion(tx, node.ID, version)
+	if err != nil {
+		return 0, err
+	}
+
+	var parentDeleted bool
+	err = tx.Get(&parentDeleted, "SELECT deleted FROM nodes WHERE id=?", node.ParentID.Int64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get parent of %s: %s", node.PID, err.Error())
+	}
+	if parentDeleted {
+		return 0, refuseChange(http.StatusConflict, "the parent of %s is deleted and must be restored first", node.PID)
+	}
+
+	qs := fmt.Sprintf("UPDATE nodes SET deleted=0, deleted_at=NULL, updated_at=NOW(6) WHERE deleted=1 and deleted_at=? and %s", subtreeFilter)
+	args := append([]interface{}{deletedAt}, subtreeArgs(&node)...)
+	res, err := tx.Exec(qs, args...)
+	if err != nil {
+		return 0, err
+	}
+	cnt, _ := res.RowsAffected()
+	err = logAudit(tx, auditRecord(computingID, "restore", &node, nodeTypeName(tx, db.Log, node.ID),
+		"deleted", deletedAt.Format(time.RFC3339), fmt.Sprintf("%d nodes", cnt)))
+	if err != nil {
+		return 0, fmt.Errorf("unable to audit restore of %s: %s", node.PID, err.Error())
+	}
+	return cnt, tx.Commit()
+}
+
+// purgeTrash permanently removes nodes deleted more than days ago and returns the number removed
+func purgeTrash(db *DB, days int, computingID string) (int64, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// the change feed reports the deletion of purged containers from their tombstones
+	_, err = tx.Exec(`INSERT INTO node_tombstones (node_id, pid, ancestry, created_at, deleted_at)
+		SELECT n.id, n.pid, n.ancestry, n.created_at, n.deleted_at FROM nodes n
+		INNER JOIN node_types nt ON nt.id = n.node_type_id
+		WHERE nt.container=1 and n.current=1 and n.deleted=1 and n.deleted_at < DATE_SUB(NOW(), INTERVAL ? DAY)`, days)
+	if err != nil {
+		return 0, fmt.Errorf("unable to keep tombstones for purged nodes: %s", err.Error())
+	}
+	res, err := tx.Exec("DELETE FROM nodes WHERE deleted=1 and deleted_at < DATE_SUB(NOW(), INTERVAL ? DAY)", days)
+	if err != nil {
+		return 0, err
+	}
+	cnt, _ := res.RowsAffected()
+	if cnt > 0 {
+		err = logAudit(tx, purgeRecord(computingID, days, cnt))
+		if err != nil {
+			return 0, fmt.Errorf("unable to audit trash purge: %s", err.Error())
+		}
+	}
+	return cnt, tx.Commit()
+}
+
+// purgeRecord builds the audit entry for a trash purge
+func purgeRecord(computingID string, days int, cnt int64) AuditEntry {
+	return AuditEntry{ComputingID: computingID, Action: "purge", Field: "trash",
+		OldValue: fmt.Sprintf("older than %d days", days), NewValue: fmt.Sprintf("%d nodes purged", cnt)}
+}
+
+func getTrash(db *DB, collectionID int64) ([]TrashEntry, error) {
+	// A trash entry is a deleted node whose parent was not deleted along with it
+	qs := `SELECT n.id, n.pid, nt.name as type, COALESCE(n.value, '') as value, n.deleted_at,
+		COALESCE((SELECT t.value FROM nodes t
+			WHERE t.parent_id=n.id and t.node_type_id=2 and t.current=1
+			ORDER BY t.sequence ASC LIMIT 1), '') as title,
+		(SELECT count(*) FROM nodes d WHERE d.deleted=1 and d.current=1 and d.deleted_at=n.deleted_at and
+			(d.ancestry=CONCAT(n.ancestry, '/', n.id) or d.ancestry LIKE CONCAT(n.ancestry, '/', n.id, '/%'))) as descendants
+		FROM nodes n
+		INNER JOIN node_types nt ON nt.id = n.node_type_id
+		INNER JOIN nodes p ON p.id = n.parent_id
+		WHERE n.deleted=1 and n.current=1 and (p.deleted=0 or p.deleted_at <> n.deleted_at)
+			and (n.ancestry=? or n.ancestry LIKE ?)
+		ORDER BY n.deleted_at DESC, n.id ASC`
+	out := make([]TrashEntry, 0)
+	collAncestry := fmt.Sprintf("%d", collectionID)
+	err := db.Select(&out, qs, collAncestry, collAncestry+"/%")
+	if err != nil {
+		return nil, err
+	}
+
+	// restoring an entry requires its version
+	nodeIDs := make([]int64, 0, len(out))
+	for _, entry := range out {
+		nodeIDs = append(nodeIDs, entry.ID)
+	}
+	versions, err := nodeVersions(db, nodeIDs)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range out {
+		out[idx].Version = versions[out[idx].ID]
+	}
+	return out, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// listTrash returns the trash of a collection from the API
+func listTrash(t *testing.T, router http.Handler, pid string) []TrashEntry {
+	t.Helper()
+	var out []TrashEntry
+	checkJSON(t, doRequest(router, "GET", "/api/collections/"+pid+"/trash", "", ""), http.StatusOK, &out)
+	return out
+}
+
+func TestDeleteRestore(t *testing.T) {
+	router := newTestRouter(t)
+	version := currentVersion(t, router, "uva-an12")
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"DELETE", "/api/nodes/uva-an12", http.StatusPreconditionRequired},
+		{"DELETE", "/api/nodes/uva-an12?version=stale", http.StatusConflict},
+		{"DELETE", "/api/nodes/uva-an1?version=any", http.StatusBadRequest},
+		{"POST", "/api/nodes/uva-an12/restore?version=" + version, http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		resp := doRequest(router, tc.method, tc.path, "", "user1")
+		if resp.Code != tc.status {
+			t.Errorf("%s %s returned %d, expected %d: %s", tc.method, tc.path, resp.Code, tc.status, resp.Body.String())
+		}
+	}
+	if trash := listTrash(t, router, "uva-an1"); len(trash) != 0 {
+		t.Fatalf("trash has %d entries before anything was deleted", len(trash))
+	}
+
+	// the version can be sent as an ETag in If-Match
+	req := httptest.NewRequest("DELETE", "/api/nodes/uva-an12", nil)
+	req.Header.Set("remote_user", "user1")
+	req.Header.Set("If-Match", `"`+version+`"`)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("delete returned %d: %s", resp.Code, resp.Body.String())
+	}
+	for _, path := range []string{"/api/items/uva-an12", "/api/items/uva-an12/context", "/api/nodes/uva-an12/children"} {
+		if resp := doRequest(router, "GET", path, "", ""); resp.Code != http.StatusNotFound {
+			t.Errorf("GET %s of a deleted item returned %d, expected %d", path, resp.Code, http.StatusNotFound)
+		}
+	}
+	if got := childPIDs(getChildPage(t, router, "uva-an9")); len(got) != 1 || got[0] != "uva-an16" {
+		t.Errorf("vol 1 has children %v after the delete", got)
+	}
+
+	trash := listTrash(t, router, "uva-an1")
+	if len(trash) != 1 {
+		t.Fatalf("trash has %d entries after the delete, expected 1", len(trash))
+	}
+	entry := trash[0]
+	if entry.PID != "uva-an12" || entry.Type != "issue" || entry.Descendants != 3 || entry.Version == "" {
+		t.Errorf("unexpected trash entry %+v", entry)
+	}
+
+	resp = doRequest(router, "POST", "/api/nodes/uva-an12/restore?version=stale", "", "user1")
+	if resp.Code != http.StatusConflict {
+		t.Errorf("stale restore returned %d, expected %d", resp.Code, http.StatusConflict)
+	}
+	resp = doRequest(router, "POST", "/api/nodes/uva-an12/restore?version="+entry.Version, "", "user1")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("restore returned %d: %s", resp.Code, resp.Body.String())
+	}
+	if resp := doRequest(router, "GET", "/api/items/uva-an12", "", ""); resp.Code != http.StatusOK {
+		t.Errorf("restored item returned %d: %s", resp.Code, resp.Body.String())
+	}
+	if trash := listTrash(t, router, "uva-an1"); len(trash) != 0 {
+		t.Errorf("trash has %d entries after the restore", len(trash))
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	router := newTestRouter(t)
+	resp := doRequest(router, "DELETE", "/api/nodes/uva-an16?version="+currentVersion(t, router, "uva-an16"), "", "user1")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("delete returned %d: %s", resp.Code, resp.Body.String())
+	}
+
+	tests := []struct {
+		path   string
+		purged int
+	}{
+		// nothing has been in the trash for a day yet
+		{"/api/admin/trash?days=1", 0},
+		{"/api/admin/trash?days=0", 4},
+		{"/api/admin/trash?days=0", 0},
+	}
+	for _, tc := range tests {
+		var out struct {
+			Purged int `json:"purged"`
+		}
+		checkJSON(t, doRequest(router, "DELETE", tc.path, "", "admin1"), http.StatusOK, &out)
+		if out.Purged != tc.purged {
+			t.Errorf("DELETE %s purged %d nodes, expected %d", tc.path, out.Purged, tc.purged)
+		}
+	}
+	if trash := listTrash(t, router, "uva-an1"); len(trash) != 0 {
+		t.Errorf("trash has %d entries after the purge", len(trash))
+	}
+	resp = doRequest(router, "DELETE", "/api/admin/trash?days=-1", "", "admin1")
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("purge with negative days returned %d, expected %d", resp.Code, http.StatusBadRequest)
+	}
+}
@@ -50,17 +50,19 @@ type ControlledValue struct {
 // single PID.
 type Node struct {
 	NodeIdentifier
-	Parent    *Node          `json:"-"`
-	Sequence  int            `json:"sequence"`
-	Type      *NodeType      `json:"type"`
-	Value     string         `json:"value,omitempty"`
-	ValueURI  string         `json:"valueURI,omitempty"`
-	Children  []*Node        `json:"children,omitempty"`
-	Deleted   bool           `json:"-"`
-	Current   bool           `json:"-"`
-	CreatedAt time.Time      `db:"created_at" json:"createdAt"`
-	UpdatedAt *time.Time     `db:"updated_at" json:"updatedAt,omitempty"`
-	Ancestry  sql.NullString `json:"-"`
+	Parent     *Node          `json:"-"`
+	Sequence   int            `json:"sequence"`
+	Type       *NodeType      `json:"type"`
+	Value      string         `json:"value,omitempty"`
+	ValueURI   string         `json:"valueURI,omitempty"`
+	Children   []*Node        `json:"children,omitempty"`
+	ChildCount int            `json:"childCount,omitempty"`
+	Deleted    bool           `json:"-"`
+	Current    bool           `json:"-"`
+	CreatedAt  time.Time      `db:"created_at" json:"createdAt"`
+	UpdatedAt  *time.Time     `db:"updated_at" json:"updatedAt,omitempty"`
+	Ancestry   sql.NullString `json:"-"`
+	Version    string         `json:"-"`
 }
 
 func (n *Node) encodeValue(val string) string {
@@ -74,24 +76,28 @@ func (n *Node) encodeValue(val string) string {
 // MarshalJSON will encode the Node structure as JSON
 func (n *Node) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&struct {
-		ID        int64      `json:"id"`
-		PID       string     `json:"pid"`
-		Sequence  int        `json:"sequence"`
-		Type      *NodeType  `json:"type"`
-		Value     string     `json:"value,omitempty"`
-		ValueURI  string     `json:"valueURI,omitempty"`
-		CreatedAt time.Time  `db:"created_at" json:"createdAt"`
-		UpdatedAt *time.Time `db:"updated_at" json:"updatedAt,omitempty"`
-		Children  []*Node    `json:"children,omitempty"`
+		ID         int64      `json:"id"`
+		PID        string     `json:"pid"`
+		Sequence   int        `json:"sequence"`
+		Type       *NodeType  `json:"type"`
+		Value      string     `json:"value,omitempty"`
+		ValueURI   string     `json:"valueURI,omitempty"`
+		CreatedAt  time.Time  `db:"created_at" json:"createdAt"`
+		UpdatedAt  *time.Time `db:"updated_at" json:"updatedAt,omitempty"`
+		Children   []*Node    `json:"children,omitempty"`
+		ChildCount int        `json:"childCount,omitempty"`
+		Version    string     `json:"version,omitempty"`
 	}{
-		ID:        n.ID,
-		PID:       n.PID,
-		Sequence:  n.Sequence,
-		Type:      n.Type,
-		Value:     n.encodeValue(n.Value),
-		ValueURI:  n.ValueURI,
-		CreatedAt: n.CreatedAt,
-		UpdatedAt: n.UpdatedAt,
-		Children:  n.Children,
+		ID:         n.ID,
+		PID:        n.PID,
+		Sequence:   n.Sequence,
+		Type:       n.Type,
+		Value:      n.encodeValue(n.Value),
+		ValueURI:   n.ValueURI,
+		CreatedAt:  n.CreatedAt,
+		UpdatedAt:  n.UpdatedAt,
+		Children:   n.Children,
+		ChildCount: n.ChildCount,
+		Version:    n.Version,
 	})
 }
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// webhookEvents are the events that can be sent to webhook subscribers
+var webhookEvents = []string{"created", "edited", "moved", "deleted", "restored", "published"}
+
+// auditEvents maps audit log actions to the webhook event they trigger
+var auditEvents = map[string]string{
+	"update": "edited", "move": "moved", "reorder": "moved", "delete": "deleted", "restore": "restored",
+}
+
+// createdScanLag is how far behind the current time the scan for created containers stays, so
+// that nodes written by an ingest that is still running are left for a later scan
+const createdScanLag = 5 * time.Minute
+
+// maxDeliveryAttempts is the number of times delivery of an event is tried before it is marked failed
+const maxDeliveryAttempts = 8
+
+// claimTimeout is how long a delivery stays claimed by a worker. Deliveries still being sent after
+// this, such as by an instance that stopped mid-send, are returned to the other workers.
+const claimTimeout = 10 * time.Minute
+
+// deliveryStatuses are the states of a delivery in the outbox
+var deliveryStatuses = []string{"pending", "sending", "delivered", "failed"}
+
+// errClaimLost is returned when a delivery result is recorded by a worker that no longer holds
+// the claim on it. The worker that took over the claim records its own result instead.
+var errClaimLost = errors.New("delivery is no longer claimed by this worker")
+
+// Webhook is a subscriber that receives events for one collection, or all collections if none is set
+type Webhook struct {
+	ID            int64         `db:"id" json:"id"`
+	URL           string        `db:"url" json:"url"`
+	Secret        string        `db:"secret" json:"secret,omitempty"`
+	CollectionID  sql.NullInt64 `db:"collection_id" json:"-"`
+	CollectionPID string        `db:"collection_pid" json:"collection,omitempty"`
+	Events        string        `db:"events" json:"-"`
+	EventList     []string      `db:"-" json:"events"`
+	Active        bool          `db:"active" json:"active"`
+	ComputingID   string        `db:"computing_id" json:"createdBy"`
+	CreatedAt     time.Time     `db:"created_at" json:"createdAt"`
+	Pending       int           `db:"pending" json:"pending"`
+	Delivered     int           `db:"delivered" json:"delivered"`
+	Failed        int           `db:"failed" json:"failed"`
+}
+
+// WebhookEvent is the json body posted to webhook subscribers
+type WebhookEvent struct {
+	Event      string    `json:"event"`
+	Collection string    `json:"collection,omitempty"`
+	PID        string    `json:"pid,omitempty"`
+	NodeType   string    `json:"nodeType,omitempty"`
+	User       string    `json:"user"`
+	Field      string    `json:"field,omitempty"`
+	OldValue   string    `json:"oldValue,omitempty"`
+	NewValue   string    `json:"newValue,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	Count      int       `json:"count,omitempty"`
+	OccurredAt time.Time `json:"occurredAt"`
+}
+
+// createdNode is a container found by the scan for newly created nodes
+type createdNode struct {
+	ID        int64          `db:"id"`
+	PID       string         `db:"pid"`
+	Ancestry  sql.NullString `db:"ancestry"`
+	NodeType  string         `db:"node_type"`
+	CreatedAt time.Time      `db:"created_at"`
+}
+
+// createdEvent is a created event along with the ID of the collection it happened in
+type createdEvent struct {
+	CollectionID int64
+	Event        WebhookEvent
+}
+
+// WebhookDelivery is the delivery status of one event to one subscriber
+type WebhookDelivery struct {
+	ID            int64          `db:"id" json:"id"`
+	WebhookID     int64          `db:"webhook_id" json:"webhook"`
+	URL           string         `db:"url" json:"-"`
+	Secret        string         `db:"secret" json:"-"`
+	Event         string         `db:"event" json:"event"`
+	Payload       string         `db:"payload" json:"payload"`
+	Status        string         `db:"status" json:"status"`
+	ClaimedBy     sql.NullString `db:"claimed_by" json:"-"`
+	ClaimedAt     *time.Time     `db:"claimed_at" json:"-"`
+	Attempts      int            `db:"attempts" json:"attempts"`
+	NextAttemptAt time.Time      `db:"next_attempt_at" json:"nextAttemptAt"`
+	LastStatus    sql.NullInt64  `db:"last_status" json:"-"`
+	LastError     sql.NullString `db:"last_error" json:"-"`
+	CreatedAt     time.Time      `db:"created_at" json:"createdAt"`
+	DeliveredAt   *time.Time     `db:"delivered_at" json:"deliveredAt,omitempty"`
+}
+
+// MarshalJSON flattens the nullable delivery results
+func (d *WebhookDelivery) MarshalJSON() ([]byte, error) {
+	type delivery WebhookDelivery
+	return json.Marshal(&struct {
+		*delivery
+		LastStatus int    `json:"lastStatus,omitempty"`
+		LastError  string `json:"lastError,omitempty"`
+	}{delivery: (*delivery)(d), LastStatus: int(d.LastStatus.Int64), LastError: d.LastError.String})
+}
+
+// queueWebhookEvent adds an event to the outbox for every active subscriber that wants it.
+// It must be called in the same transaction as the change that caused the event.
+func queueWebhookEvent(tx *sqlx.Tx, collectionID int64, evt WebhookEvent) error {
+	if evt.Collection == "" && collectionID > 0 {
+		err := tx.Get(&evt.Collection, "SELECT pid FROM nodes WHERE id=?", collectionID)
+		if err != nil {
+			return err
+		}
+	}
+	if evt.OccurredAt.IsZero() {
+		evt.OccurredAt = time.Now().UTC()
+	}
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO webhook_deliveries (webhook_id, event, payload, status, attempts, next_attempt_at, created_at)
+		SELECT id, ?, ?, 'pending', 0, NOW(6), NOW(6) FROM webhooks
+		WHERE active=1 and (collection_id IS NULL or collection_id=?) and (events='' or FIND_IN_SET(?, events))`,
+		evt.Event, string(payload), collectionID, evt.Event)
+	return err
+}
+
+// auditWebhookEvent converts an audit entry into the webhook event for it, if there is one
+func auditWebhookEvent(entry AuditEntry) (WebhookEvent, bool) {
+	name, ok := auditEvents[entry.Action]
+	if !ok {
+		return WebhookEvent{}, false
+	}
+	return WebhookEvent{Event: name, PID: entry.NodePID, NodeType: entry.NodeType, User: entry.ComputingID,
+		Field: entry.Field, OldValue: entry.OldValue, NewValue: entry.NewValue}, true
+}
+
+// createdEvents returns a created event for each new container whose parent is not also new,
+// so an ingest sends one event for each collection or subtree it adds. Count is the number of
+// new containers in the subtree, its root included. Nodes must be in ID order.
+func createdEvents(nodes []createdNode) []createdEvent {
+	out := make([]createdEvent, 0)
+	isNew := make(map[int64]bool)
+	eventIdx := make(map[int64]int)
+	for _, n := range nodes {
+		isNew[n.ID] = true
+		rootID := n.ID
+		if n.Ancestry.String != "" {
+			for _, idStr := range strings.Split(n.Ancestry.String, "/") {
+				ancestorID, _ := strconv.ParseInt(idStr, 10, 64)
+				if isNew[ancestorID] {
+					rootID = ancestorID
+					break
+				}
+			}
+		}
+		if rootID != n.ID {
+			out[eventIdx[rootID]].Event.Count++
+			continue
+		}
+		eventIdx[n.ID] = len(out)
+		out = append(out, createdEvent{CollectionID: ancestryRootID(n.ID, n.Ancestry.String),
+			Event: WebhookEvent{Event: "created", PID: n.PID, NodeType: n.NodeType, Count: 1, OccurredAt: n.CreatedAt}})
+	}
+	return out
+}
+
+// ListWebhooks returns all webhook subscribers along with a count of their deliveries by status
+func (app *Apollo) ListWebhooks(c *gin.Context) {
+	requestLog(c).Printf("INFO: list webhooks")
+	out, err := app.repo(c).GetWebhooks()
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to list webhooks: %s", err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	for idx := range out {
+		out[idx].EventList = splitEvents(out[idx].Events)
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// AddWebhook registers a webhook subscriber. Request json: {"url": "...", "collection": "PID", "events": ["edited"], "secret": "..."}.
+// Collection and events are optional; without them the subscriber gets all events for all collections.
+// If no secret is supplied one is generated. The secret is only returned in this response.
+func (app *Apollo) AddWebhook(c *gin.Context) {
+	var req struct {
+		URL        string   `json:"url"`
+		Collection string   `json:"collection"`
+		Events     []string `json:"events"`
+		Secret     string   `json:"secret"`
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		requestLog(c).Printf("ERROR: invalid webhook request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	hookURL, err := url.Parse(req.URL)
+	if err != nil || (hookURL.Scheme != "http" && hookURL.Scheme != "https") || hookURL.Host == "" {
+		c.String(http.StatusBadRequest, fmt.Sprintf("%s is not a valid http(s) url", req.URL))
+		return
+	}
+	for _, evt := range req.Events {
+		if isWebhookEvent(evt) == false {
+			c.String(http.StatusBadRequest, fmt.Sprintf("events must be from %s", strings.Join(webhookEvents, ", ")))
+			return
+		}
+	}
+
+	hook := Webhook{URL: req.URL, Secret: req.Secret, Events: strings.Join(req.Events, ","),
+		EventList: splitEvents(strings.Join(req.Events, ",")), Active: true, ComputingID: c.GetString("computingID")}
+	if req.Collection != "" {
+		collIDs, dbErr := app.repo(c).LookupIdentifier(req.Collection)
+		if dbErr != nil {
+			requestLog(c).Printf("ERROR: %s", dbErr.Error())
+			c.String(http.StatusNotFound, dbErr.Error())
+			return
+		}
+		hook.CollectionID = sql.NullInt64{Int64: collIDs.ID, Valid: true}
+		hook.CollectionPID = collIDs.PID
+	}
+	if hook.Secret == "" {
+		buf := make([]byte, 32)
+		_, err = rand.Read(buf)
+		if err != nil {
+			requestLog(c).Printf("ERROR: unable to generate webhook secret: %s", err.Error())
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		hook.Secret = hex.EncodeToString(buf)
+	}
+
+	requestLog(c).Printf("INFO: %s adds webhook %s for collection [%s]", hook.ComputingID, hook.URL, hook.CollectionPID)
+	err = app.repo(c).AddWebhook(&hook)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to add webhook %s: %s", hook.URL, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, hook)
+}
+
+// DeleteWebhook removes a webhook subscriber along with all of its deliveries
+func (app *Apollo) DeleteWebhook(c *gin.Context) {
+	hookID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	requestLog(c).Printf("INFO: %s deletes webhook %d", c.GetString("computingID"), hookID)
+	found, err := app.repo(c).DeleteWebhook(hookID)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to delete webhook %d: %s", hookID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if found == false {
+		c.String(http.StatusNotFound, fmt.Sprintf("webhook %s not found", c.Param("id")))
+		return
+	}
+	c.String(http.StatusOK, "deleted")
+}
+
+// GetWebhookDeliveries returns the most recent deliveries for a webhook, newest first.
+// Filter them with the status param (pending, sending, delivered or failed) and limit the count with limit.
+func (app *Apollo) GetWebhookDeliveries(c *gin.Context) {
+	hookID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	if status := c.Query("status"); status != "" && isDeliveryStatus(status) == false {
+		c.String(http.StatusBadRequest, fmt.Sprintf("status must be one of %s", strings.Join(deliveryStatuses, ", ")))
+		return
+	}
+
+	requestLog(c).Printf("INFO: get deliveries for webhook %d", hookID)
+	out, err := app.repo(c).GetWebhookDeliveries(hookID, c.Query("status"), limit)
+	if err != nil {
+		requestLog(c).Printf("ERROR: unable to get deliveries for webhook %d: %s", hookID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// deliverWebhooks sends pending events from the outbox every interval until the context is
+// canceled. A delivery in progress is finished; the rest are sent after the next startup.
+func (app *Apollo) deliverWebhooks(ctx context.Context, interval time.Duration) {
+	worker := webhookWorkerID()
+	log.Printf("INFO: deliver webhook events every %s as %s", interval, worker)
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("INFO: stop webhook delivery")
+			return
+		case <-ticker.C:
+		}
+		app.deliverDue(ctx, client, worker)
+	}
+}
+
+// deliverDue queues events for containers created since the last scan, then claims the deliveries
+// that are due and sends them. When the context is canceled
+// the deliveries not yet sent are released for the next worker.
+func (app *Apollo) deliverDue(ctx context.Context, client *http.Client, worker string) {
+	created, err := app.Repo.QueueCreatedEvents()
+	if err != nil {
+		log.Printf("ERROR: unable to queue created events: %s", err.Error())
+	} else if created > 0 {
+		log.Printf("INFO: queued %d created events", created)
+	}
+
+	due, err := app.Repo.ClaimDeliveries(worker, 100)
+	if err != nil {
+		log.Printf("ERROR: unable to claim pending webhook deliveries: %s", err.Error())
+		return
+	}
+	for idx := range due {
+		if ctx.Err() != nil {
+			err = app.Repo.ReleaseDeliveries(worker)
+			if err != nil {
+				log.Printf("ERROR: unable to release webhook deliveries claimed by %s: %s", worker, err.Error())
+			}
+			return
+		}
+		app.deliverWebhook(client, &due[idx])
+	}
+}
+
+// webhookWorkerID identifies this delivery worker in the claims it makes
+func webhookWorkerID() string {
+	host, _ := os.Hostname()
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(buf))
+}
+
+// deliverWebhook posts a single event and records the result. Failures are retried with
+// exponential backoff until maxDeliveryAttempts is reached.
+func (app *Apollo) deliverWebhook(client *http.Client, delivery *WebhookDelivery) {
+	delivery.Attempts++
+	httpStatus, err := postWebhook(client, delivery)
+	delivery.LastStatus = sql.NullInt64{Int64: int64(httpStatus), Valid: httpStatus != 0}
+	retryIn := time.Duration(0)
+	if err == nil {
+		delivery.Status = "delivered"
+		delivery.LastError = sql.NullString{}
+	} else {
+		log.Printf("WARNING: delivery %d of %s to %s failed on attempt %d: %s", delivery.ID, delivery.Event,
+			delivery.URL, delivery.Attempts, err.Error())
+		delivery.Status = "pending"
+		if delivery.Attempts >= maxDeliveryAttempts {
+			delivery.Status = "failed"
+		}
+		delivery.LastError = sql.NullString{String: err.Error(), Valid: true}
+		retryIn = deliveryBackoff(delivery.Attempts)
+	}
+	err = app.Repo.RecordDelivery(delivery, retryIn)
+	if errors.Is(err, errClaimLost) {
+		log.Printf("WARNING: result of delivery %d discarded; its claim expired and was taken by another worker", delivery.ID)
+	} else if err != nil {
+		log.Printf("ERROR: unable to update webhook delivery %d: %s", delivery.ID, err.Error())
+	}
+}
+
+// deliveryBackoff is the wait before retrying a delivery that has failed the given number of
+// times. It starts at 30 seconds and doubles each time, up to 6 hours.
+func deliveryBackoff(attempts int) time.Duration {
+	backoff := time.Duration(30*math.Pow(2, float64(attempts-1))) * time.Second
+	if backoff > 6*time.Hour {
+		backoff = 6 * time.Hour
+	}
+	return backoff
+}
+
+// postWebhook posts the event payload signed with the subscriber secret. The signature is the
+// hex HMAC-SHA256 of the body in the X-Apollo-Signature header. Any 2xx response is a success.
+func postWebhook(client *http.Client, delivery *WebhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Apollo-Event", delivery.Event)
+	req.Header.Set("X-Apollo-Delivery", fmt.Sprintf("%d", delivery.ID))
+	req.Header.Set("X-Apollo-Signature", "sha256="+signPayload(delivery.Secret, delivery.Payload))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("%s responded %d", delivery.URL, resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// signPayload returns the hex HMAC-SHA256 of the payload using the webhook secret
+func signPayload(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func isWebhookEvent(name string) bool {
+	for _, evt := range webhookEvents {
+		if evt == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isDeliveryStatus(name string) bool {
+	for _, status := range deliveryStatuses {
+		if status == name {
+			return true
+		}
+	}
+	return false
+}
+
+func splitEvents(events string) []string {
+	if events == "" {
+		return webhookEvents
+	}
+	return strings.Split(events, ",")
+}
+
+// getWebhooks returns all webhook subscribers along with a count of their deliveries by status.
+// Secrets are not returned.
+func getWebhooks(db *DB) ([]Webhook, error) {
+	out := make([]Webhook, 0)
+	err := db.Select(&out, `SELECT w.id, w.url, '' as secret, w.collection_id, COALESCE(n.pid, '') as collection_pid,
+		w.events, w.active, w.computing_id, w.created_at,
+		(SELECT count(*) FROM webhook_deliveries d WHERE d.webhook_id=w.id and d.status IN ('pending', 'sending')) as pending,
+		(SELECT count(*) FROM webhook_deliveries d WHERE d.webhook_id=w.id and d.status='delivered') as delivered,
+		(SELECT count(*) FROM webhook_deliveries d WHERE d.webhook_id=w.id and d.status='failed') as failed
+		FROM webhooks w LEFT JOIN nodes n ON n.id = w.collection_id ORDER BY w.id ASC`)
+	return out, err
+}
+
+// addWebhook adds an active subscriber and sets its ID and creation time
+func addWebhook(db *DB, hook *Webhook) error {
+	hook.CreatedAt = time.Now().UTC()
+	res, err := db.Exec(`INSERT INTO webhooks (url, secret, collection_id, events, active, computing_id, created_at)
+		VALUES (?, ?, ?, ?, 1, ?, ?)`, hook.URL, hook.Secret, hook.CollectionID, hook.Events, hook.ComputingID, hook.CreatedAt)
+	if err != nil {
+		return err
+	}
+	hook.ID, _ = res.LastInsertId()
+	return nil
+}
+
+// deleteWebhook removes a subscriber; its deliveries are removed by the foreign key cascade.
+// It returns false if there is no such subscriber.
+func deleteWebhook(db *DB, hookID int64) (bool, error) {
+	res, err := db.Exec("DELETE FROM webhooks WHERE id=?", hookID)
+	if err != nil {
+		return false, err
+	}
+	cnt, _ := res.RowsAffected()
+	return cnt > 0, nil
+}
+
+// getWebhookDeliveries returns up to limit of the latest deliveries to a subscriber, all of them or
+// those with a status
+func getWebhookDeliveries(db *DB, hookID int64, status string, limit int) ([]*WebhookDelivery, error) {
+	qs := `SELECT d.*, '' as url, '' as secret FROM webhook_deliveries d WHERE d.webhook_id=?`
+	args := []interface{}{hookID}
+	if status != "" {
+		qs += " and d.status=?"
+		args = append(args, status)
+	}
+	args = append(args, limit)
+	out := make([]*WebhookDelivery, 0)
+	err := db.Select(&out, qs+" ORDER BY d.id DESC LIMIT ?", args...)
+	return out, err
+}
+
+// claimDeliveries marks up to limit due deliveries as being sent by the worker and returns them.
+// The claim is a single update, so workers on other instances never get the same deliveries.
+func claimDeliveries(db *DB, worker string, limit int) ([]WebhookDelivery, error) {
+	_, err := db.Exec(`UPDATE webhook_deliveries SET status='sending', claimed_by=?, claimed_at=NOW(6)
+		WHERE ((status='pending' and next_attempt_at <= NOW(6)) or
+			(status='sending' and claimed_at < DATE_SUB(NOW(6), INTERVAL ? SECOND)))
+		and webhook_id IN (SELECT id FROM webhooks WHERE active=1)
+		ORDER BY id ASC LIMIT ?`, worker, int(claimTimeout.Seconds()), limit)
+	if err != nil {
+		return nil, err
+	}
+	var due []WebhookDelivery
+	err = db.Select(&due, `SELECT d.*, w.url, w.secret FROM webhook_deliveries d
+		INNER JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status='sending' and d.claimed_by=? ORDER BY d.id ASC`, worker)
+	return due, err
+}
+
+// releaseDeliveries returns the deliveries still claimed by the worker to the pending list
+func releaseDeliveries(db *DB, worker string) error {
+	_, err := db.Exec(`UPDATE webhook_deliveries SET status='pending', claimed_by=NULL, claimed_at=NULL
+		WHERE status='sending' and claimed_by=?`, worker)
+	return err
+}
+
+// recordDelivery saves the result of an attempt to send a delivery and clears its claim. A delivery
+// that is not delivered is tried again after retryIn. Only the worker that holds the claim can
+// record a result; any other gets errClaimLost, so an attempt is never counted twice.
+func recordDelivery(db *DB, delivery *WebhookDelivery, retryIn time.Duration) error {
+	var res sql.Result
+	var err error
+	if delivery.Status == "delivered" {
+		res, err = db.Exec(`UPDATE webhook_deliveries SET status='delivered', claimed_by=NULL, claimed_at=NULL,
+			attempts=?, last_status=?, last_error=NULL, delivered_at=NOW(6)
+			WHERE id=? and status='sending' and claimed_by=?`,
+			delivery.Attempts, delivery.LastStatus, delivery.ID, delivery.ClaimedBy.String)
+	} else {
+		res, err = db.Exec(`UPDATE webhook_deliveries SET status=?, claimed_by=NULL, claimed_at=NULL,
+			attempts=?, last_status=?, last_error=?, next_attempt_at=DATE_ADD(NOW(6), INTERVAL ? SECOND)
+			WHERE id=? and status='sending' and claimed_by=?`,
+			delivery.Status, delivery.Attempts, delivery.LastStatus, delivery.LastError, int(retryIn.Seconds()),
+			delivery.ID, delivery.ClaimedBy.String)
+	}
+	if err != nil {
+		return err
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		return errClaimLost
+	}
+	return nil
+}
+
+// queueCreatedEvents queues created events for the containers created since the last scan, up to
+// createdScanLag ago. The scan position is locked for the transaction so only one instance scans
+// at a time and each container is announced once. It returns the number of events queued.
+func queueCreatedEvents(db *DB) (int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var scannedTo, now time.Time
+	err = tx.Get(&scannedTo, "SELECT scanned_to FROM webhook_scans WHERE id=1 FOR UPDATE")
+	if err != nil {
+		return 0, fmt.Errorf("unable to get the scan position: %s", err.Error())
+	}
+	err = tx.Get(&now, "SELECT NOW(6)")
+	if err != nil {
+		return 0, err
+	}
+	scanTo := now.Add(-createdScanLag)
+	if scanTo.After(scannedTo) == false {
+		return 0, nil
+	}
+
+	var nodes []createdNode
+	err = tx.Select(&nodes, `SELECT n.id, n.pid, n.ancestry, nt.name as node_type, n.created_at FROM nodes n
+		INNER JOIN node_types nt ON nt.id = n.node_type_id
+		WHERE n.created_at > ? and n.created_at <= ? and nt.container=1 and n.current=1 and n.deleted=0
+		ORDER BY n.id ASC`, scannedTo, scanTo)
+	if err != nil {
+		return 0, fmt.Errorf("unable to find created containers: %s", err.Error())
+	}
+	events := createdEvents(nodes)
+	for _, created := range events {
+		err = queueWebhookEvent(tx, created.CollectionID, created.Event)
+		if err != nil {
+			return 0, fmt.Errorf("unable to queue created event for %s: %s", created.Event.PID, err.Error())
+		}
+	}
+	_, err = tx.Exec("UPDATE webhook_scans SET scanned_to=? WHERE id=1", scanTo)
+	if err != nil {
+		return 0, err
+	}
+	return len(events), tx.Commit()
+}
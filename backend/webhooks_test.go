@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a subscriber endpoint that records what it is sent
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []receivedEvent
+}
+
+type receivedEvent struct {
+	event     string
+	signature string
+	body      string
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.requests = append(wr.requests, receivedEvent{event: req.Header.Get("X-Apollo-Event"),
+		signature: req.Header.Get("X-Apollo-Signature"), body: string(body)})
+	w.WriteHeader(wr.status)
+}
+
+func (wr *webhookReceiver) respond(status int) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.status = status
+}
+
+func (wr *webhookReceiver) received() []receivedEvent {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return append([]receivedEvent{}, wr.requests...)
+}
+
+// getDeliveries returns the deliveries of a webhook from the API
+func getDeliveries(t *testing.T, router http.Handler, hookID int64, status string) []WebhookDelivery {
+	t.Helper()
+	path := fmt.Sprintf("/api/admin/webhooks/%d/deliveries?status=%s", hookID, status)
+	resp := doRequest(router, "GET", path, "", "admin1")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("GET %s returned %d: %s", path, resp.Code, resp.Body.String())
+	}
+	var out []struct {
+		WebhookDelivery
+		LastStatus int    `json:"lastStatus"`
+		LastError  string `json:"lastError"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &out); err != nil {
+		t.Fatalf("deliveries are not valid json: %s", err.Error())
+	}
+	deliveries := make([]WebhookDelivery, 0, len(out))
+	for _, d := range out {
+		d.WebhookDelivery.LastStatus.Int64 = int64(d.LastStatus)
+		d.WebhookDelivery.LastError.String = d.LastError
+		deliveries = append(deliveries, d.WebhookDelivery)
+	}
+	return deliveries
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	app := newTestApp(t)
+	repo := app.Repo.(*memoryRepository)
+	router := newHandler(app)
+	receiver := &webhookReceiver{status: http.StatusInternalServerError}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	body := fmt.Sprintf(`{"url": "%s/apollo", "collection": "uva-an1", "events": ["edited"], "secret": "s3cret"}`, server.URL)
+	resp := doRequest(router, "POST", "/api/admin/webhooks", body, "admin1")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("add webhook returned %d: %s", resp.Code, resp.Body.String())
+	}
+	var hook Webhook
+	json.Unmarshal(resp.Body.Bytes(), &hook)
+
+	edit := func(title string) {
+		t.Helper()
+		body := fmt.Sprintf(`{"title": "%s", "version": "%s"}`, title, currentVersion(t, router, "uva-an12"))
+		if resp := doRequest(router, "POST", "/api/nodes/12/update", body, "user1"); resp.Code != http.StatusOK {
+			t.Fatalf("update returned %d: %s", resp.Code, resp.Body.String())
+		}
+	}
+	edit("Vol. 1, no. 1")
+	pending := getDeliveries(t, router, hook.ID, "pending")
+	if len(pending) != 1 || pending[0].Event != "edited" || pending[0].Attempts != 0 {
+		t.Fatalf("expected one pending edited delivery: %+v", pending)
+	}
+
+	// a failed attempt is retried later
+	app.deliverDue(ctx, client, "worker1")
+	got := receiver.received()
+	if len(got) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(got))
+	}
+	if got[0].event != "edited" || got[0].signature != "sha256="+signPayload("s3cret", got[0].body) {
+		t.Errorf("request has event %s and signature %s", got[0].event, got[0].signature)
+	}
+	if got[0].body != pending[0].Payload {
+		t.Errorf("posted %s; payload is %s", got[0].body, pending[0].Payload)
+	}
+	retry := getDeliveries(t, router, hook.ID, "pending")
+	if len(retry) != 1 || retry[0].Attempts != 1 || retry[0].LastStatus.Int64 != http.StatusInternalServerError ||
+		retry[0].NextAttemptAt.Before(time.Now().Add(20*time.Second)) {
+		t.Fatalf("failed delivery was not scheduled for retry: %+v", retry)
+	}
+	app.deliverDue(ctx, client, "worker1")
+	if len(receiver.received()) != 1 {
+		t.Errorf("delivery was retried before it was due")
+	}
+
+	// when it is due again, a success marks it delivered
+	repo.deliveries[0].NextAttemptAt = time.Now().Add(-time.Second)
+	receiver.respond(http.StatusNoContent)
+	app.deliverDue(ctx, client, "worker1")
+	delivered := getDeliveries(t, router, hook.ID, "delivered")
+	if len(delivered) != 1 || delivered[0].Attempts != 2 || delivered[0].DeliveredAt == nil || delivered[0].LastError.String != "" {
+		t.Fatalf("delivery was not marked delivered: %+v", delivered)
+	}
+
+	// a delivery that fails on its last attempt is marked failed
+	edit("Vol. 1, no. 1, March")
+	repo.deliveries[1].Attempts = maxDeliveryAttempts - 1
+	receiver.respond(http.StatusBadGateway)
+	app.deliverDue(ctx, client, "worker1")
+	failed := getDeliveries(t, router, hook.ID, "failed")
+	if len(failed) != 1 || failed[0].Attempts != maxDeliveryAttempts || failed[0].LastError.String == "" {
+		t.Fatalf("delivery was not marked failed: %+v", failed)
+	}
+
+	resp = doRequest(router, "GET", "/api/admin/webhooks", "", "admin1")
+	var hooks []Webhook
+	json.Unmarshal(resp.Body.Bytes(), &hooks)
+	if len(hooks) != 1 || hooks[0].Delivered != 1 || hooks[0].Failed != 1 || hooks[0].Pending != 0 || hooks[0].Secret != "" {
+		t.Errorf("unexpected webhook list: %s", resp.Body.String())
+	}
+}
+
+func TestWebhookClaims(t *testing.T) {
+	app := newTestApp(t)
+	repo := app.Repo.(*memoryRepository)
+	router := newHandler(app)
+	receiver := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	body := fmt.Sprintf(`{"url": "%s", "events": ["edited"]}`, server.URL)
+	if resp := doRequest(router, "POST", "/api/admin/webhooks", body, "admin1"); resp.Code != http.StatusOK {
+		t.Fatalf("add webhook returned %d: %s", resp.Code, resp.Body.String())
+	}
+	body = fmt.Sprintf(`{"title": "Vol. 1", "version": "%s"}`, currentVersion(t, router, "uva-an9"))
+	if resp := doRequest(router, "POST", "/api/nodes/9/update", body, "user1"); resp.Code != http.StatusOK {
+		t.Fatalf("update returned %d: %s", resp.Code, resp.Body.String())
+	}
+
+	// a delivery claimed by one worker is not sent by another
+	claimed, _ := repo.ClaimDeliveries("worker1", 100)
+	if len(claimed) != 1 || claimed[0].Status != "sending" || claimed[0].URL != server.URL {
+		t.Fatalf("delivery was not claimed: %+v", claimed)
+	}
+	app.deliverDue(context.Background(), server.Client(), "worker2")
+	if len(receiver.received()) != 0 {
+		t.Fatalf("a claimed delivery was sent by another worker")
+	}
+
+	// a worker that stops releases its claims
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	app.deliverDue(canceled, server.Client(), "worker1")
+	if repo.deliveries[0].Status != "pending" || repo.deliveries[0].ClaimedBy.Valid {
+		t.Fatalf("claim was not released: %+v", repo.deliveries[0])
+	}
+
+	// a claim left by a worker that stopped mid-send expires
+	stale, _ := repo.ClaimDeliveries("worker1", 100)
+	expired := time.Now().Add(-claimTimeout - time.Minute)
+	repo.deliveries[0].ClaimedAt = &expired
+	app.deliverDue(context.Background(), server.Client(), "worker2")
+	if len(receiver.received()) != 1 || repo.deliveries[0].Status != "delivered" || repo.deliveries[0].Attempts != 1 {
+		t.Fatalf("expired claim was not delivered by another worker: %+v", repo.deliveries[0])
+	}
+
+	// the worker that lost the claim can't record its own result over the new one
+	stale[0].Attempts++
+	stale[0].Status = "pending"
+	if err := repo.RecordDelivery(&stale[0], time.Minute); err != errClaimLost {
+		t.Errorf("result recorded without the claim returned %v", err)
+	}
+	if repo.deliveries[0].Status != "delivered" || repo.deliveries[0].Attempts != 1 {
+		t.Errorf("result recorded without the claim changed the delivery: %+v", repo.deliveries[0])
+	}
+}
+
+func TestWebhookAdmin(t *testing.T) {
+	router := newTestRouter(t)
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"url": "ftp://example.com/hook"}`, http.StatusBadRequest},
+		{`{"url": "https://example.com/hook", "events": ["purged"]}`, http.StatusBadRequest},
+		{`{"url": "https://example.com/hook", "collection": "uva-an99999"}`, http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		resp := doRequest(router, "POST", "/api/admin/webhooks", tc.body, "admin1")
+		if resp.Code != tc.status {
+			t.Errorf("add webhook %s returned %d, expected %d: %s", tc.body, resp.Code, tc.status, resp.Body.String())
+		}
+	}
+
+	var scoped, all Webhook
+	checkJSON(t, doRequest(router, "POST", "/api/admin/webhooks",
+		`{"url": "https://example.com/mountain", "collection": "uva-an1", "events": ["deleted"]}`, "admin1"), http.StatusOK, &scoped)
+	if scoped.ID == 0 || scoped.Secret == "" || scoped.CollectionPID != "uva-an1" || scoped.ComputingID != "admin1" {
+		t.Errorf("unexpected webhook %+v", scoped)
+	}
+	checkJSON(t, doRequest(router, "POST", "/api/admin/webhooks",
+		`{"url": "https://example.com/all", "secret": "shh"}`, "admin1"), http.StatusOK, &all)
+	if all.Secret != "shh" || len(all.EventList) != len(webhookEvents) {
+		t.Errorf("unexpected webhook %+v", all)
+	}
+
+	// the scoped hook only gets deletes in its collection; the other gets every event
+	body := fmt.Sprintf(`{"title": "Salem fire, 1951", "version": "%s"}`, currentVersion(t, router, "uva-an109894"))
+	if resp := doRequest(router, "POST", "/api/nodes/109894/update", body, "user1"); resp.Code != http.StatusOK {
+		t.Fatalf("update returned %d: %s", resp.Code, resp.Body.String())
+	}
+	resp := doRequest(router, "DELETE", "/api/nodes/uva-an16?version="+currentVersion(t, router, "uva-an16"), "", "user1")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("delete returned %d: %s", resp.Code, resp.Body.String())
+	}
+	if got := getDeliveries(t, router, scoped.ID, ""); len(got) != 1 || got[0].Event != "deleted" || got[0].Status != "pending" {
+		t.Errorf("scoped webhook has deliveries %+v", got)
+	}
+	if got := getDeliveries(t, router, all.ID, "pending"); len(got) != 2 || got[0].Event != "deleted" || got[1].Event != "edited" {
+		t.Errorf("webhook for all collections has deliveries %+v", got)
+	}
+	if got := getDeliveries(t, router, all.ID, "delivered"); len(got) != 0 {
+		t.Errorf("webhook for all collections has delivered %+v", got)
+	}
+	path := fmt.Sprintf("/api/admin/webhooks/%d/deliveries?status=lost", all.ID)
+	if resp := doRequest(router, "GET", path, "", "admin1"); resp.Code != http.StatusBadRequest {
+		t.Errorf("GET %s returned %d, expected %d", path, resp.Code, http.StatusBadRequest)
+	}
+
+	var hooks []Webhook
+	checkJSON(t, doRequest(router, "GET", "/api/admin/webhooks", "", "admin1"), http.StatusOK, &hooks)
+	if len(hooks) != 2 || hooks[0].Secret != "" || hooks[0].Pending != 1 || hooks[1].Pending != 2 {
+		t.Errorf("unexpected webhook list %+v", hooks)
+	}
+
+	path = fmt.Sprintf("/api/admin/webhooks/%d", scoped.ID)
+	if resp := doRequest(router, "DELETE", path, "", "admin1"); resp.Code != http.StatusOK {
+		t.Errorf("DELETE %s returned %d: %s", path, resp.Code, resp.Body.String())
+	}
+	if resp := doRequest(router, "DELETE", path, "", "admin1"); resp.Code != http.StatusNotFound {
+		t.Errorf("second DELETE %s returned %d, expected %d", path, resp.Code, http.StatusNotFound)
+	}
+	if got := getDeliveries(t, router, scoped.ID, ""); len(got) != 0 {
+		t.Errorf("deleted webhook still has deliveries %+v", got)
+	}
+	checkJSON(t, doRequest(router, "GET", "/api/admin/webhooks", "", "admin1"), http.StatusOK, &hooks)
+	if len(hooks) != 1 || hooks[0].ID != all.ID {
+		t.Errorf("webhook list after the delete is %+v", hooks)
+	}
+}
+
+func TestCreatedEvents(t *testing.T) {
+	nodes := []createdNode{
+		{ID: 20, PID: "uva-an20", NodeType: "volume", Ancestry: sql.NullString{String: "1", Valid: true}},
+		{ID: 21, PID: "uva-an21", NodeType: "issue", Ancestry: sql.NullString{String: "1/20", Valid: true}},
+		{ID: 25, PID: "uva-an25", NodeType: "issue", Ancestry: sql.NullString{String: "1/9", Valid: true}},
+		{ID: 30, PID: "uva-an30", NodeType: "collection"},
+	}
+	got := createdEvents(nodes)
+	expected := []struct {
+		collectionID int64
+		pid          string
+		count        int
+	}{
+		{1, "uva-an20", 2}, {1, "uva-an25", 1}, {30, "uva-an30", 1},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("created events are %+v", got)
+	}
+	for idx, want := range expected {
+		evt := got[idx].Event
+		if got[idx].CollectionID != want.collectionID || evt.Event != "created" || evt.PID != want.pid || evt.Count != want.count {
+			t.Errorf("created event %d is %+v in collection %d, expected %+v", idx, evt, got[idx].CollectionID, want)
+		}
+	}
+}
+
+func TestWebhookCreated(t *testing.T) {
+	app := newTestApp(t)
+	repo := app.Repo.(*memoryRepository)
+	router := newHandler(app)
+
+	var all, scoped Webhook
+	checkJSON(t, doRequest(router, "POST", "/api/admin/webhooks", `{"url": "https://example.com/all"}`, "admin1"),
+		http.StatusOK, &all)
+	checkJSON(t, doRequest(router, "POST", "/api/admin/webhooks",
+		`{"url": "https://example.com/mountain", "collection": "uva-an1", "events": ["created"]}`, "admin1"), http.StatusOK, &scoped)
+
+	// the fixtures were there before the scan started, so they are not announced
+	if queued, err := repo.QueueCreatedEvents(); queued != 0 || err != nil {
+		t.Fatalf("created events queued for the fixtures: %d %v", queued, err)
+	}
+
+	// a new collection is announced once, with a count of its containers. One created within
+	// the scan lag is left for a later scan.
+	repo.scannedTo = time.Now().Add(-3 * createdScanLag)
+	newColl := `<collection><title>New</title><volume><title>Vol. 1</title><issue><title>No. 1</title></issue></volume></collection>`
+	coll, err := repo.LoadCollectionXML(strings.NewReader(newColl), time.Now().Add(-2*createdScanLag))
+	if err != nil {
+		t.Fatalf("unable to load collection: %s", err.Error())
+	}
+	if _, err := repo.LoadCollectionXML(strings.NewReader(newColl), time.Now()); err != nil {
+		t.Fatalf("unable to load collection: %s", err.Error())
+	}
+	if queued, err := repo.QueueCreatedEvents(); queued != 1 || err != nil {
+		t.Fatalf("queued %d created events, expected 1: %v", queued, err)
+	}
+	if queued, _ := repo.QueueCreatedEvents(); queued != 0 {
+		t.Errorf("a second scan queued %d created events", queued)
+	}
+
+	got := getDeliveries(t, router, all.ID, "pending")
+	if len(got) != 1 || got[0].Event != "created" {
+		t.Fatalf("webhook for all collections has deliveries %+v", got)
+	}
+	var evt WebhookEvent
+	json.Unmarshal([]byte(got[0].Payload), &evt)
+	if evt.PID != coll.PID || evt.Collection != coll.PID || evt.NodeType != "collection" || evt.Count != 3 {
+		t.Errorf("unexpected created event %+v", evt)
+	}
+	if got := getDeliveries(t, router, scoped.ID, ""); len(got) != 0 {
+		t.Errorf("webhook for another collection has deliveries %+v", got)
+	}
+}
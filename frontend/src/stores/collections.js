@@ -13,6 +13,7 @@ export const useCollectionsStore = defineStore('collections', {
       viewerError: null,
       selectedPID: "",
       editParentPID: "",
+      editVersion: "",
    }),
    getters: {
       hasError: state => {
@@ -85,16 +86,36 @@ export const useCollectionsStore = defineStore('collections', {
             this.loading = false
          })
       },
-      startEdit(pid) {
+      startEdit(pid, version) {
+         // edits must send the version of the item that was loaded with the collection, so
+         // changes made by someone else since then are detected instead of overwritten
+         if (!version) {
+            this.error = "Unable to edit " + pid + "; its version is unknown. Reload the collection and try again."
+            return
+         }
          this.editParentPID = pid
+         this.editVersion = version
       },
       cancelEdit() {
          this.editParentPID = ""
+         this.editVersion = ""
+      },
+      // typeahead completions for a value of a node type, most used first
+      getSuggestions( typeName, prefix ) {
+         return axios.get("/api/suggest", { params: { type: typeName, q: prefix } }).then((response) => {
+            return response.data
+         }).catch(() => {
+            return []
+         })
       },
       submitEdit( newTitle, newDescription ) {
+         if (this.editVersion == "") return
          let data = {title: newTitle, description: newDescription}
          let tgtNode = findNode(this.collectionDetails, this.editParentPID)
-         axios.post("/api/nodes/" + tgtNode.id + "/update", data).then((_response) => {
+         let headers = { "If-Match": this.editVersion }
+         axios.post("/api/nodes/" + tgtNode.id + "/update", data, { headers: headers }).then((response) => {
+            // the next edit must use the version that includes this one
+            tgtNode.version = response.headers.etag.replace(/"/g, "")
             tgtNode.attributes.forEach( a => {
                if (a.type.name == "title") {
                   a.values[0].value = newTitle
@@ -105,13 +126,16 @@ export const useCollectionsStore = defineStore('collections', {
             })
          }).catch((error) => {
             this.collectionDetails = {}
-            if (error.response) {
+            if (error.response && error.response.status == 409) {
+               this.error = "Unable to save changes; this item was changed by someone else. Reload to see the latest version."
+            } else if (error.response) {
                this.error = error.response.data
             } else {
                this.error = error
             }
          }).finally(() => {
             this.editParentPID = ""
+            this.editVersion = ""
          })
       },
 
@@ -286,6 +310,9 @@ function commonInit(json, currNode) {
    currNode.pid = json.pid
    currNode.type = json.type
    currNode.sequence = json.sequence
+   if (json.version) {
+      currNode.version = json.version
+   }
 }
 
 // See of the list of attributes already includes the attribute spacified